@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/justinas/alice"
 	vault_proxy "github.com/zendesk/vault-proxy/pkg/vault-proxy"
@@ -12,32 +17,117 @@ import (
 
 // Entrypoint of program.
 func main() {
-	defaultAddress := fmt.Sprintf("%s:%d", vault_proxy.PROXY_ADDR, vault_proxy.PROXY_PORT)
+	// Environment overrides of the config.go defaults
+	config := vault_proxy.LoadConfigFromEnv()
+
+	defaultAddress := fmt.Sprintf("%s:%d", config.ProxyAddr, config.ProxyPort)
+	defaultAdminAddress := fmt.Sprintf("%s:%d", config.AdminAddr, config.AdminPort)
 
 	// `flag` Enables CLI override of proxy address / port -- e.g.: go run . -addr "127.0.0.1:8888"
 	var proxyAddress = flag.String("addr", defaultAddress, "The addr of the application.")
+	var adminAddress = flag.String("admin-addr", defaultAdminAddress, "The addr of the admin listener.")
 	flag.Parse()
 
+	log.Printf("Effective configuration:\n%s", config)
+
 	// Vault Cache
-	vaultCache := vault_proxy.NewVaultCache()
+	vaultCache := vault_proxy.NewVaultCache(config)
+	vaultCache.StartEfficiencyReporter(vault_proxy.CACHE_REPORT_INTERVAL * time.Second)
+	vaultCache.StartMemoryGuard(vault_proxy.CACHE_MEMORY_GUARD_INTERVAL * time.Second)
+
+	// In-flight Requests
+	inFlightTracker := vault_proxy.NewInFlightTracker()
+
+	// Connection Limiter
+	connectionLimiter := vault_proxy.NewConnectionLimiter(vault_proxy.MAX_CONNECTIONS_PER_CLIENT_IP, vault_proxy.TRUSTED_PROXY_CIDRS[:])
+
+	// Proxy control headers clients aren't trusted with are dropped at the first agent
+	proxyHeaderFilter := vault_proxy.NewProxyHeaderFilter(vault_proxy.AGENT_PEER_CIDRS[:], vault_proxy.BURST_OVERRIDE_TRUSTED_CIDRS[:], vault_proxy.ROUTE_OVERRIDE_TRUSTED_CIDRS[:])
+
+	// Request Timeout
+	requestTimeout := vault_proxy.NewRequestTimeout(config.ProxyRequestTimeout)
 
 	// Parse Headers
-	parseHeader := vault_proxy.NewParseHeader()
+	parseHeader := vault_proxy.NewParseHeader(config)
+
+	// Proxy Metadata
+	proxyMetadataInjector := vault_proxy.NewProxyMetadataInjector(config, *proxyAddress)
+
+	// Background work (e.g. the routing table refresh) stops once shutdown begins
+	background, stopBackground := context.WithCancel(context.Background())
 
 	// Vault Agent
-	agent := vault_proxy.NewVaultAgent(*proxyAddress, vaultCache)
+	agent := vault_proxy.NewVaultAgent(background, config, *proxyAddress, vaultCache)
 
 	// Rate Limiter
-	rateLimiter := vault_proxy.NewTokenRateLimiter(vault_proxy.BURST_LIMIT_PER_SECOND, vault_proxy.RATE_LIMIT_PER_MINUTE, vault_proxy.RATE_LIMITER_BUCKET_SIZE, vaultCache)
+	rateLimiter := vault_proxy.NewTokenRateLimiter(config, vaultCache)
+
+	// Backends gating /readyz
+	agent.AddReadinessBackend("cache", vaultCache.PingBackend)
+	agent.AddReadinessBackend("rate_limiter", rateLimiter.PingBackend)
+
+	// Shadow Mirror
+	shadowMirror := vault_proxy.NewShadowMirror(config)
 
 	// Vault Proxy
-	proxyHandler := vault_proxy.NewVaultProxy(vault_proxy.VAULT_ADDR, vault_proxy.VAULT_PORT, vaultCache)
+	proxyHandler := vault_proxy.NewVaultProxy(config, vaultCache, shadowMirror)
 
 	// Chain Middlewares/Handlers
-	chain := alice.New(parseHeader.ParseHeaderHandler, agent.VaultAgentHandler, rateLimiter.RateLimitHandler).Then(proxyHandler)
+	chain := alice.New(inFlightTracker.InFlightHandler, vault_proxy.ClientIdentityHandler, proxyHeaderFilter.ProxyHeaderHandler, connectionLimiter.ConnectionLimitHandler, requestTimeout.RequestTimeoutHandler, parseHeader.ParseHeaderHandler, proxyMetadataInjector.ProxyMetadataHandler, agent.VaultAgentHandler, rateLimiter.RateLimitHandler, parseHeader.EntityLookupHandler).Then(proxyHandler)
+
+	// Probes and cache replicas pushed by neighbor agents are answered by the proxy itself, ahead of the chain,
+	// and never forwarded to Vault.
+	// Not a ServeMux, which would clean and redirect Vault paths.
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/healthz":
+			vault_proxy.HealthzHandler(writer, request)
+		case "/readyz":
+			agent.ReadyzHandler(writer, request)
+		case vault_proxy.CACHE_REPLICA_PATH:
+			agent.ReplicaHandler(writer, request)
+		default:
+			chain.ServeHTTP(writer, request)
+		}
+	})
+
+	// Admin listener
+	adminHandler := vault_proxy.NewAdminHandler(config, parseHeader, rateLimiter, vaultCache, agent)
+	adminServer := &http.Server{Addr: *adminAddress, Handler: adminHandler}
+	go func() {
+		log.Println("Starting admin server on", *adminAddress)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Admin ListenAndServe:", err)
+		}
+	}()
+
+	// TLS / mTLS on the proxy listener
+	tlsConfig, err := vault_proxy.NewProxyTLSConfig()
+	if err != nil {
+		log.Fatal("Proxy TLS configuration:", err)
+	}
+
+	server := &http.Server{Addr: *proxyAddress, Handler: handler, TLSConfig: tlsConfig}
+	go func() {
+		log.Println("Starting proxy server on", *proxyAddress)
+		var serveErr error
+		if tlsConfig != nil {
+			serveErr = server.ListenAndServeTLS("", "")
+		} else {
+			serveErr = server.ListenAndServe()
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			log.Fatal("ListenAndServe:", serveErr)
+		}
+	}()
+
+	// Drain in-flight requests on SIGINT/SIGTERM; the admin listener stays up until then so metrics can be scraped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s", <-signals)
+	stopBackground()
 
-	log.Println("Starting proxy server on", *proxyAddress)
-	if err := http.ListenAndServe(*proxyAddress, chain); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	if err := vault_proxy.GracefulShutdown(server, adminServer, inFlightTracker, time.Duration(config.ShutdownDrainTimeout)*time.Second); err != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,165 @@
+package vault_proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Admin Handler - served on a separate (non-public) listener, never proxied to Vault
+type adminHandler struct {
+	mux         *http.ServeMux
+	adminToken  string
+	parseHeader *parseHeader
+	rateLimiter *tokenRateLimiter
+	vaultCache  Cache
+	agent       *vaultAgent
+}
+
+// Should ALWAYS be used as the "constructor" for the adminHandler. Registers admin routes.
+func NewAdminHandler(config Config, parseHeader *parseHeader, rateLimiter *tokenRateLimiter, vaultCache Cache, agent *vaultAgent) *adminHandler {
+	a := &adminHandler{
+		mux:         http.NewServeMux(),
+		adminToken:  config.AdminToken,
+		parseHeader: parseHeader,
+		rateLimiter: rateLimiter,
+		vaultCache:  vaultCache,
+		agent:       agent,
+	}
+
+	a.mux.Handle("/metrics", promhttp.Handler())
+	a.mux.HandleFunc("/admin/config/methods-to-ignore", a.methodsToIgnoreHandler)
+	a.mux.HandleFunc("/admin/stats/rate-limiters", a.rateLimiterStatsHandler)
+	a.mux.HandleFunc("/admin/status", a.statusHandler)
+	a.mux.HandleFunc("/admin/cache/flush", a.cacheFlushHandler)
+	a.mux.HandleFunc("/admin/cache", a.cacheEntryHandler)
+	a.mux.HandleFunc("/admin/cache/stats", a.cacheStatsHandler)
+
+	if ENABLE_PPROF {
+		a.registerPprof()
+	}
+
+	if a.adminToken == "" {
+		log.Printf("Admin: neither ADMIN_TOKEN nor ADMIN_TOKEN_FILE is configured, all admin routes except /metrics will answer 403")
+	}
+
+	return a
+}
+
+// Mounts the net/http/pprof handlers under /debug/pprof/
+func (a *adminHandler) registerPprof() {
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// GET returns the ignorable methods list, PUT replaces it with a JSON array, e.g. ["DELETE","POST","PATCH","PUT"]
+func (a *adminHandler) methodsToIgnoreHandler(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var methods []string
+		if err := json.NewDecoder(request.Body).Decode(&methods); err != nil {
+			writeVaultError(writer, http.StatusBadRequest, "body must be a JSON array of method names")
+			return
+		}
+		log.Printf("Admin: reloading methods to ignore")
+		a.parseHeader.SetMethodsToIgnore(methods)
+	default:
+		writer.Header().Set("Allow", "GET, PUT")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(a.parseHeader.GetMethodsToIgnore())
+}
+
+// GET returns the occupancy and purge counts of the rate-limiters cache
+func (a *adminHandler) rateLimiterStatsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(a.rateLimiter.Stats())
+}
+
+// GET returns the size, capacity, hits, misses, evictions and hit ratio of the response cache
+func (a *adminHandler) cacheStatsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(a.vaultCache.Stats())
+}
+
+// POST drops every cached entry, e.g. after secrets were rotated outside of the proxy
+func (a *adminHandler) cacheFlushHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	removed := a.vaultCache.flush()
+	log.Printf("Admin: flushed %d entries from cache", removed)
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]int{"removed": removed})
+}
+
+// DELETE ?key=<cache key> drops a single cached entry, the cache key being the one logged on hits and misses
+func (a *adminHandler) cacheEntryHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		writer.Header().Set("Allow", "DELETE")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	key := request.URL.Query().Get("key")
+	if key == "" {
+		writeVaultError(writer, http.StatusBadRequest, "missing key query parameter")
+		return
+	}
+
+	// Invalidated like a write, so fetches already in flight don't cache the old value again
+	log.Printf("Admin: removing key %s from cache", key)
+	a.vaultCache.beginWrite(key)
+	a.vaultCache.endWrite(key)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// Returns `true` if the request carries the admin token. Fails closed: with no admin token configured nothing is authorized.
+func isAdminAuthorized(request *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(request.Header.Get(ADMIN_TOKEN_HEADER)), []byte(adminToken)) == 1
+}
+
+// Serves all admin HTTP traffic. Everything but /metrics requires the admin token.
+func (a *adminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/metrics" && !isAdminAuthorized(request, a.adminToken) {
+		if a.adminToken == "" {
+			log.Printf("Admin: rejecting %s, no admin token is configured", request.URL.Path)
+		}
+		writeVaultError(writer, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	a.mux.ServeHTTP(writer, request)
+}
@@ -0,0 +1,159 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminTokenFromFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(tokenFile, []byte("admin-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ADMIN_TOKEN_FILE", tokenFile)
+	config := newTestConfig(t)
+	admin := NewAdminHandler(config, NewParseHeader(config), nil, NewVaultCache(config), nil)
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		{"admin-secret", http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+		if tc.token != "" {
+			request.Header.Set(ADMIN_TOKEN_HEADER, tc.token)
+		}
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, request)
+		if recorder.Code != tc.want {
+			t.Errorf("admin token %q got status %d, want %d", tc.token, recorder.Code, tc.want)
+		}
+	}
+}
+
+// Returns the recorded response of the admin handler to the request, sent with the admin token unless it is empty
+func serveAdmin(admin http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		request.Header.Set(ADMIN_TOKEN_HEADER, token)
+	}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestPprofIsOnlyServedWhenEnabled(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	config := newTestConfig(t)
+	admin := NewAdminHandler(config, NewParseHeader(config), nil, NewVaultCache(config), nil)
+
+	if recorder := serveAdmin(admin, http.MethodGet, "/debug/pprof/", "admin-secret"); !ENABLE_PPROF && recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for the pprof index with ENABLE_PPROF off, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	// As mounted with ENABLE_PPROF, still behind the admin token
+	admin.registerPprof()
+	if recorder := serveAdmin(admin, http.MethodGet, "/debug/pprof/", "admin-secret"); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "goroutine") {
+		t.Errorf("got status %d for the enabled pprof index, want %d with the profiles", recorder.Code, http.StatusOK)
+	}
+	if recorder := serveAdmin(admin, http.MethodGet, "/debug/pprof/", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("got status %d for the pprof index without the admin token, want %d", recorder.Code, http.StatusForbidden)
+	}
+
+	// The proxy listener passes the path on to Vault like any other
+	var vaultPath string
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		vaultPath = request.URL.Path
+		http.NotFound(writer, request)
+	})
+	chain.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/debug/pprof/", "172.16.0.1:1234", "token"))
+	if vaultPath != "/debug/pprof/" {
+		t.Error("proxy listener did not pass /debug/pprof/ on to Vault")
+	}
+}
+
+func TestMethodsToIgnoreReloadAppliesToLaterRequests(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	config := newTestConfig(t)
+	parseHeader := NewParseHeader(config)
+	admin := NewAdminHandler(config, parseHeader, nil, NewVaultCache(config), nil)
+	put := newTestRequest(http.MethodPut, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	if parseRequest(parseHeader, put).IsRequestIgnorable() {
+		t.Fatal("PUT is ignorable before the reload")
+	}
+
+	request := httptest.NewRequest(http.MethodPut, "/admin/config/methods-to-ignore", strings.NewReader(`["delete","POST","PATCH"," put "]`))
+	request.Header.Set(ADMIN_TOKEN_HEADER, "admin-secret")
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, request)
+	if body := strings.TrimSpace(recorder.Body.String()); recorder.Code != http.StatusOK || body != `["DELETE","POST","PATCH","PUT"]` {
+		t.Fatalf("reload got status %d and body %s, want the normalized list", recorder.Code, body)
+	}
+
+	if !parseRequest(parseHeader, newTestRequest(http.MethodPut, "/v1/secret/data/foo", "172.16.0.1:1234", "token")).IsRequestIgnorable() {
+		t.Error("PUT is not ignorable after it was added at runtime")
+	}
+	if parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")).IsRequestIgnorable() {
+		t.Error("GET became ignorable after the reload")
+	}
+	if recorder := serveAdmin(admin, http.MethodGet, "/admin/config/methods-to-ignore", "admin-secret"); strings.TrimSpace(recorder.Body.String()) != `["DELETE","POST","PATCH","PUT"]` {
+		t.Errorf("got methods %s after the reload", recorder.Body.String())
+	}
+}
+
+func TestAdminFailsClosedWithoutASecret(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	config := newTestConfig(t)
+	admin := NewAdminHandler(config, NewParseHeader(config), nil, NewVaultCache(config), nil)
+
+	for _, path := range []string{"/admin/config/methods-to-ignore", "/admin/stats/rate-limiters", "/admin/status", "/admin/cache/flush", "/admin/cache", "/admin/cache/stats"} {
+		for _, token := range []string{"", "anything"} {
+			if recorder := serveAdmin(admin, http.MethodGet, path, token); recorder.Code != http.StatusForbidden {
+				t.Errorf("%s with token %q got status %d, want %d", path, token, recorder.Code, http.StatusForbidden)
+			}
+		}
+	}
+	if recorder := serveAdmin(admin, http.MethodGet, "/metrics", ""); recorder.Code != http.StatusOK {
+		t.Errorf("got status %d for /metrics, want it scrapeable without the admin token", recorder.Code)
+	}
+}
+
+func TestStatusPageHasEverySection(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	_, limiter := newRateLimitChain(t, nil)
+	agent := newTestAgent(t, "10.0.0.1:7444", "10.0.0.1:7444", "10.0.0.2:7444")
+	agent.lastConfigCheck = time.Now().UnixMilli()
+	admin := NewAdminHandler(agent.config, NewParseHeader(agent.config), limiter, agent.vaultCache, agent)
+
+	recorder := serveAdmin(admin, http.MethodGet, "/admin/status", "admin-secret")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &sections); err != nil {
+		t.Fatalf("status page %q is not JSON: %v", recorder.Body.String(), err)
+	}
+	for _, section := range []string{"version", "uptime_seconds", "cache", "rate_limiters", "routing"} {
+		if _, ok := sections[section]; !ok {
+			t.Errorf("status page has no %s section: %s", section, recorder.Body.String())
+		}
+	}
+
+	var status proxyStatus
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	if status.Version != Version || status.Cache.Capacity != agent.config.CacheSize || status.RateLimiters.Capacity != limiter.Stats().Capacity {
+		t.Errorf("got status %+v, want the version and the cache and limiter stats", status)
+	}
+	if len(status.Routing.RoutingTable) != 2 || status.Routing.MyAddress != "10.0.0.1:7444" || status.Routing.LastConfigCheck == nil {
+		t.Errorf("got routing %+v, want the routing table and the last config check", status.Routing)
+	}
+}
@@ -1,7 +1,9 @@
 package vault_proxy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
@@ -43,25 +45,53 @@ type VaultConfigResponse struct {
 
 // Vault Agent
 type vaultAgent struct {
-	vaultConfigResponse VaultConfigResponse
-	agentRoutingTable   map[int]string
-	lastConfigCheck     int64 // Millis since epoch of last vault config check;
-	lock                sync.RWMutex
-	myAddress           string
-	vaultCache          *vaultCache
+	vaultConfigResponse  VaultConfigResponse
+	agentRoutingTable    map[int]string
+	routingAddresses     []string        // Sorted agent addresses agentRoutingTable and routingRing were built from
+	routingRing          *consistentHash // Built from agentRoutingTable, routes routing keys to agents
+	lastConfigCheck      int64           // Millis since epoch of last vault config check;
+	lastConfigSuccess    int64           // Millis since epoch Vault last returned a non-empty raft configuration; 0 until then
+	lock                 sync.RWMutex
+	refreshLock          sync.Mutex // Serializes refreshVaultConfig, the only writer of the routing fields
+	myAddress            string
+	vaultCache           Cache
+	config               Config
+	vaultToken           string       // Token for the raft configuration fetch
+	agentScheme          string       // "https" when the proxy listener serves TLS
+	agentClient          *http.Client // Client for routing and replicating to other agents
+	routingKeyHeader     string       // ROUTING_KEY_HEADER
+	agentPeers           []*net.IPNet // AGENT_PEER_CIDRS, the peers allowed to push cache replicas
+	replicationNeighbors int          // CACHE_REPLICATION_NEIGHBORS
+	readinessBackends    []readinessBackend
+	requiredBackends     []string // READINESS_REQUIRED_BACKENDS
 }
 
-// Should ALWAYS be used as the "constructor" for the vaultAgent. Initializes rate-limiting.
-func NewVaultAgent(proxyAddress string, vaultCache *vaultCache) *vaultAgent {
-	return &vaultAgent{
-		agentRoutingTable: make(map[int]string),
-		lastConfigCheck:   0, // Force config check on startup
-		myAddress:         proxyAddress,
-		vaultCache:        vaultCache,
+// Should ALWAYS be used as the "constructor" for the vaultAgent. Starts refreshing the routing table
+// in the background until ctx is done.
+func NewVaultAgent(ctx context.Context, config Config, proxyAddress string, vaultCache Cache) *vaultAgent {
+	agentScheme, agentClient := newAgentClient(config)
+
+	a := &vaultAgent{
+		config:               config,
+		vaultToken:           config.VaultToken,
+		agentScheme:          agentScheme,
+		agentClient:          agentClient,
+		routingKeyHeader:     ROUTING_KEY_HEADER,
+		agentPeers:           parseCIDRs(AGENT_PEER_CIDRS[:], "agent peer"),
+		replicationNeighbors: CACHE_REPLICATION_NEIGHBORS,
+		requiredBackends:     READINESS_REQUIRED_BACKENDS[:],
+		agentRoutingTable:    make(map[int]string),
+		routingRing:          newConsistentHash(nil, ROUTING_VIRTUAL_NODES),
+		lastConfigCheck:      0,
+		myAddress:            proxyAddress,
+		vaultCache:           vaultCache,
 	}
+
+	go a.runConfigRefresh(ctx)
+	return a
 }
 
-// Add mock servers for local development
+// Add mock servers for local development (VAULT_PROXY_DEV only)
 func (a *vaultAgent) addMockServers(responseObject VaultConfigResponse) VaultConfigResponse {
 	mockServer1 := Server{
 		Address:         "127.0.0.1:9001",
@@ -86,53 +116,97 @@ func (a *vaultAgent) addMockServers(responseObject VaultConfigResponse) VaultCon
 	return responseObject
 }
 
-// Get raft peer details
-func (a *vaultAgent) getVaultConfigDetails() {
-	if time.Now().UnixMilli()-VAULT_CONFIG_CHECK_FREQUENCY*1000 > a.lastConfigCheck {
-		a.lock.Lock()
-		defer a.lock.Unlock()
-		addr := "http://" + VAULT_ADDR + ":" + strconv.Itoa(VAULT_PORT) + "/v1/sys/storage/raft/configuration"
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", addr, nil)
-		if err != nil {
-			log.Print(err.Error())
-		}
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("X-Vault-Token", VAULT_ROOT_TOKEN)
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Print(err.Error())
-		}
-		defer resp.Body.Close()
+// Records the time of a config check that left the routing table untouched
+func (a *vaultAgent) recordConfigCheck() {
+	a.lock.Lock()
+	a.lastConfigCheck = time.Now().UnixMilli()
+	a.lock.Unlock()
+}
 
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Print(err.Error())
+// Fetches the raft peer details from Vault and rebuilds the routing table from them. Everything is fetched
+// and built off-lock, the write lock is only held to swap the new table in, so routing never waits on Vault.
+func (a *vaultAgent) refreshVaultConfig() {
+	a.refreshLock.Lock()
+	defer a.refreshLock.Unlock()
+
+	addr := fmt.Sprintf("%s://%s:%d/v1/sys/storage/raft/configuration", a.config.VaultConfigScheme, a.config.VaultConfigAddr, a.config.VaultConfigPort)
+	timeout := time.Duration(a.config.VaultConfigTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client := newVaultClient(a.config, timeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	if err != nil {
+		log.Printf("Vault config request could not be built, keeping the current routing table: %v", err)
+		return
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(VAULT_TOKEN_HEADER, a.vaultToken)
+	if err = signUpstreamRequest(req); err != nil {
+		log.Printf("Vault config request could not be signed, keeping the current routing table: %v", err)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if isTimeoutError(err) {
+			log.Printf("Vault config request timed out after %v, keeping the current routing table", timeout)
+		} else {
+			log.Printf("Vault config request failed, keeping the current routing table: %v", err)
 		}
+		a.recordConfigCheck()
+		return
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		// e.g. the deadline hit while the body was still streaming
+		log.Printf("Vault config response could not be read, keeping the current routing table: %v", err)
+		a.recordConfigCheck()
+		return
+	}
 
-		var responseObject VaultConfigResponse
-		json.Unmarshal(bodyBytes, &responseObject)
-
-		// REMOVE THIS BEFORE DEPLOYMENT
-		a.vaultConfigResponse = a.addMockServers(responseObject)
-
-		// Changes ports from Agent use
-		a.changePortMapping()
-
-		// Sort and update the routing table
-		a.sortByNodeId()
+	var responseObject VaultConfigResponse
+	json.Unmarshal(bodyBytes, &responseObject)
+	isSuccess := resp.StatusCode == http.StatusOK && len(responseObject.Data.Config.Servers) > 0
+	// An error or empty raft config would wipe the routing table, local development routes to mock servers instead
+	if !isSuccess && !a.config.DevMode {
+		log.Printf("Vault config request returned status %d with no servers, keeping the current routing table", resp.StatusCode)
+		a.recordConfigCheck()
+		return
+	}
 
-		a.lastConfigCheck = time.Now().UnixMilli()
+	if a.config.DevMode {
+		responseObject = a.addMockServers(responseObject)
+	}
+	servers := responseObject.Data.Config.Servers
+
+	// Changes ports from Agent use
+	a.changePortMapping(servers)
+
+	// Sort and build the routing table
+	sortByNodeId(servers)
+	routingAddresses, routingTable, routingRing := a.buildRouting(servers)
+
+	a.lock.Lock()
+	a.vaultConfigResponse = responseObject
+	a.routingAddresses = routingAddresses
+	a.agentRoutingTable = routingTable
+	a.routingRing = routingRing
+	if isSuccess {
+		a.lastConfigSuccess = time.Now().UnixMilli()
 	}
+	a.lastConfigCheck = time.Now().UnixMilli()
+	a.lock.Unlock()
 }
 
 // Replaces vault ports with Agent port numbers
-// Agent Port Logic: port - AGENT_VAULT_PORT_DIFF
-// Ex - port=8444, AGENT_VAULT_PORT_DIFF=1000
+// Agent Port Logic: port - AgentVaultPortDiff
+// Ex - port=8444, AgentVaultPortDiff=1000
 // Agent Port = 8444 - 1000 = 7444
-func (a *vaultAgent) changePortMapping() {
-	for i, server := range a.vaultConfigResponse.Data.Config.Servers {
+func (a *vaultAgent) changePortMapping(servers []Server) {
+	for i, server := range servers {
 		serverAddress := server.Address
 		addrPort := strings.Split(serverAddress, ":")
 
@@ -142,28 +216,58 @@ func (a *vaultAgent) changePortMapping() {
 			log.Print(err.Error())
 		}
 
-		// For local development only
-		addrPort[1] = strconv.Itoa(port - AGENT_VAULT_PORT_DIFF + i)
-
-		// For other environments
-		// addrPort[1] = int(addrPort[1]) - AGENT_VAULT_PORT_DIFF
+		// Local development runs every agent on one host, so their ports are offset by index
+		agentPort := port - a.config.AgentVaultPortDiff
+		if a.config.DevMode {
+			agentPort += i
+		}
+		addrPort[1] = strconv.Itoa(agentPort)
 
-		a.vaultConfigResponse.Data.Config.Servers[i].Address = addrPort[0] + ":" + addrPort[1]
+		servers[i].Address = addrPort[0] + ":" + addrPort[1]
 	}
 }
 
-func (a *vaultAgent) sortByNodeId() {
-	nodes := a.vaultConfigResponse.Data.Config.Servers
-
+func sortByNodeId(nodes []Server) {
 	sort.Slice(nodes, func(i, j int) bool {
 		return nodes[i].NodeId < nodes[j].NodeId
 	})
 	log.Println("Sorted Nodes :", nodes)
+}
 
+// Builds the routing table and hash ring of the sorted servers. Raft membership rarely changes, so when the
+// addresses are the ones already routed to, the current table and ring are reused instead of rebuilt.
+// Must be called with refreshLock held, which excludes the only writer of the routing fields, so they're read without lock.
+func (a *vaultAgent) buildRouting(nodes []Server) ([]string, map[int]string, *consistentHash) {
+	addresses := make([]string, len(nodes))
 	for i, node := range nodes {
-		a.agentRoutingTable[i] = node.Address
+		addresses[i] = node.Address
+	}
+
+	if isSameAddresses(addresses, a.routingAddresses) && a.routingRing != nil {
+		return a.routingAddresses, a.agentRoutingTable, a.routingRing
+	}
+
+	// Rebuilt from scratch so entries of removed servers don't linger past the new server count
+	routingTable := make(map[int]string, len(addresses))
+	for i, address := range addresses {
+		routingTable[i] = address
+	}
+	log.Println("Agent Routing Table:", routingTable)
+
+	return addresses, routingTable, newConsistentHash(addresses, ROUTING_VIRTUAL_NODES)
+}
+
+// Returns `true` if both address lists are identical, in order
+func isSameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
-	log.Println("Agent Routing Table:", a.agentRoutingTable)
+	return true
 }
 
 // https://softwareengineering.stackexchange.com/questions/49550/which-hashing-algorithm-is-best-for-uniqueness-and-speed
@@ -180,11 +284,130 @@ func fnvHash(s string) uint32 {
 	return h.Sum32()
 }
 
-// Gets the routing server address
+// Gets the routing server address: the owner of the request's routing key (the token by default) on
+// the hash ring. Falls back to this agent while the ring is empty, so the request is processed locally.
 func (a *vaultAgent) GetRoutingServer(request *http.Request) string {
-	token := request.Header.Get(VAULT_TOKEN_HEADER)
-	server_no := int(hash(token)) % len(a.vaultConfigResponse.Data.Config.Servers)
-	return a.agentRoutingTable[server_no]
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if routingServer, ok := a.getRouteOverride(request); ok {
+		return routingServer
+	}
+
+	if routingServer := a.routingRing.get(getRoutingKey(request, a.routingKeyHeader)); routingServer != "" {
+		return routingServer
+	}
+
+	log.Printf("Routing table is empty, processing on the same agent: %s", a.myAddress)
+	return a.myAddress
+}
+
+// Returns the address of the node named by ROUTE_NODE_HEADER, if the node is in the current routing table.
+// The proxyHeaderFilter has already dropped the header unless a ROUTE_OVERRIDE_TRUSTED_CIDRS peer sent it.
+// Must be called with the lock held.
+func (a *vaultAgent) getRouteOverride(request *http.Request) (string, bool) {
+	nodeId := request.Header.Get(ROUTE_NODE_HEADER)
+	if nodeId == "" {
+		return "", false
+	}
+
+	for _, server := range a.vaultConfigResponse.Data.Config.Servers {
+		if server.NodeId == nodeId {
+			log.Printf("Routing forced to node %s (%s) by %s", nodeId, server.Address, ROUTE_NODE_HEADER)
+			return server.Address, true
+		}
+	}
+
+	log.Printf("Ignoring %s: node %s is not in the routing table", ROUTE_NODE_HEADER, nodeId)
+	return "", false
+}
+
+// Gets the addresses of the CACHE_REPLICATION_NEIGHBORS agents following the routing server on the ring
+func (a *vaultAgent) getNeighborServers(request *http.Request) []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	neighbors := make([]string, 0, a.replicationNeighbors)
+	for _, neighbor := range a.routingRing.successors(getRoutingKey(request, a.routingKeyHeader), a.replicationNeighbors) {
+		if neighbor != a.myAddress {
+			neighbors = append(neighbors, neighbor)
+		}
+	}
+
+	return neighbors
+}
+
+// Builds the request forwarded to another agent as a fresh copy of the inbound request with a replayable
+// body, leaving the inbound request untouched so it can still be processed here if forwarding fails.
+func (a *vaultAgent) newForwardRequest(request *http.Request, routingServer string) (*http.Request, error) {
+	if err := bufferRequestBody(request); err != nil {
+		return nil, err
+	}
+
+	target := *request.URL
+	target.Scheme = a.agentScheme
+	target.Host = routingServer
+
+	var body io.ReadCloser = http.NoBody
+	if request.GetBody != nil {
+		body, _ = request.GetBody()
+	}
+	forwardRequest, err := http.NewRequestWithContext(request.Context(), request.Method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardRequest.ContentLength = request.ContentLength
+	forwardRequest.GetBody = request.GetBody
+	forwardRequest.Header = request.Header.Clone()
+	forwardRequest.RemoteAddr = request.RemoteAddr
+	removeHopByHopHeaders(forwardRequest.Header)
+	appendForwardedFor(forwardRequest)
+	forwardRequest.Header.Add(AGENT_FORWARDED_HEADER, a.myAddress)
+	if identity := GetClientIdentity(request.Context()); identity != "" {
+		forwardRequest.Header.Set(CLIENT_IDENTITY_HEADER, identity)
+	}
+
+	return forwardRequest, nil
+}
+
+// Returns `true` if the request was already forwarded through this agent, or through AGENT_MAX_FORWARD_HOPS
+// agents, so forwarding it again could loop between agents whose routing tables disagree
+func (a *vaultAgent) isForwardLoop(request *http.Request) bool {
+	hops := 0
+	for _, field := range request.Header.Values(AGENT_FORWARDED_HEADER) {
+		for _, address := range strings.Split(field, ",") {
+			if address = strings.TrimSpace(address); address == "" {
+				continue
+			}
+			if address == a.myAddress {
+				return true
+			}
+			hops++
+		}
+	}
+	return hops >= AGENT_MAX_FORWARD_HOPS
+}
+
+// Refreshes the raft peer details right away, then every VaultConfigCheckFrequency seconds until ctx is done,
+// so no request ever waits on the fetch
+func (a *vaultAgent) runConfigRefresh(ctx context.Context) {
+	a.refreshVaultConfig()
+	if a.config.VaultConfigCheckFrequency <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(a.config.VaultConfigCheckFrequency) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping the Vault config refresh: %v", ctx.Err())
+			return
+		case <-ticker.C:
+			a.refreshVaultConfig()
+		}
+	}
 }
 
 // Vault Agent Handler - Routes request to other agents
@@ -192,9 +415,6 @@ func (a *vaultAgent) GetRoutingServer(request *http.Request) string {
 // else runs on the same agent
 func (a *vaultAgent) VaultAgentHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		// Fetches and stores the current vault configuration every VAULT_CONFIG_CHECK_FREQUENCY seconds
-		a.getVaultConfigDetails()
-
 		// If routingServer address is different, then forward the request to routingServer agent
 		// else run the request on the same agent
 		path := request.URL.Path
@@ -202,56 +422,68 @@ func (a *vaultAgent) VaultAgentHandler(next http.Handler) http.Handler {
 		myAddress := a.myAddress
 		log.Printf("My server address: %s", myAddress)
 
-		isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsPathCacheable()
-		isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsRequestIgnorable()
+		isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsPathCacheable()
+		isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsRequestIgnorable()
 
 		// Forward the request to Vault if path is not cacheable
 		if isPathCacheable {
 			// create/update/delete request - Invalidate cache
 			if isRequestIgnorable {
 				log.Printf("Invalidating cache: Method %s Path: %s", method, path)
-				key := request.Context().Value(parsedHeaderContextKey).(*parseHeader).GetVaultCacheKey()
-				a.vaultCache.removeFromCache(key)
+				key := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).GetPathCacheKey()
+
+				// Reads of the path, in every variant, bypass the cache until the write has completed
+				a.vaultCache.beginWrite(key)
+				defer a.vaultCache.endWrite(key)
 			} else {
 				// Gets the routing server address
 				routingServer := a.GetRoutingServer(request)
 
+				if routingServer != myAddress && a.isForwardLoop(request) {
+					log.Printf("Forward loop: Agent %s would route back through %s, processing on the same Agent Path: %s", myAddress, request.Header.Values(AGENT_FORWARDED_HEADER), path)
+					agentForwardErrorsTotal.WithLabelValues("loop").Inc()
+					routingServer = myAddress
+				} else if routingServer == myAddress && a.replicationNeighbors > 0 {
+					// Cache miss on the owning agent - push the entry to the neighbors once this request has been served
+					if cachedResponse, keyExists := a.vaultCache.getFromCache(a.vaultCache.getEntryKey(request)); !keyExists || cachedResponse.isExpired() {
+						defer a.replicateToNeighbors(request)
+					}
+				}
+
+				routingDecisionsTotal.WithLabelValues(routingNodeLabel(routingServer, myAddress)).Inc()
+
 				// Read request - route to agent
 				if routingServer != myAddress {
-					// Request URI must be dumped, it can't be set in client requests.
-					// http://golang.org/src/pkg/net/http/client.go
-					request.RequestURI = ""
-					request.URL.Scheme = "http"
-					request.URL.Host = routingServer
-
-					client := &http.Client{Timeout: AGENT_REQUEST_TIMEOUT * time.Second}
-					response := new(http.Response)
-					var err error = nil
+					forwardRequest, err := a.newForwardRequest(request, routingServer)
+					if err != nil {
+						writeRequestBodyError(writer, err)
+						return
+					}
 
 					log.Printf("Routing to Agent: %s Path: %s", routingServer, path)
-					response, err = client.Do(request)
+					agentForwardsTotal.Inc()
+					response, err := a.agentClient.Do(forwardRequest)
 
 					if err != nil {
 						// if there is an error check if its a timeout error
 						if e, ok := err.(net.Error); ok && e.Timeout() {
 							// timeout error
 							log.Printf("Agent to request timed out: Processing request on the same Agent")
+							agentForwardErrorsTotal.WithLabelValues("timeout").Inc()
 						} else {
 							// Todo: this should throw an alert in Datadog.
 							// http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
 							log.Printf("Error from Agent: %s %v", routingServer, err)
+							agentForwardErrorsTotal.WithLabelValues("error").Inc()
 							log.Printf("Running on the same agent due to connection error: %s Path: %s", myAddress, path)
 						}
 					} else {
 						defer response.Body.Close()
+						setProxyMetadataCache(request, "forwarded", routingServer)
 
 						copyHeaders(writer.Header(), response.Header)
 						writer.WriteHeader(response.StatusCode)
-						_, err = io.Copy(writer, response.Body)
-
-						if err != nil {
-							log.Fatal("Error copying response from agent.", err)
-						}
+						copyResponseBody(writer, response.Body, "agent")
 						return
 					}
 				} else {
@@ -0,0 +1,415 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRoutingKeyHeader(t *testing.T) {
+	agent := newTestAgent(t, "10.0.0.1:7444", "10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.3:7444")
+	agent.routingKeyHeader = "X-Tenant-ID"
+
+	// Tokens of the same tenant all land on the tenant's agent
+	routedTo := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", fmt.Sprintf("token-%d", i))
+		request.Header.Set("X-Tenant-ID", "tenant-a")
+		routedTo[agent.GetRoutingServer(request)] = true
+	}
+	if len(routedTo) != 1 {
+		t.Errorf("tokens of one tenant were routed to %d agents, want 1: %v", len(routedTo), routedTo)
+	}
+
+	// Without the header requests fall back to their tokens, which spread over the agents
+	routedTo = make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		routedTo[agent.GetRoutingServer(newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", fmt.Sprintf("token-%d", i)))] = true
+	}
+	if len(routedTo) < 2 {
+		t.Errorf("tokens without a routing key were all routed to %v", routedTo)
+	}
+}
+
+func TestRoutingKeyHeaderDoesNotChangeLimiterKey(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	limiterKey := func(token string, tenant string) string {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token)
+		request.Header.Set("X-Tenant-ID", tenant)
+		return parseRequest(parseHeader, request).GetLimiterCacheKey()
+	}
+
+	if limiterKey("token-a", "tenant-1") != limiterKey("token-a", "tenant-2") {
+		t.Error("rotating the routing key gave the token a fresh rate-limit bucket")
+	}
+	if limiterKey("token-a", "tenant-1") == limiterKey("token-b", "tenant-1") {
+		t.Error("tokens sharing a routing key share a rate-limit bucket")
+	}
+}
+
+func TestRouteNodeHeader(t *testing.T) {
+	agent := newTestAgent(t, "10.0.0.1:7444", "10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.3:7444")
+
+	// Every token is forced onto the named node
+	for i := 0; i < 20; i++ {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.9:1234", fmt.Sprintf("token-%d", i))
+		request.Header.Set(ROUTE_NODE_HEADER, "node3")
+		if routedTo := agent.GetRoutingServer(request); routedTo != "10.0.0.3:7444" {
+			t.Fatalf("request forced to node3 was routed to %s", routedTo)
+		}
+	}
+
+	// An unknown node falls back to the ring
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.9:1234", "token-a")
+	want := agent.GetRoutingServer(request)
+	request.Header.Set(ROUTE_NODE_HEADER, "node9")
+	if routedTo := agent.GetRoutingServer(request); routedTo != want {
+		t.Errorf("request forced to an unknown node was routed to %s, want the ring's %s", routedTo, want)
+	}
+}
+
+func TestRouteNodeHeaderRoutedThroughAgent(t *testing.T) {
+	filter := NewProxyHeaderFilter([]string{"192.168.0.0/16"}, nil, []string{"10.0.0.0/8"})
+	var forwarded http.Header
+	firstHop := filter.ProxyHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		forwarded = request.Header.Clone()
+	}))
+
+	// An untrusted client loses the header at the agent it connects to, before any agent routes it on
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	request.Header.Set(ROUTE_NODE_HEADER, "node3")
+	serveTimes(firstHop, request, 1)
+	if forwarded.Get(ROUTE_NODE_HEADER) != "" {
+		t.Errorf("first hop let %s of an untrusted client through", ROUTE_NODE_HEADER)
+	}
+
+	// A trusted client keeps it, and so does a request another agent routed on
+	for _, remoteAddr := range []string{"10.0.0.9:1234", "192.168.0.2:1234"} {
+		request = newTestRequest(http.MethodGet, "/v1/secret/data/foo", remoteAddr, "token")
+		request.Header.Set(ROUTE_NODE_HEADER, "node3")
+		serveTimes(firstHop, request, 1)
+		if forwarded.Get(ROUTE_NODE_HEADER) != "node3" {
+			t.Errorf("first hop dropped %s from %s", ROUTE_NODE_HEADER, remoteAddr)
+		}
+	}
+}
+
+// Starts two agents behind the proxy header filter, each answering with its own address once it keeps a
+// request. `routesTo` builds the addresses each agent routes over from the agents' addresses.
+func startAgentPair(t *testing.T, routesTo func(first string, second string) ([]string, []string)) (string, string, map[string]http.Handler) {
+	handlers := make(map[string]http.Handler)
+	var addresses [2]string
+	for i := range addresses {
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			handlers[request.Host].ServeHTTP(writer, request)
+		}))
+		t.Cleanup(server.Close)
+		addresses[i] = server.Listener.Addr().String()
+	}
+
+	first, second := routesTo(addresses[0], addresses[1])
+	for i, routing := range [][]string{first, second} {
+		agent := newTestAgent(t, addresses[i], routing...)
+		filter := NewProxyHeaderFilter(AGENT_PEER_CIDRS[:], BURST_OVERRIDE_TRUSTED_CIDRS[:], ROUTE_OVERRIDE_TRUSTED_CIDRS[:])
+		served := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(agent.myAddress))
+		})
+		handlers[addresses[i]] = filter.ProxyHeaderHandler(NewParseHeader(agent.config).ParseHeaderHandler(agent.VaultAgentHandler(served)))
+	}
+	return addresses[0], addresses[1], handlers
+}
+
+func TestForwardLoopBetweenTwoAgents(t *testing.T) {
+	// Routing tables that disagree: each agent thinks the other owns every token. Neither agent is in the
+	// (default, empty) AGENT_PEER_CIDRS, so this also checks the forwarded header survives the header filter.
+	first, _, _ := startAgentPair(t, func(first string, second string) ([]string, []string) {
+		return []string{second}, []string{first}
+	})
+
+	forwardsBefore := testutil.ToFloat64(agentForwardsTotal)
+	response, err := http.Get("http://" + first + "/v1/secret/data/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	forwards := testutil.ToFloat64(agentForwardsTotal) - forwardsBefore
+
+	if response.StatusCode != http.StatusOK || string(body) != first {
+		t.Errorf("got %d from %q, want 200 from %s", response.StatusCode, body, first)
+	}
+	if forwards != AGENT_MAX_FORWARD_HOPS {
+		t.Errorf("request was forwarded %v times, want %d", forwards, AGENT_MAX_FORWARD_HOPS)
+	}
+}
+
+func TestForgedForwardedHeaderKeepsRequestLocal(t *testing.T) {
+	// Both agents agree the second owns every token
+	first, _, handlers := startAgentPair(t, func(first string, second string) ([]string, []string) {
+		return []string{second}, []string{second}
+	})
+
+	// A client claiming the request already went through the first agent only gets it served there
+	request := newTestRequest(http.MethodGet, "http://"+first+"/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	request.Header.Set(AGENT_FORWARDED_HEADER, first)
+	recorder := httptest.NewRecorder()
+	handlers[first].ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != first {
+		t.Errorf("got %d from %q, want 200 from %s", recorder.Code, recorder.Body.String(), first)
+	}
+}
+
+func TestEmptyRoutingTableIsProcessedLocally(t *testing.T) {
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+
+	// The raft configuration was never fetched, so the agent knows no servers
+	agent := newTestAgent(t, "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	chain := NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != `{"data":{"value":"secret"}}` {
+			t.Errorf("%s: got %d %q with an empty routing table, want Vault's response", method, recorder.Code, recorder.Body.String())
+		}
+	}
+	if server := agent.GetRoutingServer(newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")); server != "127.0.0.1:7444" {
+		t.Errorf("got routing server %q, want the agent's own address", server)
+	}
+}
+
+func TestRoutingDecisionsAreCountedPerNode(t *testing.T) {
+	const requests = 2000
+	addresses := []string{"127.0.0.1:7444"}
+	for i := 0; i < 3; i++ {
+		peer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(`{"data":{}}`))
+		}))
+		t.Cleanup(peer.Close)
+		addresses = append(addresses, peer.Listener.Addr().String())
+	}
+	agent := newTestAgent(t, addresses[0], addresses...)
+	served := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"data":{}}`))
+	})
+	handler := NewParseHeader(agent.config).ParseHeaderHandler(agent.VaultAgentHandler(served))
+
+	labels := append([]string{"local"}, addresses[1:]...)
+	before := make(map[string]float64, len(labels))
+	for _, label := range labels {
+		before[label] = testutil.ToFloat64(routingDecisionsTotal.WithLabelValues(label))
+	}
+	for i := 0; i < requests; i++ {
+		serveTimes(handler, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", fmt.Sprintf("token-%d", i)), 1)
+	}
+
+	total := 0.0
+	for _, label := range labels {
+		decisions := testutil.ToFloat64(routingDecisionsTotal.WithLabelValues(label)) - before[label]
+		total += decisions
+
+		// Each of the 4 nodes' fair share is 1/4, allow for the uneven spread of the virtual nodes
+		if share := decisions / requests; share < 0.15 || share > 0.35 {
+			t.Errorf("node %s got %.1f%% of the routing decisions, want about 25%%", label, share*100)
+		}
+	}
+	if total != requests {
+		t.Errorf("per-node routing decisions sum to %v, want %d", total, requests)
+	}
+}
+
+func TestRaftConfigurationIsUsedUntouchedOutsideDevMode(t *testing.T) {
+	raftConfiguration := `{"data":{"config":{"index":1,"servers":[` +
+		`{"address":"10.0.0.1:8444","leader":true,"node_id":"node1","protocol_version":"3","voter":true},` +
+		`{"address":"10.0.0.2:8444","leader":false,"node_id":"node2","protocol_version":"3","voter":true},` +
+		`{"address":"10.0.0.3:8444","leader":false,"node_id":"node3","protocol_version":"3","voter":false}]}}}`
+	var want VaultConfigResponse
+	if err := json.Unmarshal([]byte(raftConfiguration), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, devMode := range []bool{false, true} {
+		t.Setenv("VAULT_PROXY_DEV", strconv.FormatBool(devMode))
+		agent := newTestAgent(t, "10.0.0.1:7444")
+		agent.config = newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+			io.WriteString(writer, raftConfiguration)
+		})
+		agent.refreshVaultConfig()
+
+		servers := agent.vaultConfigResponse.Data.Config.Servers
+		if devMode {
+			if len(servers) != len(want.Data.Config.Servers)+2 {
+				t.Errorf("dev mode: got servers %+v, want the two mock peers added", servers)
+			}
+			continue
+		}
+
+		// Only the Vault port is swapped for the agent port, by the same offset for every server
+		if len(servers) != len(want.Data.Config.Servers) {
+			t.Fatalf("got servers %+v, want exactly the %d Vault returned", servers, len(want.Data.Config.Servers))
+		}
+		for i, server := range servers {
+			expected := want.Data.Config.Servers[i]
+			expected.Address = strings.Replace(expected.Address, ":8444", ":7444", 1)
+			if server != expected {
+				t.Errorf("got server %+v, want %+v as returned by Vault", server, expected)
+			}
+		}
+	}
+}
+
+func TestFailedConfigRefreshKeepsRoutingTable(t *testing.T) {
+	addresses := []string{"10.0.0.1:7444", "10.0.0.2:7444"}
+	agent := newTestAgent(t, addresses[0], addresses...)
+	agent.config = newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, `{"errors":["local node not active but active cluster node not found"]}`, http.StatusInternalServerError)
+	})
+
+	agent.refreshVaultConfig()
+
+	if len(agent.routingAddresses) != len(addresses) || len(agent.vaultConfigResponse.Data.Config.Servers) != len(addresses) {
+		t.Fatalf("failed config refresh replaced the routing table with %v", agent.routingAddresses)
+	}
+	if agent.lastConfigCheck == 0 {
+		t.Error("failed config refresh was not recorded as a check")
+	}
+	if agent.lastConfigSuccess != 0 {
+		t.Error("failed config refresh was recorded as a success")
+	}
+}
+
+func TestForwardedBodyReachesThePeerIntact(t *testing.T) {
+	const body = `{"list":["a","b"],"nested":{"value":"secret"}}`
+	var received, contentType string
+	var contentLength int64
+	peer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, _ := io.ReadAll(request.Body)
+		received, contentType, contentLength = string(data), request.Header.Get("Content-Type"), request.ContentLength
+		writer.Write([]byte("peer"))
+	}))
+	t.Cleanup(peer.Close)
+
+	agent := newTestAgent(t, "127.0.0.1:7444", peer.Listener.Addr().String())
+	local := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("local"))
+	})
+	handler := NewParseHeader(agent.config).ParseHeaderHandler(agent.VaultAgentHandler(local))
+
+	request := httptest.NewRequest(http.MethodGet, "/v1/secret/data/foo", strings.NewReader(body))
+	request.RemoteAddr = "172.16.0.1:1234"
+	request.Header.Set(VAULT_TOKEN_HEADER, "token")
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Body.String() != "peer" {
+		t.Fatalf("got %q, want the request forwarded to the peer", recorder.Body.String())
+	}
+	if received != body || contentLength != int64(len(body)) || contentType != "application/json" {
+		t.Errorf("peer received %q (%d bytes, %s), want %q (%d bytes, application/json)", received, contentLength, contentType, body, len(body))
+	}
+}
+
+func TestFailedForwardKeepsTheBodyForTheLocalAgent(t *testing.T) {
+	const body = `{"value":"secret"}`
+	peer := httptest.NewServer(http.NotFoundHandler())
+	address := peer.Listener.Addr().String()
+	peer.Close()
+
+	agent := newTestAgent(t, "127.0.0.1:7444", address)
+	var received string
+	local := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, _ := io.ReadAll(request.Body)
+		received = string(data)
+	})
+	handler := NewParseHeader(agent.config).ParseHeaderHandler(agent.VaultAgentHandler(local))
+
+	request := httptest.NewRequest(http.MethodGet, "/v1/secret/data/foo", strings.NewReader(body))
+	request.RemoteAddr = "172.16.0.1:1234"
+	request.Header.Set(VAULT_TOKEN_HEADER, "token")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if received != body {
+		t.Errorf("local agent received %q after the forward failed, want %q", received, body)
+	}
+}
+
+func TestConfigFetchUsesItsOwnUpstream(t *testing.T) {
+	var configPaths, dataPaths []string
+	configVault := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		configPaths = append(configPaths, request.URL.Path)
+		io.WriteString(writer, `{"data":{"config":{"index":1,"servers":[{"address":"10.0.0.2:8444","node_id":"node2"},{"address":"10.0.0.1:8444","node_id":"node1"}]}}}`)
+	}))
+	t.Cleanup(configVault.Close)
+	host, port, _ := net.SplitHostPort(configVault.Listener.Addr().String())
+	t.Setenv("VAULT_CONFIG_ADDR", host)
+	t.Setenv("VAULT_CONFIG_PORT", port)
+
+	handler, agent := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		dataPaths = append(dataPaths, request.URL.Path)
+		io.WriteString(writer, `{"data":{"value":"secret"}}`)
+	})
+
+	agent.refreshVaultConfig()
+	if len(configPaths) != 1 || configPaths[0] != "/v1/sys/storage/raft/configuration" {
+		t.Errorf("config upstream got %v, want the raft configuration fetch", configPaths)
+	}
+	if want := []string{"10.0.0.1:7444", "10.0.0.2:7444"}; strings.Join(agent.routingAddresses, ",") != strings.Join(want, ",") {
+		t.Errorf("got routing addresses %v, want %v from the config upstream", agent.routingAddresses, want)
+	}
+
+	// Data traffic still goes to VAULT_ADDR, kept on this agent since the test can't reach the fetched peers
+	agent.routingAddresses, agent.routingRing = []string{agent.myAddress}, newConsistentHash([]string{agent.myAddress}, ROUTING_VIRTUAL_NODES)
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if len(dataPaths) != 1 || dataPaths[0] != "/v1/secret/data/foo" || len(configPaths) != 1 {
+		t.Errorf("data upstream got %v and config upstream %v, want the read on the data upstream only", dataPaths, configPaths)
+	}
+}
+
+// Returns `count` raft servers sorted by node id, as refreshVaultConfig passes them to buildRouting
+func benchmarkServers(count int, port int) []Server {
+	servers := make([]Server, count)
+	for i := range servers {
+		servers[i] = Server{Address: fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, port), NodeId: fmt.Sprintf("node%05d", i)}
+	}
+	return servers
+}
+
+func BenchmarkBuildRouting(b *testing.B) {
+	servers := benchmarkServers(3000, 7444)
+
+	b.Run("unchanged membership", func(b *testing.B) {
+		agent := &vaultAgent{}
+		agent.routingAddresses, agent.agentRoutingTable, agent.routingRing = agent.buildRouting(servers)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			agent.buildRouting(servers)
+		}
+	})
+
+	b.Run("rebuild", func(b *testing.B) {
+		// Alternates between two memberships so every refresh has to rebuild the table and ring
+		memberships := [][]Server{servers, benchmarkServers(3000, 7445)}
+		agent := &vaultAgent{}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			agent.routingAddresses, agent.agentRoutingTable, agent.routingRing = agent.buildRouting(memberships[i%2])
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package vault_proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Returns the AES-256-GCM cipher for cached bodies, keyed on the sha256 of CACHE_ENCRYPTION_KEY, or nil when no
+// key is configured. Bodies then never sit in memory (or the shared cache) in plaintext, e.g. in heap dumps.
+func newBodyCipher(key string) cipher.AEAD {
+	if key == "" {
+		return nil
+	}
+
+	derived := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		log.Fatal("Invalid CACHE_ENCRYPTION_KEY: ", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("Invalid CACHE_ENCRYPTION_KEY: ", err)
+	}
+	return aead
+}
+
+// Returns the body encrypted under a random nonce, prefixed with the nonce. Returns it as is without a cipher.
+// Fails if no nonce could be generated, the body must then not be cached.
+func sealBody(aead cipher.AEAD, body []byte) ([]byte, error) {
+	if aead == nil {
+		return body, nil
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate a cache encryption nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, body, nil), nil
+}
+
+// Returns the body sealed by sealBody. Fails if it was sealed under another key or was tampered with.
+func openBody(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if aead == nil {
+		return sealed, nil
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed body is shorter than its nonce")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
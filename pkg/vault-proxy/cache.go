@@ -1,136 +1,366 @@
 package vault_proxy
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
+// Response cache the handler chain depends on
+type Cache interface {
+	getCachedResponse(request *http.Request) (*http.Response, error)
+	refreshCache(request *http.Request, refresher func(*http.Request) (*http.Response, error)) (*http.Response, error)
+	getFromCache(key string) (*cachedResponse, bool)
+	getEntryKey(request *http.Request) string
+	exportEntry(key string) ([]byte, bool)
+	importEntry(pathKey string, cacheKey string, key string, data []byte) error
+	setInCache(key string, entry *cachedResponse)
+	removeFromCache(key string)
+	flush() int
+	getStaleResponse(request *http.Request) (*http.Response, bool)
+	getGraceResponse(request *http.Request) (*http.Response, bool)
+	beginWrite(key string)
+	endWrite(key string)
+	Stats() cacheStats
+	PingBackend() error
+	StartEfficiencyReporter(interval time.Duration)
+	StartMemoryGuard(interval time.Duration)
+}
+
 // Cache
 type vaultCache struct {
+	config         Config
 	lock           sync.RWMutex
 	cache          map[string]*cachedResponse
-	lastCachePurge int64 // Millis since epoch of last cache purge; Used by purgeOldCacheEntries()
+	bytes          int64                  // Sum of the body sizes of the entries in cache; guarded by lock
+	varies         map[string]*varyState  // Cache key -> variants, for keys whose responses Vary on request headers
+	queries        map[string]*queryState // Path cache key -> entries of reads of the path with a query
+	lastCachePurge int64                  // Millis since epoch of last cache purge; Used by purgeOldCacheEntries()
+
+	lastTokenValidation int64 // Millis since epoch of last sampled token validation; accessed atomically
+	lastFlush           int64 // Millis since epoch of the last flush; accessed atomically
+
+	bufferSlots    chan struct{} // Semaphore bounding concurrent response body buffering in newCachedResponse
+	writesDisabled int32         // 1 while the memory guard has disabled new entries; accessed atomically
+	bodyCipher     cipher.AEAD   // Seals cached bodies; nil unless CACHE_ENCRYPTION_KEY is set
+
+	propagateWarnings   bool // PROPAGATE_VAULT_WARNINGS
+	skipEmptyData       bool // SKIP_CACHING_EMPTY_DATA
+	entriesPerToken     int  // CACHE_ENTRIES_PER_TOKEN
+	entriesPerNamespace int  // CACHE_ENTRIES_PER_NAMESPACE
+	gracePeriod         int  // STALE_GRACE_PERIOD, seconds
+	staleWindow         int  // STALE_WHILE_REVALIDATE, seconds
+
+	refreshes singleflight.Group // Collapses concurrent misses for a key into one fetch
+
+	writesLock sync.Mutex
+	writes     map[string]*writeState // In-flight and recently finished writes per cache key
+
+	efficiency cacheEfficiency  // Counters for the periodic efficiency report
+	totals     cacheTotals      // Counters since startup, for Stats
+	hitRatio   *hitRatioMonitor // Alerts when the hit ratio drops below CACHE_HIT_RATIO_ALERT_THRESHOLD
+
+	shared *redisCache // nil unless CACHE_BACKEND is "redis"
 }
 
-// Should ALWAYS be used as the "constructor" for the vaultCache. Initializes cache.
-func NewVaultCache() *vaultCache {
+// Should ALWAYS be used as the "constructor" for the vaultCache. Initializes cache on the CACHE_BACKEND.
+func NewVaultCache(config Config) Cache {
 	vc := new(vaultCache)
-	vc.cache = make(map[string]*cachedResponse, CACHE_SIZE)
+	vc.bodyCipher = newBodyCipher(config.CacheEncryptionKey)
+	vc.propagateWarnings = PROPAGATE_VAULT_WARNINGS
+	vc.skipEmptyData = SKIP_CACHING_EMPTY_DATA
+	vc.entriesPerToken = CACHE_ENTRIES_PER_TOKEN
+	vc.entriesPerNamespace = CACHE_ENTRIES_PER_NAMESPACE
+	vc.gracePeriod = STALE_GRACE_PERIOD
+	vc.staleWindow = STALE_WHILE_REVALIDATE
+	switch config.CacheBackend {
+	case "memory":
+	case "redis":
+		vc.shared = newRedisCache(newRedisBackend(config), vc.bodyCipher)
+	default:
+		log.Fatalf("Invalid CACHE_BACKEND %q: must be \"memory\" or \"redis\"", config.CacheBackend)
+	}
+
+	vc.config = config
+	vc.cache = make(map[string]*cachedResponse, config.CacheSize)
 	vc.lastCachePurge = time.Now().UnixMilli()
+	vc.bufferSlots = make(chan struct{}, MAX_CONCURRENT_BODY_BUFFERING)
+	vc.writes = make(map[string]*writeState)
+	vc.varies = make(map[string]*varyState)
+	vc.queries = make(map[string]*queryState)
+	vc.hitRatio = newHitRatioMonitor(CACHE_HIT_RATIO_ALERT_THRESHOLD, CACHE_HIT_RATIO_ALERT_WINDOW, CACHE_HIT_RATIO_ALERT_MIN_REQUESTS, config.CacheHitRatioAlertWebhook)
 	return vc
 }
 
-// Reads data from cache
+// Reads data from cache, falling back to the shared cache for missing or expired entries
 func (c *vaultCache) getFromCache(key string) (*cachedResponse, bool) {
 	c.lock.RLock()
-	defer c.lock.RUnlock()
 	d, keyExists := c.cache[key]
+	c.lock.RUnlock()
+
+	if c.shared != nil && (!keyExists || d.isExpired()) {
+		if shared, isShared := c.shared.load(key); isShared && (!keyExists || shared.expires > d.expires) {
+			if !c.areWritesDisabled() && (c.config.MaxCacheBytes <= 0 || shared.size() <= int64(c.config.MaxCacheBytes)) {
+				c.setInMemory(key, shared)
+			}
+			return shared, true
+		}
+	}
 	return d, keyExists
 }
 
-// Writes data to cache
-func (c *vaultCache) setInCache(key string, response *http.Response) {
+// Pings the shared cache, nil if CACHE_BACKEND is "memory"
+func (c *vaultCache) PingBackend() error {
+	if c.shared == nil {
+		return nil
+	}
+	return c.shared.redis.ping()
+}
+
+// Writes data to cache, and to the shared cache
+func (c *vaultCache) setInCache(key string, entry *cachedResponse) {
+	c.setInMemory(key, entry)
+	if c.shared != nil {
+		c.shared.store(key, entry)
+	}
+}
+
+// Writes data to this agent's cache only
+func (c *vaultCache) setInMemory(key string, entry *cachedResponse) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	// A token at its quota evicts its own oldest entry instead of other tokens' entries
+	if _, keyExists := c.cache[key]; !keyExists && c.entriesPerToken > 0 && entry.token != "" {
+		c.purgeQuotaEntries(c.entriesPerToken, func(cachedResponse *cachedResponse) bool {
+			return cachedResponse.token == entry.token
+		})
+	}
+
+	// A namespace at its quota evicts its own least recently used entry, so it can't monopolize the cache
+	if _, keyExists := c.cache[key]; !keyExists && c.entriesPerNamespace > 0 {
+		c.purgeQuotaEntries(c.entriesPerNamespace, func(cachedResponse *cachedResponse) bool {
+			return cachedResponse.namespace == entry.namespace
+		})
+	}
+
+	// An entry being replaced frees its bytes first
+	c.deleteEntry(key)
+
 	// Checks if cache is full and removes item using LRU policy
-	c.purgeLruCacheEntries()
+	c.purgeLruCacheEntries(entry.size())
 
-	c.cache[key] = newCachedResponse(response)
+	c.cache[key] = entry
+	c.bytes += entry.size()
+	c.efficiency.recordStore(entry.expires - time.Now().UnixMilli())
+	cacheEntries.Set(float64(len(c.cache)))
+	cacheBytes.Set(float64(c.bytes))
 }
 
-// Deletes data to cache
+// Deletes an entry of this agent's cache. Must be called with the write lock held.
+func (c *vaultCache) deleteEntry(key string) {
+	if entry, keyExists := c.cache[key]; keyExists {
+		c.bytes -= entry.size()
+		delete(c.cache, key)
+	}
+	cacheBytes.Set(float64(c.bytes))
+}
+
+// Deletes data from cache, and from the shared cache. Variants of the key, and the query variants of a path key,
+// are deleted with it.
 func (c *vaultCache) removeFromCache(key string) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.deleteEntry(key)
+	variants := append(c.removeVariants(key), c.removeQueryVariants(key)...)
+	cacheEntries.Set(float64(len(c.cache)))
+	c.lock.Unlock()
 
-	delete(c.cache, key)
+	if c.shared != nil {
+		c.shared.remove(append(variants, key)...)
+	}
 }
 
-// Parses relevant data from the request object as needed for caching.
-func (c *vaultCache) parseVaultRequest(request *http.Request) (string, string, string) {
-	return request.Header.Get(VAULT_TOKEN_HEADER),
-		request.Header.Get(VAULT_NAMESPACE_HEADER),
-		request.URL.Path
+// Deletes every entry, including those of the shared cache. Returns the number of entries this agent held.
+func (c *vaultCache) flush() int {
+	atomic.StoreInt64(&c.lastFlush, time.Now().UnixMilli())
+
+	c.lock.Lock()
+	removed := len(c.cache)
+	c.cache = make(map[string]*cachedResponse, c.config.CacheSize)
+	c.varies = make(map[string]*varyState)
+	c.queries = make(map[string]*queryState)
+	c.bytes = 0
+	cacheEntries.Set(0)
+	cacheBytes.Set(0)
+	c.lock.Unlock()
+
+	if c.shared != nil {
+		c.shared.flush()
+	}
+	return removed
 }
 
-// Purges 1/4 of the least recently used items from cache when full
-func (c *vaultCache) purgeLruCacheEntries() {
-	if len(c.cache) >= CACHE_SIZE {
-		log.Printf("Purging vault cache because its full.")
-		// Get cache keys
-		keys := make([]string, 0, len(c.cache))
-		for key := range c.cache {
-			keys = append(keys, key)
-		}
+// Purges 1/4 of the least recently used items from cache when full, then least recently used items
+// until `incomingBytes` more fit within MAX_CACHE_BYTES
+func (c *vaultCache) purgeLruCacheEntries(incomingBytes int64) {
+	budget := int64(c.config.MaxCacheBytes) - incomingBytes
+	isFull, isOverBudget := len(c.cache) >= c.config.CacheSize, c.config.MaxCacheBytes > 0 && c.bytes > budget
+	if !isFull && !isOverBudget {
+		return
+	}
+	defer observePurge("purgeLruCacheEntries", time.Now())
 
-		// Sort by cache expiration
-		sort.SliceStable(keys, func(i, j int) bool {
-			return c.cache[keys[i]].lastUsed < c.cache[keys[j]].lastUsed
-		})
+	if isFull {
+		log.Printf("Purging vault cache because its full.")
+		c.evictLruEntries()
+	}
 
-		for i, k := range keys {
-			delete(c.cache, k)
-			if i >= len(c.cache)/4 {
+	// Evicting for size can already have brought the cache within its byte budget
+	if c.config.MaxCacheBytes > 0 && c.bytes > budget {
+		log.Printf("Purging vault cache because it holds %d of its %d bytes.", c.bytes, c.config.MaxCacheBytes)
+		sizeBefore := len(c.cache)
+		for _, key := range c.lruKeys() {
+			if c.bytes <= budget {
 				break
 			}
+			c.deleteEntry(key)
+		}
+		c.recordEvictions(int64(sizeBefore - len(c.cache)))
+	}
+}
+
+// Returns the cache keys, least recently used first. Must be called with the lock held.
+func (c *vaultCache) lruKeys() []string {
+	// Get cache keys
+	keys := make([]string, 0, len(c.cache))
+	for key := range c.cache {
+		keys = append(keys, key)
+	}
+
+	// Sort by cache expiration
+	sort.SliceStable(keys, func(i, j int) bool {
+		return c.cache[keys[i]].lastUsed < c.cache[keys[j]].lastUsed
+	})
+	return keys
+}
+
+// Evicts 1/4 of the least recently used items. Must be called with the write lock held.
+func (c *vaultCache) evictLruEntries() {
+	sizeBefore := len(c.cache)
+	for i, k := range c.lruKeys() {
+		c.deleteEntry(k)
+		if i >= len(c.cache)/4 {
+			break
+		}
+	}
+	c.recordEvictions(int64(sizeBefore - len(c.cache)))
+}
+
+// Evicts the least recently used entry among those matching `belongs` once they reach `quota` entries.
+// Must be called with the write lock held.
+func (c *vaultCache) purgeQuotaEntries(quota int, belongs func(*cachedResponse) bool) {
+	count := 0
+	oldestKey := ""
+	for key, cachedResponse := range c.cache {
+		if !belongs(cachedResponse) {
+			continue
+		}
+
+		count++
+		if oldestKey == "" || cachedResponse.lastUsed < c.cache[oldestKey].lastUsed {
+			oldestKey = key
 		}
 	}
+
+	if count >= quota {
+		log.Printf("Cache quota of %d entries reached, evicting %s.", quota, oldestKey)
+		c.deleteEntry(oldestKey)
+		c.recordEvictions(1)
+	}
 }
 
-// Purges expired items from cache on configured VAULT_CACHE_PURGE_FREQUENCY
+// Purges expired items from cache on configured VaultCachePurgeFrequency
 func (c *vaultCache) purgeOldCacheEntries() {
-	if time.Now().UnixMilli()-VAULT_CACHE_PURGE_FREQUENCY*1000 > c.lastCachePurge {
+	if time.Now().UnixMilli()-int64(c.config.VaultCachePurgeFrequency)*1000 > c.lastCachePurge {
 		// Lock cache so purge is not interrupted.
 		c.lock.Lock()
 		defer c.lock.Unlock()
+		defer observePurge("purgeOldCacheEntries", time.Now())
 
-		log.Printf("Purging cache. It has not been purged in %d seconds.", VAULT_CACHE_PURGE_FREQUENCY)
+		log.Printf("Purging cache. It has not been purged in %d seconds.", c.config.VaultCachePurgeFrequency)
 		for key, cachedResponse := range c.cache {
-			if cachedResponse.isExpired() {
+			if cachedResponse.isExpired() && !cachedResponse.isWithinGrace(c.gracePeriod) {
 				log.Printf("Expired key detected, deleting %s from cache.", key)
-				delete(c.cache, key)
+				c.deleteEntry(key)
+				c.recordEvictions(1)
 			}
 		}
 
+		cacheEntries.Set(float64(len(c.cache)))
+		c.purgeVariants()
+		c.purgeQueryVariants()
+		c.purgeFinishedWrites()
+
 		c.lastCachePurge = time.Now().UnixMilli()
 	}
 }
 
-// Converts request details into a hashed cache key
-func (c *vaultCache) getMD5HashedCacheKey(request *http.Request) string {
-	token, namespace, path := c.parseVaultRequest(request)
-	vaultHashKey := fmt.Sprintf("%s-%s-%s", token, path, namespace)
-
-	// Generate MD5 hash from vault token/path/namespace
-	hasher := md5.New()
-	hasher.Write([]byte(vaultHashKey))
-	md5Hex := hex.EncodeToString(hasher.Sum(nil))
+// Gets the hashed cache key computed for this request by ParseHeaderHandler
+func (c *vaultCache) getCacheKey(request *http.Request) string {
+	return request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).GetVaultCacheKey()
+}
 
-	return md5Hex
+// Gets the hashed cache key of the request without its query, which writes to its path are tracked under
+func (c *vaultCache) getPathKey(request *http.Request) string {
+	return request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).GetPathCacheKey()
 }
 
 // Retrieves cached response if present, otherwise returns error
 func (c *vaultCache) getCachedResponse(request *http.Request) (*http.Response, error) {
 	c.purgeOldCacheEntries()
+	c.validateCachedTokens()
 	var err error = nil
 	var response *http.Response = &http.Response{}
-	cacheKey := c.getMD5HashedCacheKey(request)
-	cachedResponse, keyExists := c.getFromCache(cacheKey)
-	if keyExists && !cachedResponse.isExpired() {
+	cacheKey, entryKey := c.getCacheKey(request), c.getEntryKey(request)
+	cachedResponse, keyExists := c.getFromCache(entryKey)
+	if c.isWriteInFlight(c.getPathKey(request)) {
+		// The cached value may predate the write, go upstream until it finishes
+		c.recordLookup(false)
+		err = errors.New("write in flight for key")
+	} else if keyExists && !cachedResponse.isExpired() {
 		// Update last access time to avoid LRU cache purging
 		cachedResponse.lastUsed = time.Now().UnixMilli()
+		atomic.AddInt64(&cachedResponse.hits, 1)
+		c.recordLookup(true)
+		if cachedResponse.negative {
+			cacheNegativeHitsTotal.Inc()
+		}
 
-		log.Printf("CACHE HIT: Key: %s found in cache, returning cached response!", cacheKey)
+		if cachedResponse.isStale() {
+			log.Printf("CACHE HIT: Key: %s found in cache but is stale, returning cached response and refreshing!", cacheKey)
+		} else {
+			log.Printf("CACHE HIT: Key: %s found in cache, returning cached response!", cacheKey)
+		}
 		response = cachedResponse.getResponse()
+		if metadata := getProxyMetadata(request.Context()); metadata != nil {
+			age := (time.Now().UnixMilli() - cachedResponse.storedAt) / 1000
+			metadata.Cache, metadata.AgeSeconds = "hit", &age
+		}
+
+		c.refreshAhead(c.getPathKey(request), entryKey, cachedResponse)
 	} else {
+		c.recordLookup(false)
 		err = errors.New("key not found in cache")
 	}
 
@@ -139,19 +369,289 @@ func (c *vaultCache) getCachedResponse(request *http.Request) (*http.Response, e
 	return response, err
 }
 
-// Refreshes the cache by fetching token from Vault
-func (c *vaultCache) refreshCache(request *http.Request, refresher func() (*http.Response, error)) (*http.Response, error) {
+// Claims one of the MAX_CONCURRENT_BODY_BUFFERING buffering slots without blocking.
+// Returns `false` when all slots are busy, in which case the response should stream through uncached.
+func (c *vaultCache) tryAcquireBufferSlot() bool {
+	select {
+	case c.bufferSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Releases a slot claimed by tryAcquireBufferSlot
+func (c *vaultCache) releaseBufferSlot() {
+	<-c.bufferSlots
+}
+
+// Writes an entry fetched at `fetchStart` (millis since epoch) to cache under `key`, unless its lease is too short
+// to be worth caching or a write to its path (`pathKey`) was in flight since the fetch started.
+func (c *vaultCache) storeEntry(pathKey string, key string, entry *cachedResponse, fetchStart int64) {
+	if c.areWritesDisabled() {
+		log.Printf("NOT CACHING: Key: %s memory is above CACHE_MEMORY_LIMIT_MB.", key)
+		return
+	}
+
+	if fetchStart <= atomic.LoadInt64(&c.lastFlush) {
+		log.Printf("NOT CACHING: Key: %s the cache was flushed while it was being fetched.", key)
+		return
+	}
+
+	if c.writtenSince(pathKey, fetchStart) {
+		log.Printf("NOT CACHING: Key: %s was written while it was being fetched.", key)
+		return
+	}
+
+	// Leases about to expire are not worth caching and risk serving a dead secret
+	if entry.leaseDuration > 0 && entry.leaseDuration < int64(c.config.VaultCacheMinTtl) {
+		log.Printf("NOT CACHING: Key: %s lease of %d seconds is below the minimum cache TTL of %d seconds.", key, entry.leaseDuration, c.config.VaultCacheMinTtl)
+		return
+	}
+
+	// Caching it would evict the whole cache and still not fit
+	if c.config.MaxCacheBytes > 0 && entry.size() > int64(c.config.MaxCacheBytes) {
+		log.Printf("NOT CACHING: Key: %s body is larger than MAX_CACHE_BYTES.", key)
+		return
+	}
+
+	// e.g. a deleted KV v2 version; caching it would hide a later undelete
+	if c.skipEmptyData && entry.emptyData && entry.response.StatusCode == 200 {
+		log.Printf("NOT CACHING: Key: %s response has no data.", key)
+		return
+	}
+
+	// HEAD responses never have a body, anything else is truncated or broken
+	isHead := entry.response.Request != nil && entry.response.Request.Method == http.MethodHead
+	if SKIP_CACHING_EMPTY_BODY && len(entry.getBody()) == 0 && entry.response.StatusCode == 200 && !isHead {
+		log.Printf("NOT CACHING: Key: %s response has an empty body.", key)
+		return
+	}
+
+	c.setInCache(key, entry)
+}
+
+// Detaches a copy of the request from the client connection so the entry can be re-fetched after the client is gone
+func newBackgroundRefresh(request *http.Request, refresher func(*http.Request) (*http.Response, error)) func(context.Context) (*http.Response, error) {
+	backgroundRequest := request.Clone(context.Background())
+	backgroundRequest.Body = http.NoBody
+
+	return func(ctx context.Context) (*http.Response, error) {
+		refreshRequest := backgroundRequest.Clone(ctx)
+		// Bodies buffered for body-keyed entries (CACHE_KEY_RULES) are replayed so the refresh matches the key
+		if refreshRequest.GetBody != nil {
+			refreshRequest.Body, _ = refreshRequest.GetBody()
+		}
+		return refresher(refreshRequest)
+	}
+}
+
+// Refreshes an entry in the background once it is past its soft TTL, or once a hot entry enters its
+// refresh-ahead window, so clients never observe an expired entry. At most one refresh runs per entry.
+func (c *vaultCache) refreshAhead(pathKey string, key string, entry *cachedResponse) {
+	if entry.refresh == nil {
+		return
+	}
+	isHot := atomic.LoadInt64(&entry.hits) >= REFRESH_AHEAD_MIN_HITS
+	if !entry.isStale() && (time.Now().UnixMilli() < entry.refreshAt || !isHot) {
+		return
+	}
+
+	// Single-flight: a failed refresh is not retried, the entry simply expires
+	if !atomic.CompareAndSwapInt32(&entry.refreshing, 0, 1) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.ProxyRequestTimeout)*time.Second)
+		defer cancel()
+
+		log.Printf("REFRESH AHEAD: Key: %s is stale or hot and close to expiry. Refreshing....", key)
+		fetchStart := time.Now().UnixMilli()
+		response, err := entry.refresh(ctx)
+		if err != nil {
+			log.Printf("REFRESH AHEAD: Key: %s refresh failed: %v", key, err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != 200 {
+			log.Printf("REFRESH AHEAD: Key: %s refresh returned status %d, keeping current entry", key, response.StatusCode)
+			return
+		}
+
+		if !c.tryAcquireBufferSlot() {
+			log.Printf("REFRESH AHEAD: Key: %s skipped, too many responses are being buffered", key)
+			return
+		}
+		defer c.releaseBufferSlot()
+
+		fresh, err := newCachedResponse(response, c.config.VaultCacheDefaultExpiration, c.config.VaultCacheMaxTtl, c.staleWindow, c.bodyCipher)
+		if err != nil {
+			log.Printf("REFRESH AHEAD: Key: %s body could not be sealed, keeping current entry: %v", key, err)
+			return
+		}
+		if fresh == nil {
+			log.Printf("REFRESH AHEAD: Key: %s body is above MAX_CACHEABLE_BODY_BYTES, keeping current entry", key)
+			return
+		}
+		if c.propagateWarnings {
+			fresh.addWarningsHeader()
+		}
+		fresh.token = entry.token
+		fresh.namespace = entry.namespace
+		fresh.path = entry.path
+		fresh.refresh = entry.refresh
+		c.storeEntry(pathKey, key, fresh, fetchStart)
+	}()
+}
+
+// Result of a fetch shared by concurrent misses for one key
+type refreshResult struct {
+	response *http.Response
+	entry    *cachedResponse // nil if the response streamed through uncached
+	request  *http.Request   // The leading request the response was fetched for
+}
+
+// Refreshes the cache by fetching token from Vault. Concurrent misses for the same entry share a single fetch,
+// each getting its own copy of the buffered body; responses that streamed through uncached, or Vary on request
+// headers the follower has other values of, are fetched again.
+func (c *vaultCache) refreshCache(request *http.Request, refresher func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	cacheKey := c.getCacheKey(request)
+	log.Printf("CACHE MISS: Key: %s NOT found in cache or value is expired. Looking up....", cacheKey)
+
+	// Keyed on the variant once responses for the key are known to Vary
+	isLeader := false
+	result, err, _ := c.refreshes.Do(c.getEntryKey(request), func() (interface{}, error) {
+		isLeader = true
+		response, entry, err := c.fetchAndStore(request, refresher)
+		return refreshResult{response, entry, request}, err
+	})
+	shared := result.(refreshResult)
+	if isLeader {
+		return shared.response, err
+	}
+
+	// The leading client went away, which says nothing about Vault
+	if errors.Is(err, context.Canceled) || (err == nil && (shared.entry == nil || !isSameVariant(cacheKey, shared, request))) {
+		response, _, err := c.fetchAndStore(request, refresher)
+		return response, err
+	}
+	if err != nil {
+		return shared.response, err
+	}
+
+	log.Printf("CACHE MISS: Key: %s shared a concurrent fetch.", cacheKey)
+	cacheRefreshesTotal.WithLabelValues("shared").Inc()
+	response := *shared.entry.response
+	response.Header = response.Header.Clone()
+	response.Body = io.NopCloser(bytes.NewReader(shared.entry.getBody()))
+	return &response, nil
+}
+
+// Returns `true` if the request selects the same variant of the shared response as the leading request did,
+// always the case for responses without a Vary header
+func isSameVariant(cacheKey string, shared refreshResult, request *http.Request) bool {
+	varyHeaders := parseVary(shared.entry.response.Header)
+	return len(varyHeaders) == 0 || variantKey(cacheKey, varyHeaders, shared.request) == variantKey(cacheKey, varyHeaders, request)
+}
+
+// Returns the TTL in seconds a 4xx response with the status is cached for, and `false` if it isn't cached.
+// Statuses CACHEABLE_ERROR_STATUS_TTLS maps to 0 are cached for NEGATIVE_CACHE_TTL.
+func getErrorTtl(status int) (int, bool) {
+	if status < 400 || status >= 500 {
+		return 0, false
+	}
+
+	ttl, isListed := CACHEABLE_ERROR_STATUS_TTLS[status]
+	if isListed && ttl == 0 {
+		ttl = NEGATIVE_CACHE_TTL
+	}
+	return ttl, isListed && ttl > 0
+}
+
+// Fetches the response from Vault and caches it. Also returns the buffered entry, nil if the response streams through uncached.
+func (c *vaultCache) fetchAndStore(request *http.Request, refresher func(*http.Request) (*http.Response, error)) (*http.Response, *cachedResponse, error) {
 	var err error = nil
 	var response *http.Response = &http.Response{}
-	cacheKey := c.getMD5HashedCacheKey(request)
+	var entry *cachedResponse
+	cacheKey := c.getCacheKey(request)
 
-	log.Printf("CACHE MISS: Key: %s NOT found in cache or value is expired. Looking up....", cacheKey)
-	response, err = refresher()
-	if response.StatusCode == 200 {
-		c.setInCache(cacheKey, response)
+	fetchStart := time.Now().UnixMilli()
+	response, err = refresher(request)
+	if err != nil {
+		cacheRefreshesTotal.WithLabelValues("error").Inc()
+	}
+	errorTtl, isCacheableError := 0, false
+	if err == nil {
+		errorTtl, isCacheableError = getErrorTtl(response.StatusCode)
+	}
+	if err == nil && (response.StatusCode == 200 || isCacheableError) {
+		// Responses Vault marks as not shareable, or whose variants can't be told apart, are never cached
+		directives, varyHeaders := parseCacheControl(response.Header), parseVary(response.Header)
+		isNoStore := RESPECT_UPSTREAM_CACHE_CONTROL && (directives.noStore || directives.hasMaxAge && directives.maxAge == 0)
+		if isNoStore || (len(varyHeaders) > 0 && varyHeaders[0] == "*") {
+			log.Printf("NOT CACHING: Key: %s response is marked uncacheable by its Cache-Control or Vary header.", cacheKey)
+			cacheRefreshesTotal.WithLabelValues("uncached").Inc()
+			return response, nil, err
+		}
+
+		// Under memory pressure nothing is cached, so don't buffer the body either
+		if c.areWritesDisabled() {
+			log.Printf("NOT CACHING: Key: %s memory is above CACHE_MEMORY_LIMIT_MB, streaming uncached.", cacheKey)
+			cacheRefreshesTotal.WithLabelValues("uncached").Inc()
+			return response, nil, err
+		}
+
+		// Bound peak memory: excess concurrent misses stream straight through instead of buffering
+		if !c.tryAcquireBufferSlot() {
+			log.Printf("NOT CACHING: Key: %s too many responses are being buffered, streaming uncached.", cacheKey)
+			cacheRefreshesTotal.WithLabelValues("uncached").Inc()
+			return response, nil, err
+		}
+		defer c.releaseBufferSlot()
+
+		entry, err = newCachedResponse(response, c.config.VaultCacheDefaultExpiration, c.config.VaultCacheMaxTtl, c.staleWindow, c.bodyCipher)
+		if err != nil {
+			log.Printf("NOT CACHING: Key: %s body could not be sealed, streaming uncached: %v", cacheKey, err)
+			cacheRefreshesTotal.WithLabelValues("uncached").Inc()
+			return response, nil, nil
+		}
+		if entry == nil {
+			log.Printf("NOT CACHING: Key: %s body is above MAX_CACHEABLE_BODY_BYTES, streaming uncached.", cacheKey)
+			cacheRefreshesTotal.WithLabelValues("uncached").Inc()
+			return response, nil, err
+		}
+		if c.propagateWarnings {
+			entry.addWarningsHeader()
+		}
+		entry.token = getVaultToken(request)
+		entry.namespace = strings.Trim(request.Header.Get(VAULT_NAMESPACE_HEADER), "/")
+		entry.path = normalizePath(request.URL.Path)
+		if isCacheableError {
+			// Errors are only cached briefly, and never refreshed ahead
+			entry.negative = true
+			entry.expires = time.Now().UnixMilli() + int64(errorTtl)*1000
+			entry.softExpires = entry.expires
+			entry.refreshAt = entry.expires
+		} else if REFRESH_AHEAD_FRACTION > 0 || CACHE_SOFT_TTL_FRACTION < 1 || c.staleWindow > 0 {
+			entry.refresh = newBackgroundRefresh(request, refresher)
+		}
+
+		entryKey := cacheKey
+		if len(varyHeaders) > 0 {
+			entryKey = c.recordVary(cacheKey, varyHeaders, request)
+		}
+		if pathKey := c.getPathKey(request); pathKey != cacheKey {
+			c.addQueryVariant(pathKey, entryKey)
+		}
+		c.storeEntry(c.getPathKey(request), entryKey, entry, fetchStart)
+		cacheRefreshesTotal.WithLabelValues("cached").Inc()
+	} else if err == nil {
+		cacheRefreshesTotal.WithLabelValues("uncached").Inc()
 	}
 
 	// Need a log.debug level -- hopefully there is an internal lib for this stuff :)
 	// log.Printf("Returning response: %+v", response)
-	return response, err
+	return response, entry, err
 }
@@ -0,0 +1,191 @@
+package vault_proxy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cache-Control directives of an upstream response that influence caching
+type cacheDirectives struct {
+	noStore   bool // no-store, no-cache or private: the response must not be served from a shared cache
+	maxAge    int  // Seconds; only set if hasMaxAge
+	hasMaxAge bool
+}
+
+// Parses the Cache-Control header of an upstream response. Unknown directives are ignored.
+func parseCacheControl(header http.Header) cacheDirectives {
+	var directives cacheDirectives
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name, argument := parts[0], ""
+			if len(parts) == 2 {
+				argument = parts[1]
+			}
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				directives.noStore = true
+			case "s-maxage", "max-age":
+				// s-maxage is meant for shared caches like this one and wins over max-age
+				maxAge, err := strconv.Atoi(strings.Trim(argument, `"`))
+				if err == nil && maxAge >= 0 && (!directives.hasMaxAge || strings.EqualFold(name, "s-maxage")) {
+					directives.maxAge, directives.hasMaxAge = maxAge, true
+				}
+			}
+		}
+	}
+	return directives
+}
+
+// Returns the canonical request header names listed in the Vary header, sorted
+func parseVary(header http.Header) []string {
+	names := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Variants of a cache key whose responses Vary on request headers
+type varyState struct {
+	headers []string            // Request headers the responses Vary on
+	keys    map[string]struct{} // Variant keys with an entry
+}
+
+// Returns the key of the variant of `cacheKey` the request selects
+func variantKey(cacheKey string, headers []string, request *http.Request) string {
+	values := make([]string, len(headers))
+	for i, name := range headers {
+		values[i] = fmt.Sprintf("%s=%s", name, strings.Join(request.Header.Values(name), ","))
+	}
+
+	hasher := md5.New()
+	hasher.Write([]byte(cacheKey + "-v=" + strings.Join(values, "&")))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Returns the key the entry for the request is stored under: its cache key, or the variant of it the request
+// selects once responses for the key were seen to Vary
+func (c *vaultCache) getEntryKey(request *http.Request) string {
+	cacheKey := c.getCacheKey(request)
+
+	c.lock.RLock()
+	vary, varies := c.varies[cacheKey]
+	c.lock.RUnlock()
+
+	if !varies {
+		return cacheKey
+	}
+	return variantKey(cacheKey, vary.headers, request)
+}
+
+// Records that the response for the request Varies on `headers` and returns the variant key to store it under
+func (c *vaultCache) recordVary(cacheKey string, headers []string, request *http.Request) string {
+	entryKey := variantKey(cacheKey, headers, request)
+	c.addVariant(cacheKey, headers, entryKey)
+	return entryKey
+}
+
+// Records the variant key of `cacheKey` whose responses Vary on `headers`
+func (c *vaultCache) addVariant(cacheKey string, headers []string, entryKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vary, varies := c.varies[cacheKey]
+	if !varies {
+		vary = &varyState{keys: make(map[string]struct{})}
+		c.varies[cacheKey] = vary
+	}
+	// Variants of other headers stay tracked, so writes still invalidate them should the headers change back
+	vary.headers = headers
+	vary.keys[entryKey] = struct{}{}
+}
+
+// Forgets the variants of the cache key and returns their keys. Must be called with the write lock held.
+func (c *vaultCache) removeVariants(cacheKey string) []string {
+	vary, varies := c.varies[cacheKey]
+	if !varies {
+		return nil
+	}
+	delete(c.varies, cacheKey)
+
+	keys := make([]string, 0, len(vary.keys))
+	for key := range vary.keys {
+		c.deleteEntry(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Entries of the reads of a path with a query, e.g. ?version=2, which are keyed apart from the path itself
+type queryState struct {
+	keys map[string]struct{} // Entry keys with a query
+}
+
+// Records that `entryKey` holds a read of the path keyed `pathKey`, with a query
+func (c *vaultCache) addQueryVariant(pathKey string, entryKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	queries, exists := c.queries[pathKey]
+	if !exists {
+		queries = &queryState{keys: make(map[string]struct{})}
+		c.queries[pathKey] = queries
+	}
+	queries.keys[entryKey] = struct{}{}
+}
+
+// Forgets the query variants of the path key and deletes their entries, returning their keys.
+// Must be called with the write lock held.
+func (c *vaultCache) removeQueryVariants(pathKey string) []string {
+	queries, exists := c.queries[pathKey]
+	if !exists {
+		return nil
+	}
+	delete(c.queries, pathKey)
+
+	keys := make([]string, 0, len(queries.keys))
+	for key := range queries.keys {
+		c.deleteEntry(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Forgets query variant keys whose entry was evicted. Must be called with the write lock held.
+func (c *vaultCache) purgeQueryVariants() {
+	for pathKey, queries := range c.queries {
+		for key := range queries.keys {
+			if _, keyExists := c.cache[key]; !keyExists {
+				delete(queries.keys, key)
+			}
+		}
+		if len(queries.keys) == 0 {
+			delete(c.queries, pathKey)
+		}
+	}
+}
+
+// Forgets variant keys whose entry was evicted. Must be called with the write lock held.
+func (c *vaultCache) purgeVariants() {
+	for cacheKey, vary := range c.varies {
+		for key := range vary.keys {
+			if _, keyExists := c.cache[key]; !keyExists {
+				delete(vary.keys, key)
+			}
+		}
+		if len(vary.keys) == 0 {
+			delete(c.varies, cacheKey)
+		}
+	}
+}
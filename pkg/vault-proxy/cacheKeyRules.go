@@ -0,0 +1,135 @@
+package vault_proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Cache key composition for requests whose path is Subpath or below it. Path is always part of the key.
+type CacheKeyRule struct {
+	Subpath   string
+	Token     bool // Leaving the token out shares entries across tokens: only for paths every token may read. Never for tokenless requests
+	Namespace bool
+	Method    bool
+	Body      bool
+	Accept    bool // Keys JSON and non-JSON representations apart, e.g. on sys endpoints
+
+	// Paths matching PathPattern (a Go regexp) are keyed on the path with the match replaced by PathReplacement,
+	// so aliased paths share an entry, e.g. `^/v1/secret/data/by-id/[^/]+/` -> "/v1/secret/data/by-id/*/".
+	// Only use it when every response of the group is identical; requests still go upstream with their own path.
+	PathPattern     string
+	PathReplacement string
+}
+
+// Key composition used when no CACHE_KEY_RULES entry matches the path
+var defaultCacheKeyRule = CacheKeyRule{Token: true, Namespace: true}
+
+// Returns the CACHE_KEY_RULES entry with the longest Subpath the path is under, or the default rule
+func (h *parseHeader) getCacheKeyRule(path string) CacheKeyRule {
+	return findCacheKeyRule(path, h.cacheKeyRules)
+}
+
+// Returns the rule with the longest Subpath the path is under, matching whole path segments, or the default rule.
+// A rule without a Subpath applies to every path. Matched under a path-style namespace, the rule keeps the token
+// in the key: every token reading the Subpath in one namespace says nothing about the others.
+func findCacheKeyRule(path string, rules []CacheKeyRule) CacheKeyRule {
+	rule := defaultCacheKeyRule
+	longestMatch := -1
+	for _, candidate := range rules {
+		if len(candidate.Subpath) > longestMatch && isUnderSubpath(path, candidate.Subpath, true) {
+			rule = candidate
+			longestMatch = len(candidate.Subpath)
+		}
+	}
+
+	if !hasSubpathPrefix(path, strings.TrimRight(rule.Subpath, "/"), true) {
+		rule.Token = true
+	}
+	return rule
+}
+
+// Compiles the PathPattern of every rule, i.e. of CACHE_KEY_RULES. Exits on an invalid pattern, or on a pattern
+// of a rule without a Subpath since it would then apply to every path.
+func compileKeyPathPatterns(rules []CacheKeyRule) map[string]*regexp.Regexp {
+	patterns := make(map[string]*regexp.Regexp)
+	for _, rule := range rules {
+		if rule.PathPattern == "" {
+			continue
+		}
+		if rule.Subpath == "" {
+			log.Fatalf("CACHE_KEY_RULES PathPattern %q needs a Subpath", rule.PathPattern)
+		}
+
+		pattern, err := regexp.Compile(rule.PathPattern)
+		if err != nil {
+			log.Fatalf("Invalid CACHE_KEY_RULES PathPattern %q: %v", rule.PathPattern, err)
+		}
+		patterns[rule.PathPattern] = pattern
+	}
+
+	return patterns
+}
+
+// Returns the path the rule keys on: the path with matches of the rule's PathPattern replaced, if it has one
+func normalizeKeyPath(rule CacheKeyRule, path string, patterns map[string]*regexp.Regexp) string {
+	pattern, exists := patterns[rule.PathPattern]
+	if !exists {
+		return path
+	}
+
+	return pattern.ReplaceAllString(path, rule.PathReplacement)
+}
+
+// Returns the Accept header lowercased with its media ranges trimmed and sorted, so equivalent
+// headers share a key. A missing Accept is equivalent to "*/*".
+func normalizeAccept(request *http.Request) string {
+	mediaRanges := make([]string, 0)
+	for _, value := range request.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			parameters := strings.Split(mediaRange, ";")
+			for i := range parameters {
+				parameters[i] = strings.ToLower(strings.TrimSpace(parameters[i]))
+			}
+			if parameters[0] != "" {
+				mediaRanges = append(mediaRanges, strings.Join(parameters, ";"))
+			}
+		}
+	}
+
+	if len(mediaRanges) == 0 {
+		return "*/*"
+	}
+	sort.Strings(mediaRanges)
+	return strings.Join(mediaRanges, ",")
+}
+
+// Returns the query string with its parameters and their values sorted, so equivalent queries share a key
+func canonicalQuery(request *http.Request) string {
+	query := request.URL.Query()
+	for _, values := range query {
+		sort.Strings(values)
+	}
+	return query.Encode()
+}
+
+// Returns the sha256 of the request body, leaving the body readable for the upstream call
+func hashRequestBody(request *http.Request) string {
+	if err := bufferRequestBody(request); err != nil {
+		log.Print("RequestBodyError: ", err)
+		return ""
+	}
+	if request.GetBody == nil {
+		return ""
+	}
+
+	body, _ := request.GetBody()
+	hasher := sha256.New()
+	io.Copy(hasher, body)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,217 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFindCacheKeyRuleMatchesWholeSegments(t *testing.T) {
+	rules := []CacheKeyRule{
+		{Subpath: "/v1/sys", Token: true, Namespace: true, Accept: true},
+		{Subpath: "/v1/public/", Namespace: true},
+	}
+
+	for _, tc := range []struct {
+		path    string
+		subpath string
+	}{
+		{"/v1/sys", "/v1/sys"},
+		{"/v1/sys/mounts", "/v1/sys"},
+		{"/v1/public/config", "/v1/public/"},
+		{"/v1/system/info", ""},
+	} {
+		if rule := findCacheKeyRule(tc.path, rules); rule.Subpath != tc.subpath {
+			t.Errorf("path %s matched rule %q, want %q", tc.path, rule.Subpath, tc.subpath)
+		}
+	}
+}
+
+func TestFindCacheKeyRuleUnderPathNamespace(t *testing.T) {
+	rules := []CacheKeyRule{{Subpath: "/v1/public/", Namespace: true}}
+
+	if rule := findCacheKeyRule("/v1/public/config", rules); rule.Token {
+		t.Error("rule leaving the token out kept it for its own Subpath")
+	}
+	for _, path := range []string{"/v1/team-a/public/config", "/v1/secret/data/public/config"} {
+		rule := findCacheKeyRule(path, rules)
+		if rule.Subpath != "/v1/public/" {
+			t.Errorf("path %s matched rule %q, want /v1/public/", path, rule.Subpath)
+		}
+		if !rule.Token {
+			t.Errorf("path %s under a path-style namespace shares entries across tokens", path)
+		}
+	}
+}
+
+func TestAcceptKeyedPathCachesEachRepresentation(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	parseHeader.cacheKeyRules = []CacheKeyRule{{Subpath: "/v1/sys/metrics", Token: true, Namespace: true, Accept: true}}
+	newRequest := func(path string, accept string) *http.Request {
+		request := newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token")
+		request.Header.Set("Accept", accept)
+		return parsedRequest(parseHeader, request)
+	}
+
+	// Each representation is fetched and cached under its own key
+	for _, accept := range []string{"application/json", "Text/Plain"} {
+		response, err := cache.refreshCache(newRequest("/v1/sys/metrics", accept), func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, `{"data":{"format":"`+request.Header.Get("Accept")+`"}}`, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		readBody(t, response)
+	}
+	if cache.getEntryKey(newRequest("/v1/sys/metrics", "application/json")) == cache.getEntryKey(newRequest("/v1/sys/metrics", "text/plain")) {
+		t.Fatal("JSON and plain text reads of an Accept-keyed path share a cache key")
+	}
+	for _, tc := range []struct{ accept, want string }{
+		{"application/json", `{"data":{"format":"application/json"}}`},
+		{" text/plain ", `{"data":{"format":"Text/Plain"}}`},
+	} {
+		response, err := cache.getCachedResponse(newRequest("/v1/sys/metrics", tc.accept))
+		if err != nil {
+			t.Fatalf("Accept %q was not cached: %v", tc.accept, err)
+		}
+		if body := readBody(t, response); body != tc.want {
+			t.Errorf("Accept %q got body %q, want its own cached representation %q", tc.accept, body, tc.want)
+		}
+	}
+
+	// Paths without the rule ignore Accept
+	if cache.getEntryKey(newRequest("/v1/secret/data/foo", "application/json")) != cache.getEntryKey(newRequest("/v1/secret/data/foo", "text/plain")) {
+		t.Error("Accept changed the cache key of a path without an Accept rule")
+	}
+}
+
+func TestAliasedPathsShareAnEntryUnderTheirPattern(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	parseHeader.cacheKeyRules = []CacheKeyRule{
+		{Subpath: "/v1/secret/data/tenants", Token: true, Namespace: true, PathPattern: `^/v1/secret/data/tenants/[0-9]+/config$`, PathReplacement: "/v1/secret/data/tenants/*/config"},
+	}
+	parseHeader.pathPatterns = compileKeyPathPatterns(parseHeader.cacheKeyRules)
+	entryKey := func(path string) string {
+		return cache.getEntryKey(parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token")))
+	}
+
+	response, err := cache.refreshCache(parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/tenants/1/config", "172.16.0.1:1234", "token")), func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"plan":"shared"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+
+	// An alias of the cached path is answered from its entry
+	if entryKey("/v1/secret/data/tenants/1/config") != entryKey("/v1/secret/data/tenants/2/config") {
+		t.Fatal("aliased paths have different cache keys")
+	}
+	response, err = cache.getCachedResponse(parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/tenants/2/config", "172.16.0.1:1234", "token")))
+	if err != nil {
+		t.Fatalf("aliased path was not served from cache: %v", err)
+	}
+	if body := readBody(t, response); body != `{"data":{"plan":"shared"}}` {
+		t.Errorf("aliased path got body %q, want the shared entry", body)
+	}
+
+	// Paths the pattern doesn't match, under the Subpath or elsewhere, keep their own keys
+	for _, pair := range [][2]string{
+		{"/v1/secret/data/tenants/1/users", "/v1/secret/data/tenants/2/users"},
+		{"/v1/secret/data/other/1/config", "/v1/secret/data/other/2/config"},
+	} {
+		if entryKey(pair[0]) == entryKey(pair[1]) {
+			t.Errorf("unrelated paths %s and %s share a cache key", pair[0], pair[1])
+		}
+	}
+}
+
+func TestEachSubpathIsKeyedByItsOwnRule(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	parseHeader.cacheKeyRules = []CacheKeyRule{
+		{Subpath: "/v1/public", Namespace: true},
+		{Subpath: "/v1/secret/data", Token: true, Namespace: true, Method: true},
+	}
+	key := func(method string, path string, token string, namespace string) string {
+		request := newTestRequest(method, path, "172.16.0.1:1234", token)
+		request.Header.Set(VAULT_NAMESPACE_HEADER, namespace)
+		return parseRequest(parseHeader, request).GetVaultCacheKey()
+	}
+
+	for _, tc := range []struct {
+		name      string
+		a, b      string
+		wantShare bool
+	}{
+		{"public across tokens", key(http.MethodGet, "/v1/public/config", "token-a", "ns1"), key(http.MethodGet, "/v1/public/config", "token-b", "ns1"), true},
+		{"public across namespaces", key(http.MethodGet, "/v1/public/config", "token-a", "ns1"), key(http.MethodGet, "/v1/public/config", "token-a", "ns2"), false},
+		{"public across methods", key(http.MethodGet, "/v1/public/config", "token-a", "ns1"), key("LIST", "/v1/public/config", "token-a", "ns1"), true},
+		{"secret across tokens", key(http.MethodGet, "/v1/secret/data/foo", "token-a", "ns1"), key(http.MethodGet, "/v1/secret/data/foo", "token-b", "ns1"), false},
+		{"secret across methods", key(http.MethodGet, "/v1/secret/data/foo", "token-a", "ns1"), key("LIST", "/v1/secret/data/foo", "token-a", "ns1"), false},
+	} {
+		if share := tc.a == tc.b; share != tc.wantShare {
+			t.Errorf("%s: sharing a key = %v, want %v", tc.name, share, tc.wantShare)
+		}
+	}
+}
+
+// Returns the proxy chain in front of a Vault counting its fetches and answering every request with a secret,
+// keying cached reads with the rules
+func newRuleKeyedChain(t *testing.T, rules []CacheKeyRule, fetches *int32) http.Handler {
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	parseHeader := NewParseHeader(config)
+	parseHeader.cacheKeyRules = rules
+	return parseHeader.ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+}
+
+func TestWriteEvictsReadsKeyedOnMethodAndBody(t *testing.T) {
+	var fetches int32
+	chain := newRuleKeyedChain(t, []CacheKeyRule{{Subpath: "/v1/secret/data", Token: true, Namespace: true, Method: true, Body: true}}, &fetches)
+	read := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	serveTimes(chain, read, 2)
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Fatalf("got %d fetches for 2 reads, want the GET cached", fetches)
+	}
+
+	// The write has its own method and body, and still drops the cached GET
+	write := httptest.NewRequest(http.MethodPost, "/v1/secret/data/foo", strings.NewReader(`{"data":{"value":"rotated"}}`))
+	write.RemoteAddr = "172.16.0.1:1234"
+	write.Header.Set(VAULT_TOKEN_HEADER, "token")
+	chain.ServeHTTP(httptest.NewRecorder(), write)
+	serveTimes(chain, read, 1)
+	if fetches := atomic.LoadInt32(&fetches); fetches != 3 {
+		t.Errorf("got %d fetches, want the GET refetched after the POST", fetches)
+	}
+}
+
+func TestWriteEvictsReadsOfEveryAccept(t *testing.T) {
+	var fetches int32
+	chain := newRuleKeyedChain(t, []CacheKeyRule{{Subpath: "/v1/secret/data", Token: true, Namespace: true, Accept: true}}, &fetches)
+	read := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	read.Header.Set("Accept", "application/json")
+	serveTimes(chain, read, 2)
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Fatalf("got %d fetches for 2 reads, want the read cached", fetches)
+	}
+
+	write := newTestRequest(http.MethodPost, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	write.Header.Set("Accept", "*/*")
+	serveTimes(chain, write, 1)
+	serveTimes(chain, read, 1)
+	if fetches := atomic.LoadInt32(&fetches); fetches != 3 {
+		t.Errorf("got %d fetches, want the application/json read refetched after a */* write", fetches)
+	}
+}
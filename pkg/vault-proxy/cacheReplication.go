@@ -0,0 +1,140 @@
+package vault_proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// Returns the fresh entry under the key serialized for a neighbor agent, if this agent has one
+func (c *vaultCache) exportEntry(key string) ([]byte, bool) {
+	c.lock.RLock()
+	entry, keyExists := c.cache[key]
+	c.lock.RUnlock()
+	if !keyExists || entry.isExpired() {
+		return nil, false
+	}
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		log.Print("CacheReplicaError: ", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// Caches an entry serialized by a neighbor agent's exportEntry under the key, a variant of `cacheKey` if its
+// response Varies, and a query variant of `pathKey` if the read had a query. Entries that expired, predate a
+// write or flush on this agent, or are older than the one already cached are dropped.
+func (c *vaultCache) importEntry(pathKey string, cacheKey string, key string, data []byte) error {
+	entry, err := decodeCacheEntry(data, c.bodyCipher)
+	if err != nil {
+		return err
+	}
+
+	if entry.isExpired() || c.areWritesDisabled() {
+		return nil
+	}
+	if entry.storedAt <= atomic.LoadInt64(&c.lastFlush) || c.writtenSince(pathKey, entry.storedAt) {
+		log.Printf("NOT CACHING: Key: %s replica predates a write or flush on this agent.", key)
+		return nil
+	}
+	if c.config.MaxCacheBytes > 0 && entry.size() > int64(c.config.MaxCacheBytes) {
+		return nil
+	}
+
+	c.lock.RLock()
+	current, keyExists := c.cache[key]
+	c.lock.RUnlock()
+	if keyExists && current.expires >= entry.expires {
+		return nil
+	}
+
+	if varyHeaders := parseVary(entry.response.Header); len(varyHeaders) > 0 && key != cacheKey {
+		c.addVariant(cacheKey, varyHeaders, key)
+	}
+	if pathKey != cacheKey {
+		c.addQueryVariant(pathKey, key)
+	}
+	c.setInMemory(key, entry)
+	return nil
+}
+
+// Pushes the entry the request was just served from to the next agents on the ring, so a failover that moves
+// the request's routing key to one of them lands on a warm cache. Neighbors cache it as is, without calling Vault
+// or spending the token's rate limit.
+func (a *vaultAgent) replicateToNeighbors(request *http.Request) {
+	parsed := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders)
+	pathKey, cacheKey := parsed.GetPathCacheKey(), parsed.GetVaultCacheKey()
+	entryKey := a.vaultCache.getEntryKey(request)
+	data, isCached := a.vaultCache.exportEntry(entryKey)
+	if !isCached {
+		return
+	}
+
+	query := url.Values{"path_key": {pathKey}, "cache_key": {cacheKey}, "key": {entryKey}}
+	for _, neighbor := range a.getNeighborServers(request) {
+		target := url.URL{Scheme: a.agentScheme, Host: neighbor, Path: CACHE_REPLICA_PATH, RawQuery: query.Encode()}
+
+		go func(neighbor string, target string) {
+			replica, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(data))
+			if err != nil {
+				log.Printf("Cache replication to Agent: %s failed: %v", neighbor, err)
+				return
+			}
+			replica.Header.Set("Content-Type", "application/json")
+
+			response, err := a.agentClient.Do(replica)
+			if err != nil {
+				log.Printf("Cache replication to Agent: %s failed: %v", neighbor, err)
+				return
+			}
+			defer response.Body.Close()
+			io.Copy(io.Discard, response.Body)
+
+			log.Printf("Cache replicated to Agent: %s Key: %s Status: %d", neighbor, entryKey, response.StatusCode)
+		}(neighbor, target.String())
+	}
+}
+
+// Caches an entry pushed by a neighbor's replicateToNeighbors. Only peer agents (AGENT_PEER_CIDRS or
+// TRUSTED_AGENT_IDENTITIES) may push, since the entry goes straight into the cache.
+func (a *vaultAgent) ReplicaHandler(writer http.ResponseWriter, request *http.Request) {
+	if !isPeerAgent(request, a.agentPeers) {
+		log.Printf("Rejecting cache replica from untrusted peer %s", request.RemoteAddr)
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if request.Method != http.MethodPut {
+		writer.Header().Set("Allow", http.MethodPut)
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	cacheKey, key := request.URL.Query().Get("cache_key"), request.URL.Query().Get("key")
+	if cacheKey == "" || key == "" {
+		http.Error(writer, "cache_key and key are required", http.StatusBadRequest)
+		return
+	}
+	// Agents that predate path keys only send the cache key, which is the path key of reads without a query
+	pathKey := request.URL.Query().Get("path_key")
+	if pathKey == "" {
+		pathKey = cacheKey
+	}
+
+	data, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = a.vaultCache.importEntry(pathKey, cacheKey, key, data)
+	}
+	if err != nil {
+		log.Printf("Ignoring cache replica from Agent: %s: %v", request.RemoteAddr, err)
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
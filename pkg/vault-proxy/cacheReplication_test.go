@@ -0,0 +1,109 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts an agent whose listener accepts cache replicas, trusting pushes from `agentPeerCIDRs`
+func startReplicaAgent(t *testing.T, agentPeerCIDRs ...string) (*vaultAgent, string) {
+	var agent *vaultAgent
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		agent.ReplicaHandler(writer, request)
+	}))
+	t.Cleanup(server.Close)
+
+	address := server.Listener.Addr().String()
+	agent = newTestAgent(t, address, address)
+	agent.agentPeers = parseCIDRs(agentPeerCIDRs, "agent peer")
+	return agent, address
+}
+
+// Serves the request on the agent in front of a cache filled by `refresher` on misses
+func serveThroughAgent(agent *vaultAgent, parseHeader *parseHeader, request *http.Request, refresher func(*http.Request) (*http.Response, error)) *httptest.ResponseRecorder {
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		response, err := agent.vaultCache.getCachedResponse(request)
+		if err != nil {
+			response, err = agent.vaultCache.refreshCache(request, refresher)
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		writer.WriteHeader(response.StatusCode)
+		copyResponseBody(writer, response.Body, "test")
+	})
+
+	recorder := httptest.NewRecorder()
+	parseHeader.ParseHeaderHandler(agent.VaultAgentHandler(next)).ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Returns a token the agent at `owner` owns on the agent's ring
+func tokenOwnedBy(t *testing.T, agent *vaultAgent, owner string) string {
+	for i := 0; i < 1000; i++ {
+		token := fmt.Sprintf("token-%d", i)
+		if agent.GetRoutingServer(newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token)) == owner {
+			return token
+		}
+	}
+	t.Fatalf("no token is owned by %s", owner)
+	return ""
+}
+
+func TestReplicationWarmsTheNeighbor(t *testing.T) {
+	neighbor, neighborAddress := startReplicaAgent(t, "127.0.0.0/8")
+	const ownerAddress = "10.0.0.1:7444"
+	owner := newTestAgent(t, ownerAddress, ownerAddress, neighborAddress)
+	owner.replicationNeighbors = 1
+	parseHeader := NewParseHeader(owner.config)
+
+	var calls int32
+	refresher := func(request *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil), nil
+	}
+	token := tokenOwnedBy(t, owner, ownerAddress)
+	if recorder := serveThroughAgent(owner, parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token), refresher); recorder.Code != http.StatusOK {
+		t.Fatalf("owner answered %d", recorder.Code)
+	}
+
+	// The owner goes away: the token now routes to the neighbor, which must answer from its replica
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token))
+	deadline := time.Now().Add(2 * time.Second)
+	for neighbor.vaultCache.Stats().Size == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if routed := neighbor.GetRoutingServer(request); routed != neighborAddress {
+		t.Fatalf("neighbor routes the token to %s", routed)
+	}
+	response, err := neighbor.vaultCache.getCachedResponse(request)
+	if err != nil {
+		t.Fatalf("neighbor missed after replication: %v", err)
+	}
+	if body := readBody(t, response); body != `{"data":{"value":"secret"}}` {
+		t.Errorf("neighbor served %q", body)
+	}
+	if calls != 1 {
+		t.Errorf("got %d Vault reads, want 1: replication must not replay the request", calls)
+	}
+}
+
+func TestReplicaFromUntrustedPeerIsRejected(t *testing.T) {
+	neighbor, _ := startReplicaAgent(t)
+
+	request := newTestRequest(http.MethodPut, CACHE_REPLICA_PATH+"?cache_key=k&key=k", "172.16.0.1:1234", "")
+	recorder := httptest.NewRecorder()
+	neighbor.ReplicaHandler(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got %d for a replica from an untrusted peer, want 403", recorder.Code)
+	}
+	if size := neighbor.vaultCache.Stats().Size; size != 0 {
+		t.Errorf("untrusted replica was cached")
+	}
+}
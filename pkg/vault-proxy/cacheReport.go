@@ -0,0 +1,125 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Cache efficiency counters since the last report; all fields accessed atomically
+type cacheEfficiency struct {
+	hits      int64
+	misses    int64
+	evictions int64
+	stored    int64
+	ttlMillis int64 // Sum of the TTLs of entries stored
+}
+
+// Cache counters since startup; all fields accessed atomically
+type cacheTotals struct {
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Records a cache lookup in the report, the totals, the metrics and the hit ratio alert
+func (c *vaultCache) recordLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&c.efficiency.hits, 1)
+		atomic.AddInt64(&c.totals.hits, 1)
+		cacheHitsTotal.Inc()
+	} else {
+		atomic.AddInt64(&c.efficiency.misses, 1)
+		atomic.AddInt64(&c.totals.misses, 1)
+		cacheMissesTotal.Inc()
+	}
+	c.hitRatio.record(hit)
+}
+
+// Records entries evicted to make room or because they expired
+func (c *vaultCache) recordEvictions(count int64) {
+	atomic.AddInt64(&c.efficiency.evictions, count)
+	atomic.AddInt64(&c.totals.evictions, count)
+}
+
+// Records an entry stored with the given TTL
+func (e *cacheEfficiency) recordStore(ttlMillis int64) {
+	atomic.AddInt64(&e.stored, 1)
+	atomic.AddInt64(&e.ttlMillis, ttlMillis)
+}
+
+// Hit count of a path across all cached entries (of every token)
+type pathHits struct {
+	path string
+	hits int64
+}
+
+// Returns the CACHE_REPORT_TOP_PATHS paths with the most hits among current cache entries
+func (c *vaultCache) topHotPaths() []pathHits {
+	c.lock.RLock()
+	hitsByPath := make(map[string]int64)
+	for _, cachedResponse := range c.cache {
+		hitsByPath[cachedResponse.path] += atomic.LoadInt64(&cachedResponse.hits)
+	}
+	c.lock.RUnlock()
+
+	paths := make([]pathHits, 0, len(hitsByPath))
+	for path, hits := range hitsByPath {
+		if hits > 0 {
+			paths = append(paths, pathHits{path, hits})
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].hits > paths[j].hits
+	})
+
+	if len(paths) > CACHE_REPORT_TOP_PATHS {
+		paths = paths[:CACHE_REPORT_TOP_PATHS]
+	}
+	return paths
+}
+
+// Summarizes cache efficiency over the last `interval` and resets the counters
+func (c *vaultCache) efficiencyReport(interval time.Duration) string {
+	hits := atomic.SwapInt64(&c.efficiency.hits, 0)
+	misses := atomic.SwapInt64(&c.efficiency.misses, 0)
+	evictions := atomic.SwapInt64(&c.efficiency.evictions, 0)
+	stored := atomic.SwapInt64(&c.efficiency.stored, 0)
+	ttlMillis := atomic.SwapInt64(&c.efficiency.ttlMillis, 0)
+
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+	averageTtl := time.Duration(0)
+	if stored > 0 {
+		averageTtl = time.Duration(ttlMillis/stored) * time.Millisecond
+	}
+
+	hotPaths := make([]string, 0, CACHE_REPORT_TOP_PATHS)
+	for _, path := range c.topHotPaths() {
+		hotPaths = append(hotPaths, fmt.Sprintf("%s=%d", path.path, path.hits))
+	}
+
+	return fmt.Sprintf("hit_ratio=%.3f hits=%d misses=%d evictions_per_min=%.1f stored=%d avg_ttl=%v hot_paths=[%s]",
+		hitRatio, hits, misses, float64(evictions)/interval.Minutes(), stored, averageTtl, strings.Join(hotPaths, " "))
+}
+
+// Logs a cache efficiency report every `interval` until the process exits
+func (c *vaultCache) StartEfficiencyReporter(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			log.Printf("Cache efficiency report (last %v): %s", interval, c.efficiencyReport(interval))
+		}
+	}()
+}
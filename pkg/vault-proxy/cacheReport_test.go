@@ -0,0 +1,52 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEfficiencyReportSummarizesTheInterval(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	for path, hits := range map[string]int{"/v1/secret/data/hot": 3, "/v1/secret/data/warm": 1, "/v1/secret/data/cold": 0} {
+		cacheReadWithToken(t, cache, parseHeader, path, "token")
+		for i := 0; i < hits; i++ {
+			response, err := cache.getCachedResponse(parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token")))
+			if err != nil {
+				t.Fatalf("%s was not cached: %v", path, err)
+			}
+			readBody(t, response)
+		}
+	}
+	cache.recordEvictions(2)
+
+	report := cache.efficiencyReport(30 * time.Second)
+	for _, want := range []string{"hits=4 ", "stored=3 ", "evictions_per_min=4.0 ", "avg_ttl=", "hot_paths=[/v1/secret/data/hot=3 /v1/secret/data/warm=1]"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report %q is missing %q", report, want)
+		}
+	}
+	if strings.Contains(report, "token") {
+		t.Errorf("report %q names a token", report)
+	}
+
+	// Counters are reset for the next interval, hot paths are taken from the entries
+	if report := cache.efficiencyReport(30 * time.Second); !strings.HasPrefix(report, "hit_ratio=0.000 hits=0 misses=0 evictions_per_min=0.0 stored=0 avg_ttl=0s") {
+		t.Errorf("got report %q for an idle interval", report)
+	}
+}
+
+func TestEfficiencyReporterLogsEveryInterval(t *testing.T) {
+	config := newTestConfig(t)
+	cache := NewVaultCache(config).(*vaultCache)
+	logs := captureLogs(t)
+
+	cache.StartEfficiencyReporter(10 * time.Millisecond)
+	reports := func() int { return strings.Count(logs.String(), "Cache efficiency report (last 10ms): hit_ratio=") }
+	if !eventually(func() bool { return reports() >= 2 }) {
+		t.Errorf("reporter did not log a report every interval:\n%s", logs)
+	}
+}
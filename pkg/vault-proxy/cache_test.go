@@ -0,0 +1,784 @@
+package vault_proxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Returns a refresher answering with the secret `{"data":{"value":<X-Variant header>}}` once released,
+// counting its calls
+func newBlockingRefresher(calls *int32, release <-chan struct{}, header http.Header) func(*http.Request) (*http.Response, error) {
+	return func(request *http.Request) (*http.Response, error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"`+request.Header.Get("X-Variant")+`"}}`, header.Clone()), nil
+	}
+}
+
+func TestConcurrentMissesShareOneFetch(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	var calls int32
+	release := make(chan struct{})
+	refresher := newBlockingRefresher(&calls, release, nil)
+
+	const clients = 100
+	bodies := make([]string, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+			request.Header.Set("X-Variant", "a")
+			response, err := cache.refreshCache(request, refresher)
+			if err != nil {
+				t.Errorf("refresh failed: %v", err)
+				return
+			}
+			bodies[i] = readBody(t, response)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("got %d upstream fetches for %d concurrent misses, want 1", calls, clients)
+	}
+	for i, body := range bodies {
+		if body != `{"data":{"value":"a"}}` {
+			t.Fatalf("client %d got body %q", i, body)
+		}
+	}
+}
+
+func TestConcurrentMissesOfDifferentVariants(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	var calls int32
+	release := make(chan struct{})
+	refresher := newBlockingRefresher(&calls, release, http.Header{"Vary": {"X-Variant"}})
+
+	variants := []string{"a", "b"}
+	bodies := make([]string, len(variants))
+	var wg sync.WaitGroup
+	for i, variant := range variants {
+		wg.Add(1)
+		go func(i int, variant string) {
+			defer wg.Done()
+			request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+			request.Header.Set("X-Variant", variant)
+			response, err := cache.refreshCache(request, refresher)
+			if err != nil {
+				t.Errorf("refresh failed: %v", err)
+				return
+			}
+			bodies[i] = readBody(t, response)
+		}(i, variant)
+		// The second miss joins the first one's fetch, before the response shows it Varies
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for i, variant := range variants {
+		if want := `{"data":{"value":"` + variant + `"}}`; bodies[i] != want {
+			t.Errorf("request with X-Variant %s got %q, want %q", variant, bodies[i], want)
+		}
+	}
+}
+
+func TestWriteDropsQueryVariantsOfPath(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	refresher := func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"data":{"value":"v1"}}}`, nil), nil
+	}
+
+	read := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo?version=1", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(read, refresher)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+	entryKey := cache.getEntryKey(read)
+	if _, isCached := cache.getFromCache(entryKey); !isCached {
+		t.Fatal("read with a query was not cached")
+	}
+
+	write := parseRequest(parseHeader, newTestRequest(http.MethodPut, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	cache.beginWrite(write.GetPathCacheKey())
+	if !cache.isWriteInFlight(cache.getPathKey(read)) {
+		t.Error("write to the path is not in flight for its query variant")
+	}
+	cache.endWrite(write.GetPathCacheKey())
+
+	if _, isCached := cache.getFromCache(entryKey); isCached {
+		t.Error("write to the path left its ?version=1 read cached")
+	}
+}
+
+func TestLruPurgeIsObservedOnce(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 4
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	refresher := func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"a"}}`, nil), nil
+	}
+	for _, path := range []string{"/v1/secret/data/a", "/v1/secret/data/b", "/v1/secret/data/c", "/v1/secret/data/d"} {
+		response, err := cache.refreshCache(parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token")), refresher)
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		readBody(t, response)
+	}
+
+	// Both full and over its byte budget
+	cache.config.MaxCacheBytes = 1
+	purgesBefore := testutil.ToFloat64(purgeOperationsTotal.WithLabelValues("purgeLruCacheEntries"))
+	cache.lock.Lock()
+	cache.purgeLruCacheEntries(0)
+	cache.lock.Unlock()
+
+	if purges := testutil.ToFloat64(purgeOperationsTotal.WithLabelValues("purgeLruCacheEntries")) - purgesBefore; purges != 1 {
+		t.Errorf("got %v purges observed for one purge, want 1", purges)
+	}
+}
+
+func TestErrorTtlDefaultsToNegativeCacheTtl(t *testing.T) {
+	defer func(ttls map[int]int) { CACHEABLE_ERROR_STATUS_TTLS = ttls }(CACHEABLE_ERROR_STATUS_TTLS)
+	CACHEABLE_ERROR_STATUS_TTLS = map[int]int{http.StatusNotFound: 0, http.StatusBadRequest: 5, http.StatusBadGateway: 5}
+
+	for _, tc := range []struct {
+		status     int
+		wantTtl    int
+		wantCached bool
+	}{
+		{http.StatusBadRequest, 5, true},
+		{http.StatusNotFound, NEGATIVE_CACHE_TTL, NEGATIVE_CACHE_TTL > 0},
+		{http.StatusForbidden, 0, false},
+		{http.StatusBadGateway, 0, false},
+		{http.StatusOK, 0, false},
+	} {
+		if ttl, isCached := getErrorTtl(tc.status); ttl != tc.wantTtl || isCached != tc.wantCached {
+			t.Errorf("getErrorTtl(%d) = %d, %v, want %d, %v", tc.status, ttl, isCached, tc.wantTtl, tc.wantCached)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("entropy source failed") }
+
+func TestSealFailureSkipsCaching(t *testing.T) {
+	t.Setenv("CACHE_ENCRYPTION_KEY", "test-encryption-key")
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	if cache.bodyCipher == nil {
+		t.Fatal("CACHE_ENCRYPTION_KEY did not enable body encryption")
+	}
+	defer func(reader io.Reader) { rand.Reader = reader }(rand.Reader)
+	rand.Reader = failingReader{}
+
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"a"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if body := readBody(t, response); body != `{"data":{"value":"a"}}` {
+		t.Errorf("got body %q, want the upstream body", body)
+	}
+	if _, isCached := cache.getFromCache(cache.getEntryKey(request)); isCached {
+		t.Error("entry whose body could not be sealed was cached")
+	}
+}
+
+func TestHotKeyIsRefreshedAheadOfExpiry(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	var calls int32
+	refresher := func(request *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"a"}}`, nil), nil
+	}
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, refresher)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+
+	// A hot entry that entered its refresh-ahead window and expires shortly
+	entry, _ := cache.getFromCache(cache.getEntryKey(request))
+	entry.refresh = newBackgroundRefresh(request, refresher)
+	entry.expires = time.Now().Add(100 * time.Millisecond).UnixMilli()
+	entry.softExpires, entry.refreshAt = entry.expires, time.Now().UnixMilli()
+	atomic.StoreInt64(&entry.hits, REFRESH_AHEAD_MIN_HITS)
+
+	for i := 0; i < 20; i++ {
+		response, err := cache.getCachedResponse(request)
+		if err != nil {
+			t.Fatalf("hot key missed before expiry: %v", err)
+		}
+		readBody(t, response)
+	}
+
+	// Well past the original expiry, clients are still served the refreshed entry
+	time.Sleep(150 * time.Millisecond)
+	response, err = cache.getCachedResponse(request)
+	if err != nil {
+		t.Fatalf("hot key missed after its original expiry: %v", err)
+	}
+	readBody(t, response)
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("got %d upstream fetches, want the first one and a single refresh", calls)
+	}
+}
+
+func TestLeaseBelowMinTtlIsNotCached(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+
+	for _, tc := range []struct {
+		leaseDuration int
+		wantCached    bool
+	}{
+		{config.VaultCacheMinTtl - 1, false},
+		{config.VaultCacheMinTtl, true},
+	} {
+		path := fmt.Sprintf("/v1/secret/data/lease-%d", tc.leaseDuration)
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token"))
+		body := fmt.Sprintf(`{"lease_id":"database/creds/app/abc","renewable":true,"lease_duration":%d,"data":{"username":"app"}}`, tc.leaseDuration)
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, body, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		if got := readBody(t, response); got != body {
+			t.Errorf("lease of %ds got body %q, want the upstream body", tc.leaseDuration, got)
+		}
+		if _, isCached := cache.getFromCache(cache.getEntryKey(request)); isCached != tc.wantCached {
+			t.Errorf("lease of %ds cached = %v, want %v", tc.leaseDuration, isCached, tc.wantCached)
+		}
+	}
+}
+
+func TestNullDataOkIsNotCached(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.skipEmptyData = true
+
+	for _, tc := range []struct {
+		body       string
+		wantCached bool
+	}{
+		{`{"data":null}`, false},
+		{`{"data":{"data":null,"metadata":{"deletion_time":"2024-01-01T00:00:00Z"}}}`, false},
+		{`{"data":{"data":{"value":"secret"}}}`, true},
+	} {
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, tc.body, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		if readBody(t, response) != tc.body {
+			t.Errorf("%s: want the upstream body passed through", tc.body)
+		}
+		if _, isCached := cache.getFromCache(cache.getEntryKey(request)); isCached != tc.wantCached {
+			t.Errorf("%s cached = %v, want %v", tc.body, isCached, tc.wantCached)
+		}
+	}
+}
+
+func TestZeroLengthOkIsNotCached(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+
+	for _, tc := range []struct {
+		body       string
+		wantCached bool
+	}{
+		{"", false},
+		{`{"data":{"value":"secret"}}`, true},
+	} {
+		path := fmt.Sprintf("/v1/secret/data/body-%d", len(tc.body))
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token"))
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, tc.body, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		if response.StatusCode != http.StatusOK || readBody(t, response) != tc.body {
+			t.Errorf("%d byte body: got status %d, want the upstream response passed through", len(tc.body), response.StatusCode)
+		}
+		if _, isCached := cache.getFromCache(cache.getEntryKey(request)); isCached != tc.wantCached {
+			t.Errorf("%d byte body cached = %v, want %v", len(tc.body), isCached, tc.wantCached)
+		}
+	}
+}
+
+func TestBodyOverTheLimitIsProxiedButNotStored(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	body := `{"data":{"value":"` + strings.Repeat("x", MAX_CACHEABLE_BODY_BYTES) + `"}}`
+
+	// Vault may announce the length up front or stream the body chunked
+	for _, contentLength := range []int64{int64(len(body)), -1} {
+		path := fmt.Sprintf("/v1/secret/data/large%d", contentLength)
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token"))
+		uncachedBefore := testutil.ToFloat64(cacheRefreshesTotal.WithLabelValues("uncached"))
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			response := newVaultResponse(request, http.StatusOK, body, nil)
+			response.ContentLength = contentLength
+			return response, nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		if got := readBody(t, response); got != body {
+			t.Errorf("Content-Length %d: got a %d byte body, want the %d byte body in full", contentLength, len(got), len(body))
+		}
+		if _, isCached := cache.getFromCache(cache.getEntryKey(request)); isCached {
+			t.Errorf("Content-Length %d: body above MAX_CACHEABLE_BODY_BYTES was cached", contentLength)
+		}
+		if uncached := testutil.ToFloat64(cacheRefreshesTotal.WithLabelValues("uncached")) - uncachedBefore; uncached != 1 {
+			t.Errorf("Content-Length %d: got %v uncached refreshes, want 1", contentLength, uncached)
+		}
+	}
+}
+
+// Returns how many durations were observed for the purge
+func purgeDurationSamples(t *testing.T, purge string) uint64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(purgeDurationSeconds)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "purge" && label.GetValue() == purge {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestPurgeRecordsADurationSample(t *testing.T) {
+	config := newTestConfig(t)
+	cache := NewVaultCache(config).(*vaultCache)
+	samplesBefore := purgeDurationSamples(t, "purgeOldCacheEntries")
+
+	// Not due yet
+	cache.purgeOldCacheEntries()
+	if samples := purgeDurationSamples(t, "purgeOldCacheEntries") - samplesBefore; samples != 0 {
+		t.Fatalf("got %d duration samples before a purge was due, want 0", samples)
+	}
+
+	cache.lastCachePurge = 0
+	cache.purgeOldCacheEntries()
+	if samples := purgeDurationSamples(t, "purgeOldCacheEntries") - samplesBefore; samples != 1 {
+		t.Errorf("got %d duration samples for one purge, want 1", samples)
+	}
+}
+
+func TestHeadDoesNotPolluteTheGetEntry(t *testing.T) {
+	var gets int32
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"data":{"value":"secret"}}`)
+	})
+	serve := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		return recorder
+	}
+
+	if recorder := serve(http.MethodHead); recorder.Code != http.StatusOK {
+		t.Fatalf("HEAD got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	for i := 0; i < 2; i++ {
+		if body := serve(http.MethodGet).Body.String(); body != `{"data":{"value":"secret"}}` {
+			t.Errorf("GET after a HEAD got body %q, want the secret", body)
+		}
+	}
+	if gets := atomic.LoadInt32(&gets); gets != 1 {
+		t.Errorf("got %d GETs to Vault, want one fetch cached for the second", gets)
+	}
+}
+
+func TestVaultWarningsAreOnFreshAndCachedResponses(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.propagateWarnings = true
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+
+	fresh, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"warnings":["mount is deprecated","token\nexpires soon"],"data":{"value":"a"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, fresh)
+	cached, err := cache.getCachedResponse(request)
+	if err != nil {
+		t.Fatalf("warning-bearing response was not cached: %v", err)
+	}
+	readBody(t, cached)
+
+	want := []string{"mount is deprecated", "token expires soon"}
+	for name, response := range map[string]*http.Response{"fresh": fresh, "cached": cached} {
+		if got := response.Header.Values(VAULT_PROXY_WARNINGS_HEADER); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s response has %s %q, want %q", name, VAULT_PROXY_WARNINGS_HEADER, got, want)
+		}
+	}
+}
+
+// Body whose first read blocks until released, counting the reads made while the cache is still buffering it,
+// before its client got the response back
+type gatedBody struct {
+	io.Reader
+	release      <-chan struct{}
+	returned     *int32
+	buffering    *int32
+	maxBuffering *int32
+	started      bool
+}
+
+func (b *gatedBody) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		if atomic.LoadInt32(b.returned) == 0 {
+			current := atomic.AddInt32(b.buffering, 1)
+			defer atomic.AddInt32(b.buffering, -1)
+			for max := atomic.LoadInt32(b.maxBuffering); current > max && !atomic.CompareAndSwapInt32(b.maxBuffering, max, current); {
+				max = atomic.LoadInt32(b.maxBuffering)
+			}
+		}
+		<-b.release
+	}
+	return b.Reader.Read(p)
+}
+
+func (b *gatedBody) Close() error { return nil }
+
+func TestBodyBufferingStaysWithinTheCap(t *testing.T) {
+	const slots, clients = 4, 20
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.bufferSlots = make(chan struct{}, slots)
+
+	var buffering, maxBuffering int32
+	returned := make([]int32, clients)
+	release := make(chan struct{})
+	refresher := func(request *http.Request) (*http.Response, error) {
+		var client int
+		fmt.Sscan(request.Header.Get("X-Client"), &client)
+		response := newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil)
+		response.Body = &gatedBody{Reader: response.Body, release: release, returned: &returned[client], buffering: &buffering, maxBuffering: &maxBuffering}
+		response.ContentLength = -1
+		return response, nil
+	}
+
+	// Every miss is for its own path, so none of them share a fetch
+	bodies := make([]string, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, fmt.Sprintf("/v1/secret/data/foo-%d", i), "172.16.0.1:1234", "token"))
+			request.Header.Set("X-Client", fmt.Sprint(i))
+			response, err := cache.refreshCache(request, refresher)
+			atomic.StoreInt32(&returned[i], 1)
+			if err != nil {
+				t.Errorf("refresh failed: %v", err)
+				return
+			}
+			bodies[i] = readBody(t, response)
+		}(i)
+	}
+
+	streamed := func() (count int) {
+		for i := range returned {
+			count += int(atomic.LoadInt32(&returned[i]))
+		}
+		return count
+	}
+	if !eventually(func() bool { return atomic.LoadInt32(&buffering) == slots && streamed() == clients-slots }) {
+		t.Errorf("got %d responses buffering and %d streamed, want %d and %d", atomic.LoadInt32(&buffering), streamed(), slots, clients-slots)
+	}
+	close(release)
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&maxBuffering); max > slots {
+		t.Errorf("%d responses were buffered at once, want at most %d", max, slots)
+	}
+	for i, body := range bodies {
+		if body != `{"data":{"value":"secret"}}` {
+			t.Errorf("client %d got body %q", i, body)
+		}
+	}
+}
+
+func TestTokenOverItsQuotaEvictsItsOwnEntries(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.entriesPerToken = 2
+
+	other := cacheReadWithToken(t, cache, parseHeader, "/v1/secret/data/foo-0", "token-b")
+	greedy := make([]string, 4)
+	for i := range greedy {
+		// Entries are aged by their millisecond last use
+		time.Sleep(2 * time.Millisecond)
+		greedy[i] = cacheReadWithToken(t, cache, parseHeader, fmt.Sprintf("/v1/secret/data/foo-%d", i), "token-a")
+	}
+
+	for i, key := range greedy {
+		_, isCached := cache.getFromCache(key)
+		if wantCached := i >= 2; isCached != wantCached {
+			t.Errorf("entry %d of the token over its quota: cached %v, want %v", i, isCached, wantCached)
+		}
+	}
+	if _, isCached := cache.getFromCache(other); !isCached {
+		t.Error("another token's entry was evicted by a token over its quota")
+	}
+}
+
+func TestNamespaceOverItsQuotaEvictsItsOwnEntries(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.entriesPerNamespace = 2
+	cacheRead := func(namespace string, path string) string {
+		request := newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token-"+path)
+		request.Header.Set(VAULT_NAMESPACE_HEADER, namespace)
+		request = parsedRequest(parseHeader, request)
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		readBody(t, response)
+		return cache.getEntryKey(request)
+	}
+
+	others := []string{cacheRead("team-b", "/v1/secret/data/foo-0"), cacheRead("team-b/child", "/v1/secret/data/foo-1")}
+	greedy := make([]string, 4)
+	for i := range greedy {
+		// Entries are aged by their millisecond last use; tokens differ, so only the namespace quota applies
+		time.Sleep(2 * time.Millisecond)
+		greedy[i] = cacheRead("/team-a/", fmt.Sprintf("/v1/secret/data/foo-%d", i))
+	}
+
+	for i, key := range greedy {
+		_, isCached := cache.getFromCache(key)
+		if wantCached := i >= 2; isCached != wantCached {
+			t.Errorf("entry %d of the namespace over its quota: cached %v, want %v", i, isCached, wantCached)
+		}
+	}
+	for _, key := range others {
+		if _, isCached := cache.getFromCache(key); !isCached {
+			t.Errorf("entry %s of another namespace was evicted by a namespace over its quota", key)
+		}
+	}
+}
+
+func TestSoftAndHardTtlZones(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	var calls int32
+	refresher := func(request *http.Request) (*http.Response, error) {
+		version := atomic.AddInt32(&calls, 1)
+		return newVaultResponse(request, http.StatusOK, fmt.Sprintf(`{"data":{"version":%d}}`, version), nil), nil
+	}
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, refresher)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+	entry, _ := cache.getFromCache(cache.getEntryKey(request))
+	entry.refresh = newBackgroundRefresh(request, refresher)
+	cachedBody := func() (string, error) {
+		response, err := cache.getCachedResponse(request)
+		if err != nil {
+			return "", err
+		}
+		return readBody(t, response), nil
+	}
+
+	// Fresh: served, not refreshed
+	entry.softExpires = time.Now().Add(time.Hour).UnixMilli()
+	if body, err := cachedBody(); err != nil || body != `{"data":{"version":1}}` || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("fresh entry got body %q, error %v and %d fetches, want version 1 without a refresh", body, err, atomic.LoadInt32(&calls))
+	}
+
+	// Stale: still served, and refreshed in the background
+	entry.softExpires = time.Now().Add(-time.Second).UnixMilli()
+	if body, err := cachedBody(); err != nil || body != `{"data":{"version":1}}` {
+		t.Errorf("stale entry got body %q and error %v, want version 1 served while refreshing", body, err)
+	}
+	if !eventually(func() bool { body, _ := cachedBody(); return body == `{"data":{"version":2}}` }) {
+		t.Error("stale entry was not replaced by its background refresh")
+	}
+
+	// Expired: never served
+	expireEntries(cache, time.Second)
+	if body, err := cachedBody(); err == nil {
+		t.Errorf("expired entry was served with body %q", body)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("got %d fetches, want the first one and a single background refresh", calls)
+	}
+}
+
+func TestStaleWhileRevalidateServesTheStaleEntryWhileRefreshing(t *testing.T) {
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	cache.staleWindow = 10
+	var calls int32
+	release := make(chan struct{})
+	refresher := func(request *http.Request) (*http.Response, error) {
+		version := atomic.AddInt32(&calls, 1)
+		if version > 1 {
+			<-release
+		}
+		return newVaultResponse(request, http.StatusOK, fmt.Sprintf(`{"data":{"version":%d}}`, version), nil), nil
+	}
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, refresher)
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+	entry, _ := cache.getFromCache(cache.getEntryKey(request))
+	if window := entry.expires - entry.softExpires; window != 10000 {
+		t.Fatalf("entry turns stale %dms before it expires, want the 10s window", window)
+	}
+	cachedBody := func() string {
+		response, err := cache.getCachedResponse(request)
+		if err != nil {
+			t.Fatalf("entry within the window was not served: %v", err)
+		}
+		return readBody(t, response)
+	}
+
+	// 5s before expiry: every hit is answered from cache at once, and one refresh runs behind them
+	cache.lock.Lock()
+	entry.expires, entry.softExpires = time.Now().Add(5*time.Second).UnixMilli(), time.Now().Add(-5*time.Second).UnixMilli()
+	cache.lock.Unlock()
+	for i := 0; i < 5; i++ {
+		if body := cachedBody(); body != `{"data":{"version":1}}` {
+			t.Errorf("got body %q while the refresh runs, want the stale version 1", body)
+		}
+	}
+	if !eventually(func() bool { return atomic.LoadInt32(&calls) == 2 }) {
+		t.Fatalf("got %d fetches, want a background refresh", atomic.LoadInt32(&calls))
+	}
+
+	close(release)
+	if !eventually(func() bool { return cachedBody() == `{"data":{"version":2}}` }) {
+		t.Error("stale entry was not replaced by its background refresh")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("got %d fetches for 5 hits in the window, want a single background refresh", calls)
+	}
+}
+
+func TestByteBudgetEvictsLeastRecentlyUsedEntries(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize, config.MaxCacheBytes = 100, 250
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	body := `{"data":{"value":"` + strings.Repeat("x", 79) + `"}}` // 100 bytes
+	paths := []string{"/v1/secret/data/a", "/v1/secret/data/b", "/v1/secret/data/c", "/v1/secret/data/d"}
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token"))
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, body, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		readBody(t, response)
+		keys[i] = cache.getEntryKey(request)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// Far from its entry limit, the cache only keeps the 2 most recent 100 byte bodies within 250 bytes
+	cache.lock.RLock()
+	bytes, size := cache.bytes, len(cache.cache)
+	cache.lock.RUnlock()
+	if bytes > 250 || size != 2 {
+		t.Errorf("cache holds %d entries and %d bytes, want 2 entries within the 250 byte budget", size, bytes)
+	}
+	for i, key := range keys {
+		if _, isCached := cache.getFromCache(key); isCached != (i >= 2) {
+			t.Errorf("%s cached = %v, want only the most recently used entries kept", paths[i], isCached)
+		}
+	}
+	if gauge := testutil.ToFloat64(cacheBytes); gauge != float64(bytes) {
+		t.Errorf("got %v in vault_proxy_cache_bytes, want %d", gauge, bytes)
+	}
+}
+
+func TestQueryVersionsAreSeparateEntries(t *testing.T) {
+	var fetches int32
+	chain, agent := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(writer, `{"data":{"data":{"version":%q}}}`, request.URL.Query().Get("version"))
+	})
+	agent.vaultCache.(*vaultCache).config.CacheSize = 100
+	read := func(target string) string {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(http.MethodGet, target, "172.16.0.1:1234", "token"))
+		return recorder.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, version := range []string{"1", "2"} {
+			if body, want := read("/v1/secret/data/foo?version="+version), `{"data":{"data":{"version":"`+version+`"}}}`; body != want {
+				t.Errorf("?version=%s got body %q, want %q", version, body, want)
+			}
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 2 {
+		t.Errorf("got %d fetches from Vault, want one per version", fetches)
+	}
+
+	// The same query in another order is the same entry
+	read("/v1/secret/data/foo?version=1&list=false")
+	read("/v1/secret/data/foo?list=false&version=1")
+	if fetches := atomic.LoadInt32(&fetches); fetches != 3 {
+		t.Errorf("got %d fetches from Vault, want reordered query parameters to share an entry", fetches)
+	}
+}
@@ -1,50 +1,250 @@
 package vault_proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/json"
 	"io"
+	"math/rand"
 	"net/http"
 	"strings"
 	"time"
 )
 
 type cachedResponse struct {
-	response *http.Response
-	bodyData string
-	expires  int64
-	lastUsed int64
+	response      *http.Response
+	bodyData      []byte      // Sealed with bodyCipher when CACHE_ENCRYPTION_KEY is set, see getBody
+	bodyCipher    cipher.AEAD // nil unless CACHE_ENCRYPTION_KEY is set
+	expires       int64       // Millis since epoch of the hard TTL, after which the entry is never served
+	softExpires   int64       // Millis since epoch of the soft TTL, after which hits trigger a background refresh
+	lastUsed      int64
+	storedAt      int64 // Millis since epoch the response was fetched from Vault
+	leaseDuration int64 // Seconds; lease_duration reported by Vault, 0 when the secret has no lease_id and isn't renewable
+	refreshAt     int64 // Millis since epoch when a hot entry becomes eligible for refresh-ahead
+	hits          int64 // Cache hits since the entry was stored; accessed atomically
+	refreshing    int32 // 1 while a background refresh is in flight; accessed atomically
+	refresh       func(ctx context.Context) (*http.Response, error)
+	emptyData     bool     // `true` if the body's `data` (or KV v2 data.data) is null or empty
+	negative      bool     // `true` for a cached error response (e.g. a 404) rather than a secret
+	token         string   // Vault token the entry was fetched with; used to evict entries of revoked tokens
+	path          string   // Request path, used for the hot paths of the efficiency report
+	namespace     string   // Vault namespace of the request, "" for root; used for the per-namespace quota
+	warnings      []string // `warnings` of the Vault response body
+}
+
+// Fields of a Vault API response body that influence caching
+type vaultResponseBody struct {
+	LeaseId       string          `json:"lease_id"`
+	LeaseDuration int64           `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Warnings      []string        `json:"warnings"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Returns `true` if a response `data` field is missing, null or empty. For KV v2 the secret lives in
+// data.data, which is null for a deleted (but not destroyed) version while its metadata is still present.
+// Keys named `data` anywhere else are secret values, never looked into.
+func isEmptyData(data json.RawMessage) bool {
+	if isEmptyJson(data) {
+		return true
+	}
+
+	var kvV2 map[string]json.RawMessage
+	if json.Unmarshal(data, &kvV2) != nil {
+		return false
+	}
+	secret, hasData := kvV2["data"]
+	_, hasMetadata := kvV2["metadata"]
+	return hasData && hasMetadata && isEmptyJson(secret)
+}
+
+// Returns `true` if the JSON value is missing, null or empty
+func isEmptyJson(value json.RawMessage) bool {
+	switch strings.TrimSpace(string(value)) {
+	case "", "null", "{}", "[]", `""`:
+		return true
+	}
+	return false
+}
+
+// Returns the plaintext body
+func (cr *cachedResponse) getBody() []byte {
+	// Entries are only ever sealed by this cipher, or checked against it when loaded from the shared cache
+	body, _ := openBody(cr.bodyCipher, cr.bodyData)
+	return body
 }
 
 // Returns the http.Response object that is cached and rewrites the stored Body to the Body stream.
+// Sealed entries return a copy instead, so the plaintext body is never left on the cached response.
 func (cr *cachedResponse) getResponse() *http.Response {
-	readerCloser := io.NopCloser(strings.NewReader(cr.bodyData))
+	readerCloser := io.NopCloser(bytes.NewReader(cr.getBody()))
+	if cr.bodyCipher != nil {
+		response := *cr.response
+		response.Body = readerCloser
+		return &response
+	}
 	cr.response.Body = readerCloser
 
 	return cr.response
 }
 
+// Returns the bytes the entry's body takes in the cache, sealed if encrypted.
+func (cr *cachedResponse) size() int64 {
+	return int64(len(cr.bodyData))
+}
+
 // Returns `true` if the cached entry is expired.
 func (cr *cachedResponse) isExpired() bool {
 	return time.Now().UnixMilli() > cr.expires
 }
 
+// Returns `true` if the entry is past its soft TTL and should be refreshed in the background while still being served.
+func (cr *cachedResponse) isStale() bool {
+	return time.Now().UnixMilli() > cr.softExpires
+}
+
+// Returns `true` if the entry expired less than `gracePeriod` seconds ago and may still be served
+// when a synchronous refresh fails.
+func (cr *cachedResponse) isWithinGrace(gracePeriod int) bool {
+	return time.Now().UnixMilli() <= cr.expires+int64(gracePeriod)*1000
+}
+
+// Returns a copy of the cached response marked stale per RFC 7234, leaving the cached headers untouched.
+func (cr *cachedResponse) getStaleResponse() *http.Response {
+	cr.lastUsed = time.Now().UnixMilli()
+	stale := *cr.getResponse()
+	stale.Header = stale.Header.Clone()
+	stale.Header.Set("Warning", `110 - "Response is Stale"`)
+
+	return &stale
+}
+
 // Should ALWAYS be used as the 'constructor' to this struct. Will properly initialize this instance of the struct.
-func newCachedResponse(response *http.Response) *cachedResponse {
-	// Copy response to buffer
-	buffer := new(strings.Builder)
-	io.Copy(buffer, response.Body)
-	body := buffer.String()
+// Responses with a lease expire with it, capped at maxTtlSeconds; all others are cached for defaultTtlSeconds.
+// Entries turn stale staleWindowSeconds (STALE_WHILE_REVALIDATE) before they expire, if not already by the soft TTL.
+// With a bodyCipher the body is stored sealed and the caller's response is the only copy holding it in plaintext.
+// Returns nil, with the response left to stream through, if its body exceeds MAX_CACHEABLE_BODY_BYTES, or with
+// an error if the body could not be sealed.
+func newCachedResponse(response *http.Response, defaultTtlSeconds int, maxTtlSeconds int, staleWindowSeconds int, bodyCipher cipher.AEAD) (*cachedResponse, error) {
+	body, isCacheable := readCacheableBody(response)
+	if !isCacheable {
+		return nil, nil
+	}
+	bodyData, err := sealBody(bodyCipher, body)
+	if err != nil {
+		return nil, err
+	}
 
-	// Write buffer back to response after copy so it's fresh
-	readerCloser := io.NopCloser(strings.NewReader(body))
-	response.Body = readerCloser
+	// Non-JSON bodies simply leave the parsed fields at their zero values
+	var parsedBody vaultResponseBody
+	json.Unmarshal(body, &parsedBody)
 
-	expires := time.Now().UnixMilli() + VAULT_CACHE_DEFAULT_EXPIRATION*1000
+	// Only a real lease bounds the entry. KV v1 reports its mount's 32-day default TTL as lease_duration, with
+	// no lease_id, as a refresh hint only.
+	leaseDuration := int64(0)
+	if parsedBody.LeaseId != "" || parsedBody.Renewable {
+		leaseDuration = parsedBody.LeaseDuration
+	}
+
+	ttlSeconds := int64(defaultTtlSeconds)
+	if leaseDuration > 0 {
+		ttlSeconds = leaseDuration
+		if ttlSeconds > int64(maxTtlSeconds) {
+			ttlSeconds = int64(maxTtlSeconds)
+		}
+	}
+
+	// An upstream max-age replaces the default TTL, but never outlives the lease or maxTtlSeconds
+	if directives := parseCacheControl(response.Header); RESPECT_UPSTREAM_CACHE_CONTROL && directives.hasMaxAge {
+		if leaseDuration <= 0 {
+			ttlSeconds = int64(maxTtlSeconds)
+		}
+		if int64(directives.maxAge) < ttlSeconds {
+			ttlSeconds = int64(directives.maxAge)
+		}
+	}
+
+	expires := time.Now().UnixMilli() + ttlSeconds*1000
 	lastUsed := time.Now().UnixMilli()
 
+	softExpires := expires
+	if CACHE_SOFT_TTL_FRACTION > 0 && CACHE_SOFT_TTL_FRACTION < 1 {
+		softExpires = lastUsed + int64(float64(expires-lastUsed)*CACHE_SOFT_TTL_FRACTION)
+	}
+	// Capped at half the TTL, so short-lived entries aren't refreshed on every hit
+	if window := int64(staleWindowSeconds) * 1000; window > 0 {
+		if window > (expires-lastUsed)/2 {
+			window = (expires - lastUsed) / 2
+		}
+		if expires-window < softExpires {
+			softExpires = expires - window
+		}
+	}
+
+	// Refresh-ahead window is jittered per entry so hot keys cached together don't refresh together
+	refreshAt := expires
+	if REFRESH_AHEAD_FRACTION > 0 {
+		window := float64(expires-lastUsed) * REFRESH_AHEAD_FRACTION * (1 + REFRESH_AHEAD_JITTER*(2*rand.Float64()-1))
+		refreshAt = expires - int64(window)
+	}
+
+	cached := response
+	if bodyCipher != nil {
+		detached := *response
+		detached.Body = http.NoBody
+		cached = &detached
+	}
+
 	return &cachedResponse{
-		response,
-		body,
-		expires,
-		lastUsed,
+		response:      cached,
+		bodyData:      bodyData,
+		bodyCipher:    bodyCipher,
+		expires:       expires,
+		softExpires:   softExpires,
+		lastUsed:      lastUsed,
+		storedAt:      lastUsed,
+		leaseDuration: leaseDuration,
+		refreshAt:     refreshAt,
+		emptyData:     isEmptyData(parsedBody.Data),
+		warnings:      parsedBody.Warnings,
+	}, nil
+}
+
+// Warnings only live in the body, surfaces them as VAULT_PROXY_WARNINGS_HEADER so they're cached and visible on every hit
+func (cr *cachedResponse) addWarningsHeader() {
+	for _, warning := range cr.warnings {
+		cr.response.Header.Add(VAULT_PROXY_WARNINGS_HEADER, strings.NewReplacer("\r", " ", "\n", " ").Replace(warning))
+	}
+}
+
+// Buffers the response body and rewrites it so it's fresh for the caller. Returns `false` without buffering
+// more than MAX_CACHEABLE_BODY_BYTES if the body is larger, leaving the response to stream through in full.
+func readCacheableBody(response *http.Response) ([]byte, bool) {
+	if MAX_CACHEABLE_BODY_BYTES > 0 && response.ContentLength > MAX_CACHEABLE_BODY_BYTES {
+		return nil, false
 	}
+
+	buffer := new(bytes.Buffer)
+	if response.ContentLength > 0 {
+		buffer.Grow(int(response.ContentLength))
+	}
+	reader := io.Reader(response.Body)
+	if MAX_CACHEABLE_BODY_BYTES > 0 {
+		reader = io.LimitReader(response.Body, MAX_CACHEABLE_BODY_BYTES+1)
+	}
+	io.Copy(buffer, reader)
+
+	// Chunked body over the limit - replay what was read, then stream the rest
+	if MAX_CACHEABLE_BODY_BYTES > 0 && buffer.Len() > MAX_CACHEABLE_BODY_BYTES {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(buffer, response.Body), response.Body}
+		return nil, false
+	}
+
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(buffer.Bytes()))
+	return buffer.Bytes(), true
 }
@@ -0,0 +1,91 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaseDurationOnlyAppliesToLeases(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantTtl int64
+	}{
+		// KV v1 reports its mount's default TTL with no lease behind it
+		{"kv v1", `{"lease_id":"","renewable":false,"lease_duration":2764800,"data":{"value":"secret"}}`, 30},
+		{"lease", `{"lease_id":"database/creds/app/abc","renewable":true,"lease_duration":60,"data":{"username":"app"}}`, 60},
+		{"renewable without id", `{"lease_id":"","renewable":true,"lease_duration":60,"data":{"value":"secret"}}`, 60},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newTestRequest(http.MethodGet, "/v1/secret/foo", "172.16.0.1:1234", "token")
+			entry, _ := newCachedResponse(newVaultResponse(request, http.StatusOK, test.body, nil), 30, 3600, 0, nil)
+
+			ttl := (entry.expires - time.Now().UnixMilli() + 500) / 1000
+			if ttl != test.wantTtl {
+				t.Errorf("got a TTL of %ds, want %ds", ttl, test.wantTtl)
+			}
+		})
+	}
+}
+
+func TestIsEmptyData(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"missing", ``, true},
+		{"null", `null`, true},
+		{"empty object", `{}`, true},
+		{"kv v1", `{"value":"secret"}`, false},
+		{"kv v2", `{"data":{"value":"secret"},"metadata":{"version":2}}`, false},
+		{"kv v2 deleted version", `{"data":null,"metadata":{"version":2,"deletion_time":"2024-01-01T00:00:00Z"}}`, true},
+		{"kv v1 secret with a null data key", `{"data":null,"owner":"team-a"}`, false},
+		{"kv v2 secret with a null data key", `{"data":{"data":null},"metadata":{"version":1}}`, false},
+	}
+
+	for _, tc := range tests {
+		if got := isEmptyData(json.RawMessage(tc.data)); got != tc.want {
+			t.Errorf("%s: isEmptyData(%s) = %v, want %v", tc.name, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestEncryptedBodyNeverHoldsThePlaintext(t *testing.T) {
+	const secret = "hunter2-plaintext-secret"
+	body := `{"data":{"password":"` + secret + `"}}`
+	t.Setenv("CACHE_ENCRYPTION_KEY", "test-encryption-key")
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, body, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+
+	entry, isCached := cache.getFromCache(cache.getEntryKey(request))
+	if !isCached {
+		t.Fatal("the encrypted entry was not cached")
+	}
+	if strings.Contains(string(entry.bodyData), secret) || strings.Contains(string(entry.bodyData), `"data"`) {
+		t.Errorf("stored body %q holds the plaintext", entry.bodyData)
+	}
+	if got := readBody(t, entry.getResponse()); got != body {
+		t.Errorf("cached response has body %q, want the decrypted secret %q", got, body)
+	}
+
+	// Without a key the stored body is the plaintext, as before
+	plain, _ := newCachedResponse(newVaultResponse(request, http.StatusOK, body, nil), 30, 3600, 0, nil)
+	if string(plain.bodyData) != body {
+		t.Errorf("got stored body %q without an encryption key, want the plaintext", plain.bodyData)
+	}
+}
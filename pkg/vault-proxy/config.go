@@ -1,33 +1,181 @@
 package vault_proxy
 
 // Configurable Constants
+// Settings that are fields of Config (see loadConfig.go) are only defaults, overridden by the
+// environment variable of the same name, e.g. VAULT_ADDR=vault.internal CACHE_SIZE=10000.
 
+const VAULT_SCHEME = "https" // "http" for e.g. `vault server -dev`
 const VAULT_ADDR = "127.0.0.1"
 const VAULT_PORT = 8080
 const PROXY_ADDR = "127.0.0.1"
 const PROXY_PORT = 8001
+const ADMIN_ADDR = "127.0.0.1" // admin listener; must not be exposed publicly
+const ADMIN_PORT = 9101
+
+// Verification of the Vault server certificate. VAULT_CA_CERT_FILE is a PEM bundle used instead of the system
+// roots; VAULT_TLS_SKIP_VERIFY disables verification and must only be used for local testing.
+const VAULT_CA_CERT_FILE = ""
+const VAULT_TLS_SKIP_VERIFY = false
+
+// HTTP(S) proxy for every call to Vault, e.g. "http://proxy.corp:3128". Empty uses HTTPS_PROXY/NO_PROXY from the environment.
+const VAULT_OUTBOUND_PROXY = ""
+
 const VAULT_CACHE_DEFAULT_EXPIRATION = 30 // responses are cached for 60 seconds.
 const VAULT_CACHE_PURGE_FREQUENCY = 30    // force purge all expired records every 1.5 minutes to prevent unnecessary memory bloat
+const VAULT_CACHE_MIN_TTL = 5             // responses whose lease_duration is below 5 seconds are not cached
+const VAULT_CACHE_MAX_TTL = 300           // responses with a lease are cached for their lease_duration, but at most 5 minutes
+
+// Seconds past expiry an entry is kept. A read in this window refreshes synchronously from Vault,
+// and if that refresh fails (error or 5xx) the stale entry is served with a Warning header. 0 disables
+const STALE_GRACE_PERIOD = 0
+
+// Every CACHE_REPORT_INTERVAL seconds the hit ratio, eviction rate, average entry TTL and the
+// CACHE_REPORT_TOP_PATHS most hit paths are logged. 0 disables the report.
+const CACHE_REPORT_INTERVAL = 0
+const CACHE_REPORT_TOP_PATHS = 5
+
+// Alert (log, metric and optional webhook) once when the cache hit ratio over the last CACHE_HIT_RATIO_ALERT_WINDOW
+// seconds drops below CACHE_HIT_RATIO_ALERT_THRESHOLD (0-1), counting only windows of at least
+// CACHE_HIT_RATIO_ALERT_MIN_REQUESTS lookups. 0 disables the alert. Set CACHE_HIT_RATIO_ALERT_WEBHOOK to also POST it.
+const CACHE_HIT_RATIO_ALERT_THRESHOLD = 0.0
+const CACHE_HIT_RATIO_ALERT_WINDOW = 300
+const CACHE_HIT_RATIO_ALERT_MIN_REQUESTS = 100
+const CACHE_HIT_RATIO_ALERT_WEBHOOK = ""
+
+// Memory guard against OOM kills: once the heap, sampled every CACHE_MEMORY_GUARD_INTERVAL seconds, exceeds
+// CACHE_MEMORY_LIMIT_MB no new responses are cached until it drops below CACHE_MEMORY_RESUME_FRACTION of the limit.
+// Set CACHE_MEMORY_PRESSURE_EVICT to also evict a quarter of the entries per sample while over. 0 disables the guard.
+const CACHE_MEMORY_LIMIT_MB = 0
+const CACHE_MEMORY_GUARD_INTERVAL = 5
+const CACHE_MEMORY_RESUME_FRACTION = 0.9
+const CACHE_MEMORY_PRESSURE_EVICT = false
+
+// Seals cached response bodies with AES-256-GCM under a key derived from this secret, so secrets never sit in
+// memory (heap dumps, core files) or the shared cache in plaintext. Use a long random value; "" stores bodies as is.
+const CACHE_ENCRYPTION_KEY = ""
+const HIT_RATIO_ALERT_WEBHOOK_TIMEOUT = 5
+
+// Refresh-ahead - hot entries are refreshed in the background once they enter the last REFRESH_AHEAD_FRACTION
+// of their TTL, jittered by ±REFRESH_AHEAD_JITTER per entry so keys cached together don't refresh together.
+const REFRESH_AHEAD_FRACTION = 0.0 // 0 disables refresh-ahead, e.g. 0.2 refreshes during the last 20% of the TTL
+const REFRESH_AHEAD_JITTER = 0.1
+const REFRESH_AHEAD_MIN_HITS = 2 // hits since the entry was stored before it counts as hot
 
-// Any URL that contains 1 of these subpaths will be eligible for caching.
+// Soft TTL, as a fraction of the hard TTL (VAULT_CACHE_DEFAULT_EXPIRATION). Past the soft TTL an entry is stale:
+// it is still served, but every hit triggers a background refresh. Past the hard TTL it is never served.
+const CACHE_SOFT_TTL_FRACTION = 1.0 // 1 disables the soft TTL, e.g. 0.5 marks entries stale halfway through their TTL
+
+// Stale-while-revalidate window: entries also turn stale this many seconds before their hard TTL, whatever
+// their length (at most half of it), so latency-sensitive callers are served from cache while the entry refreshes. 0 disables it.
+const STALE_WHILE_REVALIDATE = 0
+
+// Every TOKEN_VALIDATION_FREQUENCY seconds one sampled cached token is checked against Vault's
+// token/lookup-self, and all of its entries are evicted if Vault reports it revoked. 0 disables validation.
+const TOKEN_VALIDATION_FREQUENCY = 0
+
+// Limiter cache keys (as logged by ParseHeaderHandler) of monitoring tokens that always bypass the cache,
+// so synthetic monitors measure real Vault latency. Canary requests are still rate-limited.
+var CANARY_TOKEN_HASHES = [...]string{}
+
+// Any URL under 1 of these subpaths (matched on whole path segments, e.g. "/v1/secret/data" matches
+// "/v1/secret/data/foo" but not "/v1/secret/data-like") will be eligible for caching.
 var CACHEABLE_SUBPATHS = [...]string{
 	"/v1/secret/data",
 }
 
+// Requests to exactly a CACHEABLE_SUBPATHS entry, with no leaf below it, are not real secret reads and are
+// only cached when this is set.
+const CACHE_SUBPATH_BASE_REQUESTS = false
+
+// Any URL under 1 of these subpaths is never cached, even if it also matches CACHEABLE_SUBPATHS. Matched after
+// path-style namespaces too, e.g. /v1/team-a/sys/wrapping/unwrap.
+// Response-wrapping tokens are single-use, so a cached unwrap would replay the secret to other callers.
+var NEVER_CACHEABLE_SUBPATHS = [...]string{
+	"/v1/sys/wrapping/",
+}
+
+// Per-subpath cache key composition, the longest matching Subpath wins. Paths without a rule are keyed on
+// token, path and namespace; reads are always keyed on their query string too, e.g. KV v2 ?version=.
+// e.g. {Subpath: "/v1/sys", Token: true, Namespace: true, Accept: true} keys a path per normalized Accept
+// header; a write to the path drops its reads of every Accept, method and body. Leaving Token out shares cached secrets between tokens, so only do that for paths every token is
+// allowed to read; requests without a token are then never cached. PathPattern
+// maps aliased paths below the Subpath to one key, PathReplacement may use the pattern's groups, e.g. "$1".
+var CACHE_KEY_RULES = [...]CacheKeyRule{}
+
+// Strips trailing slashes before cacheability checks and cache keying, so `/v1/secret/data/foo/`
+// shares a cache entry with `/v1/secret/data/foo`. Requests are still forwarded with their original path.
+const NORMALIZE_TRAILING_SLASH = false
+
+// Folds the accessor of the mount serving the path into the cache key, so a path on a remounted
+// secrets engine never shares entries with the previous mount. Mount tables are fetched with
+// the agent's Vault token (VAULT_TOKEN / VAULT_TOKEN_FILE) and refreshed in the background every
+// MOUNT_TABLE_REFRESH_FREQUENCY seconds. Namespaces come from the client's X-Vault-Namespace header, so at most
+// MAX_MOUNT_TABLE_NAMESPACES tables are kept; the least recently fetched one is evicted first.
+const INCLUDE_MOUNT_ACCESSOR_IN_KEY = false
+const MOUNT_TABLE_REFRESH_FREQUENCY = 30
+const MAX_MOUNT_TABLE_NAMESPACES = 1000
+
+// Key the cache on the identity behind the token (its entity_id and policies, from auth/token/lookup-self)
+// instead of the token, so the tokens of one identity share entries. Tokens are looked up in the background once their
+// requests pass the rate limiter, and keep per-token entries until then. Lookups are cached ENTITY_LOOKUP_TTL seconds,
+// or until the token expires if sooner; tokens without an entity (e.g. root tokens) or whose lookup failed keep
+// per-token entries.
+const CACHE_KEY_BY_ENTITY = false
+const ENTITY_LOOKUP_TTL = 300
+
 // Any request of the following method types will be ignored
 // DELETE for deleting key values
 // POST for create/update key values
 // https://www.vaultproject.io/api-docs/secret/kv/kv-v1
+// This is the startup default; it can be replaced at runtime with PUT /admin/config/methods-to-ignore
 var METHODS_TO_IGNORE = [...]string{
 	"DELETE",
 	"POST",
 	"PATCH",
 }
 
+// Shadow upstream - mirrors a sample of read requests to a second Vault cluster and logs divergences
+const SHADOW_VAULT_ADDR = "" // mirroring is disabled when empty
+const SHADOW_VAULT_PORT = 8080
+const SHADOW_SAMPLE_PERCENT = 0  // percentage (0-100) of read requests mirrored to the shadow Vault
+const SHADOW_REQUEST_TIMEOUT = 5 // seconds
+
+// HEAD requests to cacheable paths are proxied without caching unless enabled.
+// When enabled they are cached under a key distinct from GET so an empty HEAD body is never served for a GET.
+const CACHE_HEAD_REQUESTS = false
+
+// Copies Vault response `warnings` into the X-Vault-Proxy-Warnings header of cached responses
+const PROPAGATE_VAULT_WARNINGS = false
+
+// 4xx status codes that are cached too, as negative entries, mapped to their own (short) TTL in seconds. Statuses
+// mapped to 0 are cached for NEGATIVE_CACHE_TTL, so a hot read of a missing secret (or one the token may not read)
+// doesn't reach Vault on every request, e.g. {403: 5} keeps clients polling until a policy is attached off Vault.
+var CACHEABLE_ERROR_STATUS_TTLS = map[int]int{
+	404: 0,
+	403: 0,
+}
+
+// Default TTL in seconds of the CACHEABLE_ERROR_STATUS_TTLS statuses mapped to 0. 0 disables caching them
+const NEGATIVE_CACHE_TTL = 0
+
+// Doesn't cache 200 responses whose `data` is null or empty (e.g. a deleted but not destroyed KV v2 version),
+// so a later undelete is visible immediately
+const SKIP_CACHING_EMPTY_DATA = false
+
+// 200s with a zero-length body (other than to HEAD requests) come from upstream bugs and are never cached,
+// so they can't be served as empty secrets until expiry. Disable to cache them like any other 200.
+const SKIP_CACHING_EMPTY_BODY = true
+
+// Honors the Cache-Control of upstream responses: no-store, no-cache and private responses are not cached and
+// max-age (s-maxage) replaces the default TTL. Off by default because Vault sends `Cache-Control: no-store` on
+// every API response, which would disable caching. Vary is always honored, entries are keyed per listed header.
+const RESPECT_UPSTREAM_CACHE_CONTROL = false
+
 // Rate limiters should be purged at a much higher rate than vault cache
 // since deleting rate limiters resets API tracking
 const RATE_LIMITER_DEFAULT_EXPIRATION = 60 // rate-limiters are cached for 120 seconds.
 const RATE_LIMITER_PURGE_FREQUENCY = 60    // purges all unused limiters after default expiration time
+const RATE_LIMITER_MAX_LIFETIME = 0        // seconds after which even an active limiter is recreated with the current limits; 0 disables
 
 const RATELIMITING_HASHING_KEY_PREFIX = "umtmynuxphgogwcickiyyongcdmpldofpqufkvdmckasamrtzk"
 const RATELIMITING_HASHING_KEY_SUFFIX = "fiamhqbicxrgcrfvirlkdxmxzdbxoeojhkfffjsqycxizncojv"
@@ -37,17 +185,203 @@ const BURST_LIMIT_PER_SECOND = 2   // Burst requests allowed per second
 const RATE_LIMIT_PER_MINUTE = 5    // Number of requests allowed per minute
 const RATE_LIMITER_BUCKET_SIZE = 5 // Max requests allowed in a time frame
 
+// Trusted peers (e.g. the hosts of internal batch jobs) may raise the burst of their token's limiters with
+// X-Vault-Proxy-Burst: <requests> for BURST_OVERRIDE_DURATION seconds, clamped to BURST_OVERRIDE_MAX. 0 disables overrides.
+// Only the agent the client connects to checks these; requests routed on from AGENT_PEER_CIDRS keep the header it let through.
+const BURST_OVERRIDE_MAX = 0
+const BURST_OVERRIDE_DURATION = 300
+
+var BURST_OVERRIDE_TRUSTED_CIDRS = [...]string{}
+
+// Cap in seconds on the Retry-After sent with 429s, so a very low rate can't tell clients to go away for hours
+const RATE_LIMIT_RETRY_AFTER_MAX = 60
+
+// Concurrent requests allowed in flight per client IP. 0 disables the limit
+const MAX_CONNECTIONS_PER_CLIENT_IP = 0
+
+// Proxies (load balancers, peer agents) whose X-Forwarded-For header is trusted for the client IP
+var TRUSTED_PROXY_CIDRS = [...]string{}
+
+// Addresses of the agents themselves. Requests from them were routed on by another agent, which already dropped
+// the proxy control headers (e.g. X-Vault-Proxy-Burst) the client wasn't trusted with, so they're kept as is.
+// Never include client networks: their control headers would then be trusted.
+var AGENT_PEER_CIDRS = [...]string{}
+
+// Peers allowed to force routing to a node with X-Vault-Proxy-Route-Node: <node id>, for debugging and canaries.
+// Checked by the agent the client connects to only; agents in AGENT_PEER_CIDRS keep the header it let through.
+var ROUTE_OVERRIDE_TRUSTED_CIDRS = [...]string{}
+
+// TLS on the proxy listener. Set PROXY_TLS_CERT_FILE/PROXY_TLS_KEY_FILE to serve https; set PROXY_CLIENT_CA_FILE to
+// also require client certificates signed by that CA (mTLS). Agents then reach each other over https with the
+// same certificate, so agent certificates must be signed by PROXY_CLIENT_CA_FILE too.
+const PROXY_TLS_CERT_FILE = ""
+const PROXY_TLS_KEY_FILE = ""
+const PROXY_CLIENT_CA_FILE = ""
+
+// Client certificate identities (CN or SAN) of the agents, trusted to pass on the original client's identity
+var TRUSTED_AGENT_IDENTITIES = [...]string{}
+
+// Rate-limits per verified client certificate identity instead of per token
+const RATE_LIMIT_BY_CLIENT_IDENTITY = false
+
+// Holds a token's requests to a namespace (X-Vault-Namespace) listed in NAMESPACE_RATE_LIMITS to that namespace's
+// limits too, so a noisy namespace can be capped below the token's limit. The token's own limit always applies.
+const RATE_LIMIT_BY_NAMESPACE = false
+
+// Per-namespace limits applied on top of the global ones, e.g. "team-a": {BurstLimitPerSecond: 1, RateLimitPerMinute: 2, BucketSize: 2}.
+// Namespaces are matched without leading/trailing slashes; the root namespace is "".
+var NAMESPACE_RATE_LIMITS = map[string]NamespaceRateLimit{}
+
 const CACHE_SIZE = 2
+const MAX_CACHE_BYTES = 0                // Total cached body bytes; LRU entries are evicted to stay within it. 0 disables
+const CACHE_ENTRIES_PER_TOKEN = 0        // Per-token entry quota; a token at its quota evicts its own oldest entries. 0 disables
+const CACHE_ENTRIES_PER_NAMESPACE = 0    // Per-namespace entry quota; a namespace at its quota evicts its own LRU entry. 0 disables
+const MAX_CONCURRENT_BODY_BUFFERING = 64 // Concurrent cache misses buffering a body; the rest stream through uncached
+const MAX_CACHEABLE_BODY_BYTES = 8 << 20 // Larger responses stream through uncached instead of being buffered. 0 disables
+const MAX_REQUEST_BODY_BYTES = 32 << 20  // Larger request bodies are answered with 413, like Vault's max_request_size. 0 disables
 const RATE_LIMITER_CACHE_SIZE = 2
 
+// Response cache: "memory" keeps each agent's own cache, cold after a restart; "redis" additionally shares
+// responses between agents through REDIS_ADDR, with each agent's in-memory cache in front of it.
+const CACHE_BACKEND = "memory"
+
+// Rate limiter state: "memory" keeps each agent's own buckets, so a token routed across N agents gets N times the
+// limit; "redis" shares token buckets between agents through REDIS_ADDR (Redis 5+). While Redis is unreachable
+// each agent falls back to its own in-memory buckets, retrying Redis every REDIS_RETRY_INTERVAL seconds.
+const RATE_LIMITER_BACKEND = "memory"
+
+// Per-subpath overrides of RATE_LIMITER_BACKEND, e.g. "/v1/database/creds/": "redis" to share the buckets of a few
+// costly paths between agents while the rest stay on the faster in-memory buckets. The longest matching subpath
+// wins. A token's requests to an overridden path use buckets of their own, apart from its other requests.
+var RATE_LIMITER_BACKEND_BY_PATH = map[string]string{}
+
+// Redis shared by the agents
+const REDIS_ADDR = "localhost:6379"
+const REDIS_PASSWORD = ""
+const REDIS_DB = 0
+const REDIS_TIMEOUT_MS = 50
+const REDIS_RETRY_INTERVAL = 5
+const REDIS_KEY_PREFIX = "vault-proxy:"
+
+// Shared cache writes wait for REDIS_CACHE_MIN_REPLICAS replicas to acknowledge them (Redis WAIT), for at most
+// REDIS_CACHE_REPLICA_TIMEOUT_MS, so an entry survives the loss of the primary. A write that reaches fewer replicas
+// is counted in vault_proxy_redis_errors_total{operation="cache_replicate"}; the response is served from Vault
+// either way. The wait adds up to the timeout to cache misses. 0 disables
+const REDIS_CACHE_MIN_REPLICAS = 0
+const REDIS_CACHE_REPLICA_TIMEOUT_MS = 20
+
+// Expiry timestamps of entries shared through Redis or pushed by neighbor agents come from the storing agent's clock.
+// They are moved this many millis earlier, so entries from an agent whose clock runs ahead by up to this much are
+// never served past their expiry. A warning is logged when an entry was stored further in the future.
+const CLOCK_SKEW_TOLERANCE_MS = 500
+
+// Entries loaded from the Redis cache are answered locally for REDIS_HOT_KEY_TTL_MS, so keys missing from the
+// in-memory cache (e.g. evicted from a small CACHE_SIZE) don't cost a Redis call per request. Redis stays the source
+// of truth: writes through another agent are seen here within the TTL. At most REDIS_HOT_KEY_CACHE_SIZE entries
+// are kept. 0 disables
+const REDIS_HOT_KEY_TTL_MS = 0
+const REDIS_HOT_KEY_CACHE_SIZE = 100
+
 const VAULT_CONFIG_CHECK_FREQUENCY = 5 // Checks vault configuration every 5 seconds
+const VAULT_CONFIG_TIMEOUT = 3         // Seconds a vault configuration check may take before the current routing table is kept
+
+// Upstream for the raft configuration fetch, which may be reachable on a different address/port
+// (e.g. an internal cluster listener) than data traffic. Defaults to the data upstream.
+const VAULT_CONFIG_SCHEME = VAULT_SCHEME
+const VAULT_CONFIG_ADDR = VAULT_ADDR
+const VAULT_CONFIG_PORT = VAULT_PORT
+
+// Handling of requests carrying several different X-Vault-Namespace headers. Vault only reads the first one,
+// "first" keys on and forwards just that one, "reject" answers 400. Identical duplicates are always collapsed.
+const DUPLICATE_NAMESPACE_HEADER_POLICY = "first"
 
-const VAULT_ROOT_TOKEN = "hvs.0m0imDAXB9AVSkr0LaeCbKNa"
+// Header whose value drives agent routing affinity instead of the Vault token, e.g. "X-Tenant-ID". Requests
+// without it fall back to the token. Clients choose its value, so rate limits and cache keys stay on the token.
+// Must be the same on every agent, otherwise agents disagree on which one owns a request.
+const ROUTING_KEY_HEADER = ""
+
+// Which header wins when a request carries both X-Vault-Token and an "Authorization: Bearer" token.
+// "x-vault-token" prefers X-Vault-Token, "authorization" prefers the bearer token (case-insensitive).
+// The winning token is used for cache/limiter keys and forwarded upstream as X-Vault-Token.
+const TOKEN_HEADER_PRECEDENCE = "x-vault-token"
+
+const PROXY_REQUEST_TIMEOUT = 10   // Overall per-request deadline in seconds, exceeded requests get a 504
+const SHUTDOWN_DRAIN_TIMEOUT = 30  // Seconds in-flight requests get to finish after SIGINT/SIGTERM
+const UNAVAILABLE_RETRY_AFTER = 5  // Retry-After seconds sent with a 503 when Vault can't be reached
+const UPSTREAM_CLOSED_STATUS = 502 // Status sent when Vault closes or resets the connection before responding, e.g. 503 to make clients retry
+
+// Only orders the last resort of a cacheable read: the routed agent, then the cache, then Vault are always tried
+// first, in that order. Once all three failed, these fallbacks are tried in order. "stale" serves an expired entry
+// not yet purged from the cache, "unavailable" answers 503 immediately.
+// e.g. {"stale", "unavailable"} prefers availability, {"unavailable"} prefers freshness.
+var VAULT_FAILURE_FALLBACK_ORDER = [...]string{
+	"unavailable",
+}
+
+// Load shedding - while the p95 latency of upstream calls over the last LOAD_SHED_WINDOW seconds
+// is above LOAD_SHED_P95_THRESHOLD_MS, non-cacheable requests are rejected with a 503. 0 disables shedding.
+const LOAD_SHED_P95_THRESHOLD_MS = 0
+const LOAD_SHED_WINDOW = 30
+const LOAD_SHED_MAX_SAMPLES = 1000 // most recent upstream calls kept for the percentile
+
+// Per-token circuit breaker - a token whose requests get more than TOKEN_ERROR_THRESHOLD upstream 5xx within
+// TOKEN_ERROR_WINDOW seconds has its requests answered with a 503 for TOKEN_ERROR_COOLDOWN seconds. 0 disables it.
+const TOKEN_ERROR_THRESHOLD = 0
+const TOKEN_ERROR_WINDOW = 60
+const TOKEN_ERROR_COOLDOWN = 30
+
+// /readyz answers 503 once the last non-empty routing table from Vault is older than this many
+// VAULT_CONFIG_CHECK_FREQUENCY intervals. Never if VAULT_CONFIG_CHECK_FREQUENCY is 0 or less, as the config is
+// then only fetched once.
+const READINESS_CONFIG_MAX_AGE = 3
+
+// Backends whose ping must succeed for /readyz to answer 200: "cache" (the Redis of CACHE_BACKEND "redis") and
+// "rate_limiter" (the Redis of RATE_LIMITER_BACKEND "redis"). Unlisted backends are pinged and only logged, since
+// agents fall back to their own memory while Redis is down. In-memory backends are always up.
+var READINESS_REQUIRED_BACKENDS = [...]string{}
+
+// Local development against a single Vault: two mock raft peers are added to the routing table and each
+// peer's agent port is offset by its index, so several agents can run on one host. Never set in production.
+const VAULT_PROXY_DEV = false
 
 const AGENT_VAULT_PORT_DIFF = 1000
 const AGENT_REQUEST_TIMEOUT = 2
 
+// Agent-to-agent forwards a request may go through before it's processed wherever it lands. Routing
+// tables that disagree (e.g. mid raft config change) would otherwise bounce a request between agents.
+const AGENT_MAX_FORWARD_HOPS = 2
+
+// Points per agent on the routing hash ring; more points spread routing keys more evenly across agents
+const ROUTING_VIRTUAL_NODES = 100
+
+// Number of next agents on the routing hash ring whose caches are warmed after a cache miss on the owning agent,
+// so a failover that moves a token to a neighbor lands on a warm cache. 0 disables replication. The owning agent
+// pushes the cached entry to CACHE_REPLICA_PATH, which only accepts it from AGENT_PEER_CIDRS or TRUSTED_AGENT_IDENTITIES.
+const CACHE_REPLICATION_NEIGHBORS = 0
+
+// Namespaces that get their own label on namespace-labeled metrics; all others are reported as "other".
+// The root namespace is labeled "root".
+var METRIC_NAMESPACE_ALLOWLIST = [...]string{
+	"root",
+}
+
+// Mounts net/http/pprof under /debug/pprof/ on the admin listener
+const ENABLE_PPROF = false
+
+// Injects a `_proxy` object (cache status, serving node, entry age) into JSON responses of requests that
+// carry the admin token (ADMIN_TOKEN or ADMIN_TOKEN_FILE) in the X-Vault-Proxy-Admin-Token header. For client-side debugging only.
+const INJECT_PROXY_METADATA = false
+
 // Static Constants
 
 const VAULT_TOKEN_HEADER = "X-Vault-Token"
 const VAULT_NAMESPACE_HEADER = "X-Vault-Namespace"
+const VAULT_WRAP_TTL_HEADER = "X-Vault-Wrap-TTL"
+const AUTHORIZATION_HEADER = "Authorization"
+const VAULT_PROXY_WARNINGS_HEADER = "X-Vault-Proxy-Warnings"
+const ADMIN_TOKEN_HEADER = "X-Vault-Proxy-Admin-Token"
+const CLIENT_IDENTITY_HEADER = "X-Vault-Proxy-Client-Identity"
+const ROUTE_NODE_HEADER = "X-Vault-Proxy-Route-Node"
+const CACHE_REPLICA_PATH = "/agent/replica"
+const AGENT_FORWARDED_HEADER = "X-Vault-Proxy-Forwarded"
+const BURST_OVERRIDE_HEADER = "X-Vault-Proxy-Burst"
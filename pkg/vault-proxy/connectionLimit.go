@@ -0,0 +1,108 @@
+package vault_proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Per client IP concurrent request limit
+type connectionLimiter struct {
+	lock           sync.Mutex
+	active         map[string]int // client IP -> requests in flight
+	maxPerIP       int
+	trustedProxies []*net.IPNet
+}
+
+// Should ALWAYS be used as the "constructor" for the connectionLimiter. A maxPerIP of 0 disables the limit.
+func NewConnectionLimiter(maxPerIP int, trustedProxyCIDRs []string) *connectionLimiter {
+	limiter := &connectionLimiter{
+		active:   make(map[string]int),
+		maxPerIP: maxPerIP,
+	}
+
+	limiter.trustedProxies = parseCIDRs(trustedProxyCIDRs, "trusted proxy")
+
+	return limiter
+}
+
+// Returns `true` if the address belongs to a trusted proxy (load balancer, peer agent etc.)
+func (c *connectionLimiter) isTrustedProxy(ip net.IP) bool {
+	return networksContain(c.trustedProxies, ip)
+}
+
+// Returns the client IP of the request. X-Forwarded-For is only honored when the request comes
+// from a trusted proxy, and is walked right to left so a client can't spoof its address by
+// prepending entries.
+func (c *connectionLimiter) clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !c.isTrustedProxy(ip) {
+		return host
+	}
+
+	forwardedFor := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwardedFor[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		host = hop
+		if !c.isTrustedProxy(hopIP) {
+			break
+		}
+	}
+
+	return host
+}
+
+// Reserves a slot for the IP, returns `false` if it is already at its limit
+func (c *connectionLimiter) acquire(ip string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.active[ip] >= c.maxPerIP {
+		return false
+	}
+	c.active[ip]++
+	return true
+}
+
+// Releases a slot reserved by acquire
+func (c *connectionLimiter) release(ip string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.active[ip]--; c.active[ip] <= 0 {
+		delete(c.active, ip)
+	}
+}
+
+// Rejects requests from a client IP that already has MAX_CONNECTIONS_PER_CLIENT_IP requests in flight
+func (c *connectionLimiter) ConnectionLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if c.maxPerIP <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		ip := c.clientIP(request)
+		if !c.acquire(ip) {
+			log.Printf("CONNECTION LIMIT EXCEEDED: Client: %s Path: %s", ip, request.URL.Path)
+			writer.Header().Set("Retry-After", strconv.Itoa(UNAVAILABLE_RETRY_AFTER))
+			writeVaultError(writer, http.StatusTooManyRequests, "too many concurrent requests from this client")
+			return
+		}
+		defer c.release(ip)
+
+		next.ServeHTTP(writer, request)
+	})
+}
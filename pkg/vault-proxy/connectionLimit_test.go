@@ -0,0 +1,75 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConnectionLimitIsPerClientIP(t *testing.T) {
+	limiter := NewConnectionLimiter(2, []string{"10.0.0.0/8"})
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := limiter.ConnectionLimitHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("X-Block") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	// The load balancer forwards two slow requests of one client, filling its slots
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.1:1234", "token")
+			request.Header.Set("X-Forwarded-For", "172.16.0.1")
+			request.Header.Set("X-Block", "true")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+		}()
+		<-entered
+	}
+
+	throttled := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.1:1234", "token")
+	throttled.Header.Set("X-Forwarded-For", "172.16.0.1")
+	if statuses := serveTimes(handler, throttled, 1); statuses[0] != http.StatusTooManyRequests {
+		t.Errorf("got status %d for a client over its limit, want %d", statuses[0], http.StatusTooManyRequests)
+	}
+
+	// Another client behind the same load balancer, and one connecting directly, are unaffected
+	other := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.1:1234", "token")
+	other.Header.Set("X-Forwarded-For", "172.16.0.2")
+	if statuses := serveTimes(handler, other, 1); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d for another forwarded client, want %d", statuses[0], http.StatusOK)
+	}
+	direct := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.3:1234", "token")
+	if statuses := serveTimes(handler, direct, 1); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d for a direct client, want %d", statuses[0], http.StatusOK)
+	}
+
+	close(release)
+	wg.Wait()
+
+	// Finished requests give their slots back
+	if statuses := serveTimes(handler, throttled, 1); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d once the client's requests finished, want %d", statuses[0], http.StatusOK)
+	}
+}
+
+func TestUntrustedForwardedForIsIgnored(t *testing.T) {
+	limiter := NewConnectionLimiter(1, []string{"10.0.0.0/8"})
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	request.Header.Set("X-Forwarded-For", "172.16.0.2")
+	if ip := limiter.clientIP(request); ip != "172.16.0.1" {
+		t.Errorf("got client IP %s, want the untrusted peer 172.16.0.1", ip)
+	}
+
+	// A spoofed entry prepended by the client is skipped
+	request = newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.1:1234", "token")
+	request.Header.Set("X-Forwarded-For", "1.2.3.4, 172.16.0.2, 10.0.0.2")
+	if ip := limiter.clientIP(request); ip != "172.16.0.2" {
+		t.Errorf("got client IP %s, want the rightmost untrusted hop 172.16.0.2", ip)
+	}
+}
@@ -0,0 +1,82 @@
+package vault_proxy
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Hash ring of agent addresses, each placed at virtualNodes points, so adding or removing one of N agents
+// only moves ~1/N of the routing keys instead of almost all of them as with hash % N.
+type consistentHash struct {
+	points []uint32          // Sorted hashes of every virtual node
+	nodes  map[uint32]string // Virtual node hash -> agent address
+	size   int               // Number of distinct agents on the ring
+}
+
+// Should ALWAYS be used as the "constructor" for the consistentHash.
+func newConsistentHash(addresses []string, virtualNodes int) *consistentHash {
+	ring := &consistentHash{
+		points: make([]uint32, 0, len(addresses)*virtualNodes),
+		nodes:  make(map[uint32]string, len(addresses)*virtualNodes),
+	}
+
+	distinct := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		if address == "" || distinct[address] {
+			continue
+		}
+		distinct[address] = true
+
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(address + "#" + strconv.Itoa(i))
+			if _, taken := ring.nodes[point]; !taken {
+				ring.nodes[point] = address
+				ring.points = append(ring.points, point)
+			}
+		}
+	}
+	ring.size = len(distinct)
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Returns the index of the first virtual node at or after the key's hash, wrapping around the ring
+func (r *consistentHash) search(key string) int {
+	keyHash := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= keyHash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Returns the agent owning the key, or "" while the ring is empty
+func (r *consistentHash) get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	return r.nodes[r.points[r.search(key)]]
+}
+
+// Returns up to `count` distinct agents following the key's owner on the ring, i.e. the agents that
+// would own the key next if its owner went away
+func (r *consistentHash) successors(key string, count int) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	start := r.search(key)
+	owner := r.nodes[r.points[start]]
+	seen := map[string]bool{owner: true}
+	successors := make([]string, 0, count)
+	for i := 1; i < len(r.points) && len(successors) < count && len(seen) < r.size; i++ {
+		address := r.nodes[r.points[(start+i)%len(r.points)]]
+		if !seen[address] {
+			seen[address] = true
+			successors = append(successors, address)
+		}
+	}
+
+	return successors
+}
@@ -0,0 +1,72 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Returns the owner of each of `count` routing keys
+func ringOwners(ring *consistentHash, count int) []string {
+	owners := make([]string, count)
+	for i := range owners {
+		owners[i] = ring.get(fmt.Sprintf("token-%d", i))
+	}
+	return owners
+}
+
+func TestAddingAnAgentOnlyMovesItsShareOfKeys(t *testing.T) {
+	const keys = 10000
+	addresses := []string{"10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.3:7444", "10.0.0.4:7444"}
+	before := ringOwners(newConsistentHash(addresses, ROUTING_VIRTUAL_NODES), keys)
+	after := ringOwners(newConsistentHash(append(addresses, "10.0.0.5:7444"), ROUTING_VIRTUAL_NODES), keys)
+
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != "10.0.0.5:7444" {
+				t.Fatalf("key %d moved from %s to %s, keys should only move to the new agent", i, before[i], after[i])
+			}
+		}
+	}
+
+	// The new agent's fair share is 1/5, allow for the uneven spread of the virtual nodes
+	if churn := float64(moved) / keys; churn < 0.1 || churn > 0.3 {
+		t.Errorf("%.1f%% of keys moved, want about 20%%", churn*100)
+	}
+}
+
+func TestRemovingAnAgentOnlyMovesItsKeys(t *testing.T) {
+	const keys = 10000
+	addresses := []string{"10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.3:7444", "10.0.0.4:7444"}
+	before := ringOwners(newConsistentHash(addresses, ROUTING_VIRTUAL_NODES), keys)
+	after := ringOwners(newConsistentHash(addresses[:3], ROUTING_VIRTUAL_NODES), keys)
+
+	for i := range before {
+		if before[i] != after[i] && before[i] != "10.0.0.4:7444" {
+			t.Fatalf("key %d moved from %s to %s, only the removed agent's keys should move", i, before[i], after[i])
+		}
+	}
+}
+
+func TestRingIsIndependentOfAddressOrder(t *testing.T) {
+	ring := newConsistentHash([]string{"10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.3:7444"}, ROUTING_VIRTUAL_NODES)
+	reordered := newConsistentHash([]string{"10.0.0.3:7444", "10.0.0.1:7444", "10.0.0.2:7444", "10.0.0.1:7444"}, ROUTING_VIRTUAL_NODES)
+
+	before, after := ringOwners(ring, 1000), ringOwners(reordered, 1000)
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("key %d is owned by %s and %s depending on the address order", i, before[i], after[i])
+		}
+	}
+}
+
+func TestEmptyRingHasNoOwner(t *testing.T) {
+	ring := newConsistentHash(nil, ROUTING_VIRTUAL_NODES)
+	if owner := ring.get("token"); owner != "" {
+		t.Errorf("got owner %q from an empty ring", owner)
+	}
+	if successors := ring.successors("token", 2); len(successors) != 0 {
+		t.Errorf("got successors %v from an empty ring", successors)
+	}
+}
@@ -0,0 +1,64 @@
+package vault_proxy
+
+import (
+	"log"
+	"net/http"
+)
+
+// Degradation strategies that may be listed in VAULT_FAILURE_FALLBACK_ORDER
+const (
+	DEGRADE_STALE       = "stale"       // serve an expired entry that has not yet been purged from the cache
+	DEGRADE_UNAVAILABLE = "unavailable" // give up and answer 503 (or 504 on timeout)
+)
+
+// Exits if VAULT_FAILURE_FALLBACK_ORDER contains an unknown strategy
+func validateDegradationOrder() {
+	for _, strategy := range VAULT_FAILURE_FALLBACK_ORDER {
+		if strategy != DEGRADE_STALE && strategy != DEGRADE_UNAVAILABLE {
+			log.Fatal("Unknown degradation strategy in VAULT_FAILURE_FALLBACK_ORDER: ", strategy)
+		}
+	}
+}
+
+// Returns the cached response for the request even if it has expired, marked stale
+func (c *vaultCache) getStaleResponse(request *http.Request) (*http.Response, bool) {
+	cachedResponse, keyExists := c.getFromCache(c.getEntryKey(request))
+	if !keyExists {
+		return nil, false
+	}
+
+	return cachedResponse.getStaleResponse(), true
+}
+
+// Returns the cached response for the request, marked stale, if it expired within STALE_GRACE_PERIOD.
+// Never serves an entry while a write to its key is in flight, since the write may have changed it.
+func (c *vaultCache) getGraceResponse(request *http.Request) (*http.Response, bool) {
+	if c.gracePeriod <= 0 {
+		return nil, false
+	}
+
+	cachedResponse, keyExists := c.getFromCache(c.getEntryKey(request))
+	if !keyExists || !cachedResponse.isWithinGrace(c.gracePeriod) || c.isWriteInFlight(c.getPathKey(request)) {
+		return nil, false
+	}
+
+	return cachedResponse.getStaleResponse(), true
+}
+
+// Walks VAULT_FAILURE_FALLBACK_ORDER once the routed agent, the cache and Vault have all failed a cacheable read.
+// Returns a response to serve instead, or the error if every strategy was exhausted.
+func (p *vaultProxy) degrade(request *http.Request, upstreamErr error) (*http.Response, error) {
+	for _, strategy := range VAULT_FAILURE_FALLBACK_ORDER {
+		switch strategy {
+		case DEGRADE_STALE:
+			if response, ok := p.vaultCache.getStaleResponse(request); ok {
+				log.Printf("DEGRADED: Path: %s serving stale cached response after: %v", request.URL.Path, upstreamErr)
+				return response, nil
+			}
+		case DEGRADE_UNAVAILABLE:
+			return nil, upstreamErr
+		}
+	}
+
+	return nil, upstreamErr
+}
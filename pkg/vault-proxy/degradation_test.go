@@ -0,0 +1,127 @@
+package vault_proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVaultFailureFallbackOrder(t *testing.T) {
+	defer func(order [len(VAULT_FAILURE_FALLBACK_ORDER)]string) { VAULT_FAILURE_FALLBACK_ORDER = order }(VAULT_FAILURE_FALLBACK_ORDER)
+	config := newTestConfig(t)
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	proxy := NewVaultProxy(config, cache, nil)
+
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"a"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+	entry, _ := cache.getFromCache(cache.getEntryKey(request))
+	entry.expires = time.Now().Add(-time.Second).UnixMilli()
+	upstreamErr := errors.New("vault is down")
+
+	VAULT_FAILURE_FALLBACK_ORDER = [...]string{DEGRADE_UNAVAILABLE}
+	if _, err := proxy.degrade(request, upstreamErr); err != upstreamErr {
+		t.Errorf("unavailable first got error %v, want the upstream error", err)
+	}
+
+	VAULT_FAILURE_FALLBACK_ORDER = [...]string{DEGRADE_STALE}
+	stale, err := proxy.degrade(request, upstreamErr)
+	if err != nil {
+		t.Fatalf("stale first got error %v, want the stale entry", err)
+	}
+	if body := readBody(t, stale); body != `{"data":{"value":"a"}}` || stale.Header.Get("Warning") == "" {
+		t.Errorf("stale first got body %q with Warning %q", body, stale.Header.Get("Warning"))
+	}
+}
+
+// Moves the expiry of every cached entry to `ago` in the past
+func expireEntries(cache *vaultCache, ago time.Duration) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, entry := range cache.cache {
+		entry.expires = time.Now().Add(-ago).UnixMilli()
+		entry.softExpires, entry.refreshAt = entry.expires, entry.expires
+	}
+}
+
+func TestFailedRefreshInGracePeriodServesStale(t *testing.T) {
+	var failing int32
+	chain, agent := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			writeVaultError(writer, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	cache := agent.vaultCache.(*vaultCache)
+	cache.gracePeriod = 60
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, request.Clone(request.Context()))
+		return recorder
+	}
+	if recorder := serve(); recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d caching the secret", recorder.Code)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	expireEntries(cache, time.Second)
+	recorder := serve()
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"data":{"value":"secret"}}` {
+		t.Errorf("got status %d and body %q within the grace period, want the stale secret", recorder.Code, recorder.Body.String())
+	}
+	if warning := recorder.Header().Get("Warning"); warning != `110 - "Response is Stale"` {
+		t.Errorf("got Warning %q on the stale response, want the RFC 7234 stale warning", warning)
+	}
+
+	// Past the grace period the failure is passed on
+	expireEntries(cache, time.Minute+time.Second)
+	if recorder := serve(); recorder.Code != http.StatusInternalServerError || recorder.Header().Get("Warning") != "" {
+		t.Errorf("got status %d and Warning %q past the grace period, want Vault's 500", recorder.Code, recorder.Header().Get("Warning"))
+	}
+}
+
+func TestUnreachableVaultServesStaleInGracePeriod(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	}))
+	t.Cleanup(vault.Close)
+	host, port, _ := net.SplitHostPort(vault.Listener.Addr().String())
+	t.Setenv("VAULT_SCHEME", "http")
+	t.Setenv("VAULT_ADDR", host)
+	t.Setenv("VAULT_PORT", port)
+	config := newTestConfig(t)
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	chain := NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+	cache := agent.vaultCache.(*vaultCache)
+	cache.gracePeriod = 60
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	if statuses := serveTimes(chain, request, 1); statuses[0] != http.StatusOK {
+		t.Fatalf("got status %d caching the secret", statuses[0])
+	}
+
+	// Vault goes away after the entry expired
+	vault.Close()
+	expireEntries(cache, time.Second)
+	recorder := httptest.NewRecorder()
+	chain.ServeHTTP(recorder, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"data":{"value":"secret"}}` {
+		t.Errorf("got status %d and body %q with Vault unreachable, want the stale secret", recorder.Code, recorder.Body.String())
+	}
+	if warning := recorder.Header().Get("Warning"); warning != `110 - "Response is Stale"` {
+		t.Errorf("got Warning %q on the stale response, want the RFC 7234 stale warning", warning)
+	}
+}
@@ -0,0 +1,177 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Placeholder printed instead of secret configuration values
+const REDACTED = "<redacted>"
+
+// A configurable value from the Config or config.go
+type configSetting struct {
+	name   string
+	value  interface{}
+	secret bool
+}
+
+// Returns the URL with any password replaced, e.g. for a proxy URL carrying credentials
+func redactUrlPassword(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return REDACTED
+	}
+	return parsed.Redacted()
+}
+
+// Returns every setting in effect - the loaded Config plus the remaining config.go constants - one
+// "NAME=value" per line, with secrets (Vault token, hash keys, admin token) replaced by REDACTED. Safe to log at startup.
+func (c Config) String() string {
+	settings := []configSetting{
+		{"VAULT_SCHEME", c.VaultScheme, false},
+		{"VAULT_ADDR", c.VaultAddr, false},
+		{"VAULT_PORT", c.VaultPort, false},
+		{"PROXY_ADDR", c.ProxyAddr, false},
+		{"PROXY_PORT", c.ProxyPort, false},
+		{"ADMIN_ADDR", c.AdminAddr, false},
+		{"ADMIN_PORT", c.AdminPort, false},
+		{"VAULT_CA_CERT_FILE", c.VaultCaCertFile, false},
+		{"VAULT_TLS_SKIP_VERIFY", c.VaultTlsSkipVerify, false},
+		{"VAULT_OUTBOUND_PROXY", redactUrlPassword(c.VaultOutboundProxy), false},
+		{"VAULT_CACHE_DEFAULT_EXPIRATION", c.VaultCacheDefaultExpiration, false},
+		{"VAULT_CACHE_PURGE_FREQUENCY", c.VaultCachePurgeFrequency, false},
+		{"VAULT_CACHE_MIN_TTL", c.VaultCacheMinTtl, false},
+		{"VAULT_CACHE_MAX_TTL", c.VaultCacheMaxTtl, false},
+		{"STALE_GRACE_PERIOD", STALE_GRACE_PERIOD, false},
+		{"CACHE_REPORT_INTERVAL", CACHE_REPORT_INTERVAL, false},
+		{"CACHE_REPORT_TOP_PATHS", CACHE_REPORT_TOP_PATHS, false},
+		{"CACHE_HIT_RATIO_ALERT_THRESHOLD", CACHE_HIT_RATIO_ALERT_THRESHOLD, false},
+		{"CACHE_HIT_RATIO_ALERT_WINDOW", CACHE_HIT_RATIO_ALERT_WINDOW, false},
+		{"CACHE_HIT_RATIO_ALERT_MIN_REQUESTS", CACHE_HIT_RATIO_ALERT_MIN_REQUESTS, false},
+		{"CACHE_HIT_RATIO_ALERT_WEBHOOK", c.CacheHitRatioAlertWebhook, true},
+		{"CACHE_MEMORY_LIMIT_MB", c.CacheMemoryLimitMb, false},
+		{"CACHE_MEMORY_GUARD_INTERVAL", CACHE_MEMORY_GUARD_INTERVAL, false},
+		{"CACHE_MEMORY_RESUME_FRACTION", CACHE_MEMORY_RESUME_FRACTION, false},
+		{"CACHE_MEMORY_PRESSURE_EVICT", CACHE_MEMORY_PRESSURE_EVICT, false},
+		{"CACHE_ENCRYPTION_KEY", c.CacheEncryptionKey, true},
+		{"HIT_RATIO_ALERT_WEBHOOK_TIMEOUT", HIT_RATIO_ALERT_WEBHOOK_TIMEOUT, false},
+		{"REFRESH_AHEAD_FRACTION", REFRESH_AHEAD_FRACTION, false},
+		{"REFRESH_AHEAD_JITTER", REFRESH_AHEAD_JITTER, false},
+		{"REFRESH_AHEAD_MIN_HITS", REFRESH_AHEAD_MIN_HITS, false},
+		{"CACHE_SOFT_TTL_FRACTION", CACHE_SOFT_TTL_FRACTION, false},
+		{"STALE_WHILE_REVALIDATE", STALE_WHILE_REVALIDATE, false},
+		{"TOKEN_VALIDATION_FREQUENCY", TOKEN_VALIDATION_FREQUENCY, false},
+		{"CANARY_TOKEN_HASHES", CANARY_TOKEN_HASHES, false},
+		{"CACHEABLE_SUBPATHS", CACHEABLE_SUBPATHS, false},
+		{"CACHE_SUBPATH_BASE_REQUESTS", CACHE_SUBPATH_BASE_REQUESTS, false},
+		{"NEVER_CACHEABLE_SUBPATHS", NEVER_CACHEABLE_SUBPATHS, false},
+		{"CACHE_KEY_RULES", CACHE_KEY_RULES, false},
+		{"NORMALIZE_TRAILING_SLASH", NORMALIZE_TRAILING_SLASH, false},
+		{"INCLUDE_MOUNT_ACCESSOR_IN_KEY", INCLUDE_MOUNT_ACCESSOR_IN_KEY, false},
+		{"MOUNT_TABLE_REFRESH_FREQUENCY", MOUNT_TABLE_REFRESH_FREQUENCY, false},
+		{"MAX_MOUNT_TABLE_NAMESPACES", MAX_MOUNT_TABLE_NAMESPACES, false},
+		{"CACHE_KEY_BY_ENTITY", CACHE_KEY_BY_ENTITY, false},
+		{"ENTITY_LOOKUP_TTL", ENTITY_LOOKUP_TTL, false},
+		{"METHODS_TO_IGNORE", METHODS_TO_IGNORE, false},
+		{"SHADOW_VAULT_ADDR", c.ShadowVaultAddr, false},
+		{"SHADOW_VAULT_PORT", c.ShadowVaultPort, false},
+		{"SHADOW_SAMPLE_PERCENT", c.ShadowSamplePercent, false},
+		{"SHADOW_REQUEST_TIMEOUT", c.ShadowRequestTimeout, false},
+		{"CACHE_HEAD_REQUESTS", CACHE_HEAD_REQUESTS, false},
+		{"PROPAGATE_VAULT_WARNINGS", PROPAGATE_VAULT_WARNINGS, false},
+		{"CACHEABLE_ERROR_STATUS_TTLS", CACHEABLE_ERROR_STATUS_TTLS, false},
+		{"NEGATIVE_CACHE_TTL", NEGATIVE_CACHE_TTL, false},
+		{"SKIP_CACHING_EMPTY_DATA", SKIP_CACHING_EMPTY_DATA, false},
+		{"SKIP_CACHING_EMPTY_BODY", SKIP_CACHING_EMPTY_BODY, false},
+		{"RESPECT_UPSTREAM_CACHE_CONTROL", RESPECT_UPSTREAM_CACHE_CONTROL, false},
+		{"RATE_LIMITER_DEFAULT_EXPIRATION", c.RateLimiterDefaultExpiration, false},
+		{"RATE_LIMITER_PURGE_FREQUENCY", c.RateLimiterPurgeFrequency, false},
+		{"RATE_LIMITER_MAX_LIFETIME", c.RateLimiterMaxLifetime, false},
+		{"RATELIMITING_HASHING_KEY_PREFIX", RATELIMITING_HASHING_KEY_PREFIX, true},
+		{"RATELIMITING_HASHING_KEY_SUFFIX", RATELIMITING_HASHING_KEY_SUFFIX, true},
+		{"BURST_LIMIT_PER_SECOND", c.BurstLimitPerSecond, false},
+		{"RATE_LIMIT_PER_MINUTE", c.RateLimitPerMinute, false},
+		{"RATE_LIMITER_BUCKET_SIZE", c.RateLimiterBucketSize, false},
+		{"BURST_OVERRIDE_MAX", BURST_OVERRIDE_MAX, false},
+		{"BURST_OVERRIDE_DURATION", BURST_OVERRIDE_DURATION, false},
+		{"BURST_OVERRIDE_TRUSTED_CIDRS", BURST_OVERRIDE_TRUSTED_CIDRS, false},
+		{"RATE_LIMIT_BY_NAMESPACE", RATE_LIMIT_BY_NAMESPACE, false},
+		{"NAMESPACE_RATE_LIMITS", NAMESPACE_RATE_LIMITS, false},
+		{"RATE_LIMIT_RETRY_AFTER_MAX", RATE_LIMIT_RETRY_AFTER_MAX, false},
+		{"MAX_CONNECTIONS_PER_CLIENT_IP", MAX_CONNECTIONS_PER_CLIENT_IP, false},
+		{"TRUSTED_PROXY_CIDRS", TRUSTED_PROXY_CIDRS, false},
+		{"AGENT_PEER_CIDRS", AGENT_PEER_CIDRS, false},
+		{"ROUTE_OVERRIDE_TRUSTED_CIDRS", ROUTE_OVERRIDE_TRUSTED_CIDRS, false},
+		{"PROXY_TLS_CERT_FILE", PROXY_TLS_CERT_FILE, false},
+		{"PROXY_TLS_KEY_FILE", PROXY_TLS_KEY_FILE, false},
+		{"PROXY_CLIENT_CA_FILE", PROXY_CLIENT_CA_FILE, false},
+		{"TRUSTED_AGENT_IDENTITIES", TRUSTED_AGENT_IDENTITIES, false},
+		{"RATE_LIMIT_BY_CLIENT_IDENTITY", RATE_LIMIT_BY_CLIENT_IDENTITY, false},
+		{"CACHE_SIZE", c.CacheSize, false},
+		{"MAX_CACHE_BYTES", c.MaxCacheBytes, false},
+		{"CACHE_ENTRIES_PER_TOKEN", CACHE_ENTRIES_PER_TOKEN, false},
+		{"CACHE_ENTRIES_PER_NAMESPACE", CACHE_ENTRIES_PER_NAMESPACE, false},
+		{"MAX_CONCURRENT_BODY_BUFFERING", MAX_CONCURRENT_BODY_BUFFERING, false},
+		{"MAX_CACHEABLE_BODY_BYTES", MAX_CACHEABLE_BODY_BYTES, false},
+		{"MAX_REQUEST_BODY_BYTES", MAX_REQUEST_BODY_BYTES, false},
+		{"RATE_LIMITER_CACHE_SIZE", c.RateLimiterCacheSize, false},
+		{"CACHE_BACKEND", c.CacheBackend, false},
+		{"RATE_LIMITER_BACKEND", c.RateLimiterBackend, false},
+		{"RATE_LIMITER_BACKEND_BY_PATH", RATE_LIMITER_BACKEND_BY_PATH, false},
+		{"REDIS_ADDR", c.RedisAddr, false},
+		{"REDIS_PASSWORD", c.RedisPassword, true},
+		{"REDIS_DB", c.RedisDb, false},
+		{"REDIS_TIMEOUT_MS", REDIS_TIMEOUT_MS, false},
+		{"REDIS_RETRY_INTERVAL", REDIS_RETRY_INTERVAL, false},
+		{"REDIS_KEY_PREFIX", REDIS_KEY_PREFIX, false},
+		{"REDIS_CACHE_MIN_REPLICAS", REDIS_CACHE_MIN_REPLICAS, false},
+		{"REDIS_CACHE_REPLICA_TIMEOUT_MS", REDIS_CACHE_REPLICA_TIMEOUT_MS, false},
+		{"CLOCK_SKEW_TOLERANCE_MS", CLOCK_SKEW_TOLERANCE_MS, false},
+		{"REDIS_HOT_KEY_TTL_MS", REDIS_HOT_KEY_TTL_MS, false},
+		{"REDIS_HOT_KEY_CACHE_SIZE", REDIS_HOT_KEY_CACHE_SIZE, false},
+		{"VAULT_CONFIG_CHECK_FREQUENCY", c.VaultConfigCheckFrequency, false},
+		{"VAULT_CONFIG_TIMEOUT", c.VaultConfigTimeout, false},
+		{"VAULT_CONFIG_SCHEME", c.VaultConfigScheme, false},
+		{"VAULT_CONFIG_ADDR", c.VaultConfigAddr, false},
+		{"VAULT_CONFIG_PORT", c.VaultConfigPort, false},
+		{"VAULT_TOKEN", c.VaultToken, true},
+		{"ADMIN_TOKEN", c.AdminToken, true},
+		{"TOKEN_HEADER_PRECEDENCE", TOKEN_HEADER_PRECEDENCE, false},
+		{"DUPLICATE_NAMESPACE_HEADER_POLICY", DUPLICATE_NAMESPACE_HEADER_POLICY, false},
+		{"ROUTING_KEY_HEADER", ROUTING_KEY_HEADER, false},
+		{"PROXY_REQUEST_TIMEOUT", c.ProxyRequestTimeout, false},
+		{"SHUTDOWN_DRAIN_TIMEOUT", c.ShutdownDrainTimeout, false},
+		{"UNAVAILABLE_RETRY_AFTER", UNAVAILABLE_RETRY_AFTER, false},
+		{"UPSTREAM_CLOSED_STATUS", UPSTREAM_CLOSED_STATUS, false},
+		{"VAULT_FAILURE_FALLBACK_ORDER", VAULT_FAILURE_FALLBACK_ORDER, false},
+		{"LOAD_SHED_P95_THRESHOLD_MS", LOAD_SHED_P95_THRESHOLD_MS, false},
+		{"LOAD_SHED_WINDOW", LOAD_SHED_WINDOW, false},
+		{"LOAD_SHED_MAX_SAMPLES", LOAD_SHED_MAX_SAMPLES, false},
+		{"TOKEN_ERROR_THRESHOLD", TOKEN_ERROR_THRESHOLD, false},
+		{"TOKEN_ERROR_WINDOW", TOKEN_ERROR_WINDOW, false},
+		{"TOKEN_ERROR_COOLDOWN", TOKEN_ERROR_COOLDOWN, false},
+		{"READINESS_CONFIG_MAX_AGE", READINESS_CONFIG_MAX_AGE, false},
+		{"READINESS_REQUIRED_BACKENDS", READINESS_REQUIRED_BACKENDS, false},
+		{"AGENT_VAULT_PORT_DIFF", c.AgentVaultPortDiff, false},
+		{"VAULT_PROXY_DEV", c.DevMode, false},
+		{"AGENT_REQUEST_TIMEOUT", c.AgentRequestTimeout, false},
+		{"AGENT_MAX_FORWARD_HOPS", AGENT_MAX_FORWARD_HOPS, false},
+		{"ROUTING_VIRTUAL_NODES", ROUTING_VIRTUAL_NODES, false},
+		{"CACHE_REPLICATION_NEIGHBORS", CACHE_REPLICATION_NEIGHBORS, false},
+		{"METRIC_NAMESPACE_ALLOWLIST", METRIC_NAMESPACE_ALLOWLIST, false},
+		{"ENABLE_PPROF", ENABLE_PPROF, false},
+		{"INJECT_PROXY_METADATA", INJECT_PROXY_METADATA, false},
+	}
+
+	lines := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		value := fmt.Sprint(setting.value)
+		if setting.secret {
+			value = REDACTED
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", setting.name, value))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,181 @@
+package vault_proxy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Identity of a single token
+type tokenIdentity struct {
+	identity  string // "entity:<entity_id>:<policies hash>", "" if the token has no entity or the lookup failed
+	expiresAt int64  // Millis since epoch; ENTITY_LOOKUP_TTL after the lookup, or the token's own expiry if sooner
+}
+
+// Cached token -> identity lookups, used to key the cache on the identity behind a token instead of the token
+// itself so all tokens of an identity share entries
+type entityTable struct {
+	config  Config
+	lock    sync.RWMutex
+	tokens  map[string]*tokenIdentity // Hashed token -> identity
+	lookups singleflight.Group        // Collapses concurrent lookups of a token into one
+}
+
+// Response of GET /v1/auth/token/lookup-self
+type vaultTokenLookupResponse struct {
+	Data struct {
+		EntityId         string   `json:"entity_id"`
+		Ttl              int64    `json:"ttl"` // Seconds left, 0 for tokens that never expire
+		Policies         []string `json:"policies"`
+		IdentityPolicies []string `json:"identity_policies"`
+	} `json:"data"`
+}
+
+// Should ALWAYS be used as the "constructor" for the entityTable.
+func newEntityTable(config Config) *entityTable {
+	return &entityTable{
+		config: config,
+		tokens: make(map[string]*tokenIdentity),
+	}
+}
+
+// Looks the token up against Vault and returns its identity, how long it may be used, and Vault's status code.
+// Tokens of one entity can carry different policies, so the policies are part of the identity - a token never
+// shares entries with a more privileged one.
+func (e *entityTable) fetchIdentity(token string, namespace string) (*tokenIdentity, int, error) {
+	addr := fmt.Sprintf("%s://%s:%d/v1/auth/token/lookup-self", e.config.VaultScheme, e.config.VaultAddr, e.config.VaultPort)
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add(VAULT_TOKEN_HEADER, token)
+	if namespace != "" {
+		req.Header.Add(VAULT_NAMESPACE_HEADER, namespace)
+	}
+	if err = signUpstreamRequest(req); err != nil {
+		return nil, 0, err
+	}
+
+	client := newVaultClient(e.config, time.Duration(e.config.AgentRequestTimeout)*time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+
+	var responseObject vaultTokenLookupResponse
+	if err = json.Unmarshal(bodyBytes, &responseObject); err != nil {
+		return nil, resp.StatusCode, err
+	}
+
+	// Never map the token past its own expiry, after which it must not be served the identity's entries
+	ttl := int64(ENTITY_LOOKUP_TTL)
+	if responseObject.Data.Ttl > 0 && responseObject.Data.Ttl < ttl {
+		ttl = responseObject.Data.Ttl
+	}
+	identity := &tokenIdentity{expiresAt: time.Now().UnixMilli() + ttl*1000}
+
+	// Root and other entity-less tokens keep their own entries
+	if responseObject.Data.EntityId == "" {
+		return identity, resp.StatusCode, nil
+	}
+
+	policies := append(responseObject.Data.Policies, responseObject.Data.IdentityPolicies...)
+	sort.Strings(policies)
+	hasher := md5.New()
+	hasher.Write([]byte(strings.Join(policies, ",")))
+
+	identity.identity = fmt.Sprintf("entity:%s:%s", responseObject.Data.EntityId, hex.EncodeToString(hasher.Sum(nil)))
+	return identity, resp.StatusCode, nil
+}
+
+// Drops expired lookups, and a quarter of the rest if the table is still full. Caller must hold the lock.
+func (e *entityTable) purgeIdentities(now int64) {
+	if len(e.tokens) < e.config.CacheSize {
+		return
+	}
+
+	for tokenKey, identity := range e.tokens {
+		if now > identity.expiresAt {
+			delete(e.tokens, tokenKey)
+		}
+	}
+
+	if len(e.tokens) < e.config.CacheSize {
+		return
+	}
+	toRemove := len(e.tokens) / 4
+	for tokenKey := range e.tokens {
+		if toRemove <= 0 {
+			break
+		}
+		delete(e.tokens, tokenKey)
+		toRemove--
+	}
+}
+
+// Returns the known identity of the token without asking Vault, "" for tokens without an entity and tokens
+// not looked up yet (or whose lookup expired), so they fall back to per-token keys
+func (e *entityTable) getIdentity(tokenKey string) string {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if identity, exists := e.tokens[tokenKey]; exists && time.Now().UnixMilli() <= identity.expiresAt {
+		return identity.identity
+	}
+	return ""
+}
+
+// Looks the token up in the background unless its identity is already known. A token Vault rejects (403)
+// has its mapping dropped; other failures are remembered for ENTITY_LOOKUP_TTL so Vault isn't asked again
+// on every request.
+func (e *entityTable) lookupIdentity(tokenKey string, token string, namespace string) {
+	e.lock.RLock()
+	identity, exists := e.tokens[tokenKey]
+	e.lock.RUnlock()
+	if exists && time.Now().UnixMilli() <= identity.expiresAt {
+		return
+	}
+
+	e.lookups.DoChan(tokenKey, func() (interface{}, error) {
+		fetched, status, err := e.fetchIdentity(token, namespace)
+		now := time.Now().UnixMilli()
+
+		e.lock.Lock()
+		defer e.lock.Unlock()
+
+		if status == http.StatusForbidden {
+			log.Printf("Vault rejected token %s, dropping its identity", tokenKey)
+			delete(e.tokens, tokenKey)
+			return nil, err
+		}
+		if err != nil {
+			log.Printf("Could not look up the identity of token %s, keying on the token: %v", tokenKey, err)
+			fetched = &tokenIdentity{expiresAt: now + ENTITY_LOOKUP_TTL*1000}
+		}
+
+		e.purgeIdentities(now)
+		e.tokens[tokenKey] = fetched
+		return nil, nil
+	})
+}
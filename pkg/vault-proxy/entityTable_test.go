@@ -0,0 +1,121 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves auth/token/lookup-self, answering every token with `status` and, on 200, entity e1 with a `ttl` left
+func newLookupVault(t *testing.T, status *int32, ttl int) (Config, *int32) {
+	var lookups int32
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if code := int(atomic.LoadInt32(status)); code != http.StatusOK {
+			writer.WriteHeader(code)
+			return
+		}
+		fmt.Fprintf(writer, `{"data":{"entity_id":"e1","policies":["default","reader"],"ttl":%d}}`, ttl)
+	})
+	return config, &lookups
+}
+
+// Returns a parseHeader keying on entities, and a handler running a request through it and the entity lookup
+func newEntityKeyedParseHeader(config Config) (*parseHeader, http.Handler) {
+	parseHeader := NewParseHeader(config)
+	parseHeader.entities = newEntityTable(config)
+	lookup := parseHeader.ParseHeaderHandler(parseHeader.EntityLookupHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	return parseHeader, lookup
+}
+
+// Waits for the background lookup of the token to be stored
+func waitForIdentity(t *testing.T, parseHeader *parseHeader, token string) {
+	tokenKey := parseHeader.getMD5HashedLimiterKey(token)
+	deadline := time.Now().Add(2 * time.Second)
+	for parseHeader.entities.getIdentity(tokenKey) == "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if parseHeader.entities.getIdentity(tokenKey) == "" {
+		t.Fatalf("identity of %s was never looked up", token)
+	}
+}
+
+func TestTokensOfOneEntityShareAnEntry(t *testing.T) {
+	status := int32(http.StatusOK)
+	config, _ := newLookupVault(t, &status, 3600)
+	parseHeader, lookup := newEntityKeyedParseHeader(config)
+	cacheKey := func(token string) string {
+		return parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token)).GetVaultCacheKey()
+	}
+
+	for _, token := range []string{"token-a", "token-b"} {
+		lookup.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token))
+		waitForIdentity(t, parseHeader, token)
+	}
+
+	if cacheKey("token-a") != cacheKey("token-b") {
+		t.Error("tokens of the same entity don't share a cache entry")
+	}
+	if cacheKey("token-a") == cacheKey("token-c") {
+		t.Error("a token not looked up shares the entity's cache entry")
+	}
+}
+
+func TestEntityLookupIsNotPartOfParsing(t *testing.T) {
+	status := int32(http.StatusOK)
+	config, lookups := newLookupVault(t, &status, 3600)
+	parseHeader, _ := newEntityKeyedParseHeader(config)
+
+	parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+	if got := atomic.LoadInt32(lookups); got != 0 {
+		t.Errorf("parsing the request looked the token up %d times, want 0", got)
+	}
+}
+
+func TestEntityMappingIsCappedAtTheTokenTtl(t *testing.T) {
+	status := int32(http.StatusOK)
+	config, _ := newLookupVault(t, &status, 2)
+	parseHeader, lookup := newEntityKeyedParseHeader(config)
+
+	lookup.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+	waitForIdentity(t, parseHeader, "token-a")
+
+	parseHeader.entities.lock.RLock()
+	defer parseHeader.entities.lock.RUnlock()
+	identity := parseHeader.entities.tokens[parseHeader.getMD5HashedLimiterKey("token-a")]
+	if identity == nil || identity.expiresAt > time.Now().UnixMilli()+2000 {
+		t.Errorf("mapping of a token expiring in 2s outlives it: %+v", identity)
+	}
+}
+
+func TestRejectedTokenDropsItsEntity(t *testing.T) {
+	status := int32(http.StatusOK)
+	config, _ := newLookupVault(t, &status, 3600)
+	parseHeader, lookup := newEntityKeyedParseHeader(config)
+	tokenKey := parseHeader.getMD5HashedLimiterKey("token-a")
+
+	lookup.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+	waitForIdentity(t, parseHeader, "token-a")
+
+	// The mapping expires and the token has since been revoked
+	parseHeader.entities.lock.Lock()
+	parseHeader.entities.tokens[tokenKey].expiresAt = 0
+	parseHeader.entities.lock.Unlock()
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	lookup.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		parseHeader.entities.lock.RLock()
+		_, exists := parseHeader.entities.tokens[tokenKey]
+		parseHeader.entities.lock.RUnlock()
+		if !exists {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("mapping of a token Vault rejected was kept")
+}
@@ -0,0 +1,89 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Liveness probe - answers 200 for as long as the HTTP server is up
+func HealthzHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("ok\n"))
+}
+
+// Backend pinged by the readiness probe, e.g. the Redis of the shared cache
+type readinessBackend struct {
+	name string
+	ping func() error
+}
+
+// Adds a backend to the readiness probe. Only backends listed in READINESS_REQUIRED_BACKENDS fail it when
+// their ping fails; the others are logged. Must be called before the proxy starts serving.
+func (a *vaultAgent) AddReadinessBackend(name string, ping func() error) {
+	a.readinessBackends = append(a.readinessBackends, readinessBackend{name: name, ping: ping})
+}
+
+// Returns `true` once Vault has returned a non-empty routing table within the last
+// READINESS_CONFIG_MAX_AGE config checks. With a VAULT_CONFIG_CHECK_FREQUENCY of 0 or less the config is only
+// fetched at startup, so the table is never required to be fresh.
+func (a *vaultAgent) isReady() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.lastConfigSuccess <= 0 || len(a.vaultConfigResponse.Data.Config.Servers) == 0 {
+		return false
+	}
+	if a.config.VaultConfigCheckFrequency <= 0 {
+		return true
+	}
+	maxAge := int64(READINESS_CONFIG_MAX_AGE*a.config.VaultConfigCheckFrequency) * 1000
+	return time.Now().UnixMilli()-a.lastConfigSuccess <= maxAge
+}
+
+// Returns the name of the first required backend whose ping fails, "" if they are all up
+func (a *vaultAgent) getUnavailableBackend() string {
+	for _, backend := range a.readinessBackends {
+		err := backend.ping()
+		if err == nil {
+			continue
+		}
+		if !a.isRequiredBackend(backend.name) {
+			log.Printf("Readiness check: optional backend %s is unavailable: %v", backend.name, err)
+			continue
+		}
+		log.Printf("Readiness check failed: required backend %s is unavailable: %v", backend.name, err)
+		return backend.name
+	}
+	return ""
+}
+
+// Returns `true` if the backend is in READINESS_REQUIRED_BACKENDS
+func (a *vaultAgent) isRequiredBackend(name string) bool {
+	for _, required := range a.requiredBackends {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Readiness probe - answers 200 once the routing table is populated and fresh and the required backends are up,
+// 503 otherwise
+func (a *vaultAgent) ReadyzHandler(writer http.ResponseWriter, request *http.Request) {
+	if !a.isReady() {
+		log.Printf("Readiness check failed: no recent routing table from Vault")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte("routing table not ready\n"))
+		return
+	}
+	if backend := a.getUnavailableBackend(); backend != "" {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(writer, "%s backend unavailable\n", backend)
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("ok\n"))
+}
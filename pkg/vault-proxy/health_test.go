@@ -0,0 +1,60 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns an agent with a fresh routing table and a Redis-backed cache whose Redis is down
+func newAgentWithRedisDown(t *testing.T) *vaultAgent {
+	agent := newTestAgent(t, "10.0.0.1:7444", "10.0.0.1:7444")
+	agent.lastConfigSuccess = time.Now().UnixMilli()
+
+	config := agent.config
+	config.CacheBackend = "redis"
+	newTestRedis(t, &config).Close()
+	agent.vaultCache = NewVaultCache(config)
+	agent.AddReadinessBackend("cache", agent.vaultCache.PingBackend)
+	return agent
+}
+
+func readyzStatus(agent *vaultAgent) int {
+	recorder := httptest.NewRecorder()
+	agent.ReadyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return recorder.Code
+}
+
+func TestReadyzFailsWhileRequiredRedisIsDown(t *testing.T) {
+	agent := newAgentWithRedisDown(t)
+	agent.requiredBackends = []string{"cache"}
+
+	if status := readyzStatus(agent); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d with the required cache Redis down, want 503", status)
+	}
+}
+
+func TestReadyzIgnoresOptionalRedis(t *testing.T) {
+	agent := newAgentWithRedisDown(t)
+
+	if status := readyzStatus(agent); status != http.StatusOK {
+		t.Errorf("got %d with an optional cache Redis down, want 200", status)
+	}
+}
+
+func TestReadyzWithoutPeriodicConfigRefresh(t *testing.T) {
+	agent := newTestAgent(t, "10.0.0.1:7444", "10.0.0.1:7444")
+	agent.lastConfigSuccess = time.Now().Add(-time.Hour).UnixMilli()
+
+	// The config is fetched once at startup and never again, so its age doesn't matter
+	agent.config.VaultConfigCheckFrequency = 0
+	if status := readyzStatus(agent); status != http.StatusOK {
+		t.Errorf("got %d with the config refresh disabled, want 200", status)
+	}
+
+	agent.config.VaultConfigCheckFrequency = 30
+	if status := readyzStatus(agent); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d with the last config success an hour ago, want 503", status)
+	}
+}
@@ -0,0 +1,200 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMain(m *testing.M) {
+	// Every request logs several lines, which would bury the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Log output safe to write from the goroutines of the code under test
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+// Captures the log output until the end of the test
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return logs
+}
+
+// Waits up to a second for the condition, returning whether it became `true`
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// Returns the config.go defaults, as loaded for an agent with a Vault token
+func newTestConfig(t *testing.T) Config {
+	t.Setenv("VAULT_TOKEN", "agent-token")
+	return LoadConfigFromEnv()
+}
+
+// Starts a fake Vault serving `handler` and returns the config of an agent in front of it
+func newTestVault(t *testing.T, handler http.HandlerFunc) Config {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	t.Setenv("VAULT_SCHEME", "http")
+	t.Setenv("VAULT_ADDR", host)
+	t.Setenv("VAULT_PORT", port)
+	return newTestConfig(t)
+}
+
+// Returns a request as received from the peer at `remoteAddr` with the Vault token
+func newTestRequest(method string, target string, remoteAddr string, token string) *http.Request {
+	request := httptest.NewRequest(method, target, nil)
+	request.RemoteAddr = remoteAddr
+	if token != "" {
+		request.Header.Set(VAULT_TOKEN_HEADER, token)
+	}
+	return request
+}
+
+// Returns the status codes of serving the request `count` times, each time on a fresh copy
+func serveTimes(handler http.Handler, request *http.Request, count int) []int {
+	statuses := make([]int, count)
+	for i := range statuses {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request.Clone(request.Context()))
+		statuses[i] = recorder.Code
+	}
+	return statuses
+}
+
+// Returns how often the status occurs in the statuses
+func countStatus(statuses []int, status int) int {
+	count := 0
+	for _, s := range statuses {
+		if s == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the values ParseHeaderHandler parses from the request
+func parseRequest(parseHeader *parseHeader, request *http.Request) *parsedHeaders {
+	var parsed *parsedHeaders
+	parseHeader.ParseHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		parsed = request.Context().Value(parsedHeaderContextKey).(*parsedHeaders)
+	})).ServeHTTP(httptest.NewRecorder(), request)
+	return parsed
+}
+
+// Returns an agent at `myAddress` routing over `addresses`, without the background routing table refresh
+func newTestAgent(t *testing.T, myAddress string, addresses ...string) *vaultAgent {
+	config := newTestConfig(t)
+	agentScheme, agentClient := newAgentClient(config)
+	servers := make([]Server, len(addresses))
+	routingTable := make(map[int]string, len(addresses))
+	for i, address := range addresses {
+		servers[i] = Server{Address: address, NodeId: fmt.Sprintf("node%d", i+1)}
+		routingTable[i] = address
+	}
+
+	agent := &vaultAgent{
+		config:            config,
+		agentScheme:       agentScheme,
+		agentClient:       agentClient,
+		agentRoutingTable: routingTable,
+		routingAddresses:  addresses,
+		routingRing:       newConsistentHash(addresses, ROUTING_VIRTUAL_NODES),
+		myAddress:         myAddress,
+		vaultCache:        NewVaultCache(config),
+	}
+	agent.vaultConfigResponse.Data.Config.Servers = servers
+	return agent
+}
+
+// Returns the request as ParseHeaderHandler passes it on, with its parsed values in the context
+func parsedRequest(parseHeader *parseHeader, request *http.Request) *http.Request {
+	var parsed *http.Request
+	parseHeader.ParseHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		parsed = request
+	})).ServeHTTP(httptest.NewRecorder(), request)
+	return parsed
+}
+
+// Returns a Vault response with the JSON body
+func newVaultResponse(request *http.Request, status int, body string, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// Returns the response body, failing the test if it can't be read
+func readBody(t *testing.T, response *http.Response) string {
+	t.Helper()
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("reading the response body: %v", err)
+	}
+	return string(body)
+}
+
+// Starts an in-memory Redis and points the config's Redis settings at it
+func newTestRedis(t *testing.T, config *Config) *miniredis.Miniredis {
+	server := miniredis.RunT(t)
+	config.RedisAddr = server.Addr()
+	return server
+}
+
+// Returns the handler chain of a single agent in front of a fake Vault serving `vault`, and the agent.
+// Rate limits are high enough to never deny a test's requests.
+func newTestProxyChain(t *testing.T, vault http.HandlerFunc) (http.Handler, *vaultAgent) {
+	config := newTestVault(t, vault)
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	return NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy))), agent
+}
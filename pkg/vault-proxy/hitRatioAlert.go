@@ -0,0 +1,121 @@
+package vault_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cache lookups of one second
+type hitRatioBucket struct {
+	second int64 // Seconds since epoch the bucket counts
+	hits   int64
+	misses int64
+}
+
+// Alerts once when the cache hit ratio over a rolling window drops below a threshold, which often means a
+// cache-key bug or a secret-rotation storm. It re-arms once the ratio is back at or above the threshold.
+type hitRatioMonitor struct {
+	lock        sync.Mutex
+	buckets     []hitRatioBucket // One per second of the window, indexed by second % len(buckets)
+	threshold   float64
+	minRequests int64
+	webhook     string
+	breached    bool
+	client      *http.Client
+}
+
+// Alert posted to the webhook
+type hitRatioAlert struct {
+	Event         string  `json:"event"` // "cache_hit_ratio_low" or "cache_hit_ratio_recovered"
+	HitRatio      float64 `json:"hit_ratio"`
+	Threshold     float64 `json:"threshold"`
+	Requests      int64   `json:"requests"`
+	WindowSeconds int     `json:"window_seconds"`
+}
+
+// Should ALWAYS be used as the "constructor" for the hitRatioMonitor. A zero threshold disables it.
+func newHitRatioMonitor(threshold float64, windowSeconds int, minRequests int, webhook string) *hitRatioMonitor {
+	if windowSeconds <= 0 {
+		windowSeconds = 1
+	}
+	return &hitRatioMonitor{
+		buckets:     make([]hitRatioBucket, windowSeconds),
+		threshold:   threshold,
+		minRequests: int64(minRequests),
+		webhook:     webhook,
+		client:      &http.Client{Timeout: HIT_RATIO_ALERT_WEBHOOK_TIMEOUT * time.Second},
+	}
+}
+
+// Records a cache lookup and alerts if it takes the hit ratio of the window across the threshold
+func (m *hitRatioMonitor) record(hit bool) {
+	if m.threshold <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now().Unix()
+	bucket := &m.buckets[now%int64(len(m.buckets))]
+	if bucket.second != now {
+		*bucket = hitRatioBucket{second: now}
+	}
+	if hit {
+		bucket.hits++
+	} else {
+		bucket.misses++
+	}
+
+	var hits, requests int64
+	for _, b := range m.buckets {
+		if now-b.second < int64(len(m.buckets)) {
+			hits += b.hits
+			requests += b.hits + b.misses
+		}
+	}
+	if requests < m.minRequests {
+		return
+	}
+
+	hitRatio := float64(hits) / float64(requests)
+	if !m.breached && hitRatio < m.threshold {
+		m.breached = true
+		cacheHitRatioAlertsTotal.Inc()
+		log.Printf("CACHE HIT RATIO ALERT: hit ratio %.3f over the last %ds (%d requests) is below %.3f", hitRatio, len(m.buckets), requests, m.threshold)
+		m.notify(hitRatioAlert{"cache_hit_ratio_low", hitRatio, m.threshold, requests, len(m.buckets)})
+	} else if m.breached && hitRatio >= m.threshold {
+		m.breached = false
+		log.Printf("CACHE HIT RATIO RECOVERED: hit ratio %.3f over the last %ds (%d requests) is back above %.3f", hitRatio, len(m.buckets), requests, m.threshold)
+		m.notify(hitRatioAlert{"cache_hit_ratio_recovered", hitRatio, m.threshold, requests, len(m.buckets)})
+	}
+}
+
+// Posts the alert to the webhook, if one is configured, without blocking the request being served
+func (m *hitRatioMonitor) notify(alert hitRatioAlert) {
+	if m.webhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Print("HitRatioAlertError: ", err)
+		return
+	}
+
+	go func() {
+		response, err := m.client.Post(m.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Print("HitRatioAlertWebhookError: ", err)
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			log.Printf("HitRatioAlertWebhookError: webhook answered %d", response.StatusCode)
+		}
+	}()
+}
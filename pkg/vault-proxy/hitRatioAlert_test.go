@@ -0,0 +1,81 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Records `count` lookups that all hit or all miss
+func recordLookups(monitor *hitRatioMonitor, hit bool, count int) {
+	for i := 0; i < count; i++ {
+		monitor.record(hit)
+	}
+}
+
+// Returns the next alert posted to the webhook, failing the test if none arrives
+func nextAlert(t *testing.T, alerts chan hitRatioAlert) hitRatioAlert {
+	t.Helper()
+	select {
+	case alert := <-alerts:
+		return alert
+	case <-time.After(time.Second):
+		t.Fatal("no alert was posted to the webhook")
+		return hitRatioAlert{}
+	}
+}
+
+func TestHitRatioAlertFiresOncePerBreach(t *testing.T) {
+	alerts := make(chan hitRatioAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var alert hitRatioAlert
+		json.NewDecoder(request.Body).Decode(&alert)
+		alerts <- alert
+	}))
+	t.Cleanup(webhook.Close)
+
+	monitor := newHitRatioMonitor(0.5, 60, 10, webhook.URL)
+	alertsBefore := testutil.ToFloat64(cacheHitRatioAlertsTotal)
+
+	// Too few lookups to judge the ratio of a quiet agent
+	recordLookups(newHitRatioMonitor(0.5, 60, 10, ""), false, 9)
+	recordLookups(monitor, true, 20)
+	if fired := testutil.ToFloat64(cacheHitRatioAlertsTotal) - alertsBefore; fired != 0 {
+		t.Fatalf("alert fired %v times above the threshold or below the minimum lookups", fired)
+	}
+
+	// Drive the ratio below the threshold and keep it there
+	recordLookups(monitor, false, 40)
+	if fired := testutil.ToFloat64(cacheHitRatioAlertsTotal) - alertsBefore; fired != 1 {
+		t.Fatalf("alert fired %v times for one breach, want once", fired)
+	}
+	if alert := nextAlert(t, alerts); alert.Event != "cache_hit_ratio_low" || alert.HitRatio >= 0.5 || alert.Threshold != 0.5 {
+		t.Errorf("got alert %+v, want cache_hit_ratio_low below 0.5", alert)
+	}
+
+	// Recovering re-arms the alert, so the next breach fires again
+	recordLookups(monitor, true, 60)
+	if alert := nextAlert(t, alerts); alert.Event != "cache_hit_ratio_recovered" {
+		t.Errorf("got alert %+v, want cache_hit_ratio_recovered", alert)
+	}
+	recordLookups(monitor, false, 100)
+	if fired := testutil.ToFloat64(cacheHitRatioAlertsTotal) - alertsBefore; fired != 2 {
+		t.Errorf("alert fired %v times for two breaches, want twice", fired)
+	}
+	if alert := nextAlert(t, alerts); alert.Event != "cache_hit_ratio_low" {
+		t.Errorf("got alert %+v, want cache_hit_ratio_low", alert)
+	}
+}
+
+func TestHitRatioAlertDisabledByDefault(t *testing.T) {
+	monitor := newHitRatioMonitor(CACHE_HIT_RATIO_ALERT_THRESHOLD, CACHE_HIT_RATIO_ALERT_WINDOW, CACHE_HIT_RATIO_ALERT_MIN_REQUESTS, "")
+	alertsBefore := testutil.ToFloat64(cacheHitRatioAlertsTotal)
+	recordLookups(monitor, false, 1000)
+	if fired := testutil.ToFloat64(cacheHitRatioAlertsTotal) - alertsBefore; fired != 0 {
+		t.Errorf("disabled alert fired %v times", fired)
+	}
+}
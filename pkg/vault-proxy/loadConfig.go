@@ -0,0 +1,217 @@
+package vault_proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Deployment settings. Each field is read from the environment variable of the same name as its
+// default constant in config.go, falling back to that constant when unset.
+type Config struct {
+	VaultToken         string // Token for the agent's own Vault calls; from VAULT_TOKEN or VAULT_TOKEN_FILE, never a constant
+	AdminToken         string // Required by admin routes; from ADMIN_TOKEN or ADMIN_TOKEN_FILE, admin routes answer 403 without it
+	VaultScheme        string
+	VaultAddr          string
+	VaultPort          int
+	VaultCaCertFile    string
+	VaultTlsSkipVerify bool
+	VaultOutboundProxy string
+	ProxyAddr          string
+	ProxyPort          int
+	AdminAddr          string
+	AdminPort          int
+
+	VaultCacheDefaultExpiration int // Seconds
+	VaultCachePurgeFrequency    int // Seconds
+	VaultCacheMinTtl            int // Seconds
+	VaultCacheMaxTtl            int // Seconds
+	CacheSize                   int
+	MaxCacheBytes               int
+	CacheHitRatioAlertWebhook   string
+	CacheBackend                string // "memory" or "redis"
+	CacheMemoryLimitMb          int
+	CacheEncryptionKey          string
+
+	RateLimiterDefaultExpiration int // Seconds
+	RateLimiterPurgeFrequency    int // Seconds
+	RateLimiterMaxLifetime       int // Seconds
+	BurstLimitPerSecond          int
+	RateLimitPerMinute           int
+	RateLimiterBucketSize        int
+	RateLimiterCacheSize         int
+	RateLimiterBackend           string // "memory" or "redis"
+
+	RedisAddr     string
+	RedisPassword string
+	RedisDb       int
+
+	VaultConfigCheckFrequency int // Seconds
+	VaultConfigTimeout        int // Seconds
+	VaultConfigScheme         string
+	VaultConfigAddr           string
+	VaultConfigPort           int
+	AgentVaultPortDiff        int
+	DevMode                   bool // VAULT_PROXY_DEV
+	AgentRequestTimeout       int  // Seconds
+
+	ProxyRequestTimeout  int // Seconds
+	ShutdownDrainTimeout int // Seconds
+
+	ShadowVaultAddr      string
+	ShadowVaultPort      int
+	ShadowSamplePercent  int
+	ShadowRequestTimeout int // Seconds
+}
+
+// Returns the value of an environment variable, or `fallback` when it is unset
+func envString(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// Returns the integer value of an environment variable, or `fallback` when it is unset. Exits on a malformed value.
+func envInt(name string, fallback int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %q is not an integer", name, value)
+	}
+	return parsed
+}
+
+// Returns the boolean value of an environment variable, or `fallback` when it is unset. Exits on a malformed value.
+func envBool(name string, fallback bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %q is not a boolean", name, value)
+	}
+	return parsed
+}
+
+// Returns the agent's Vault token from VAULT_TOKEN, or else from the file named by VAULT_TOKEN_FILE
+func loadVaultToken() (string, error) {
+	if token := strings.TrimSpace(os.Getenv("VAULT_TOKEN")); token != "" {
+		return token, nil
+	}
+
+	tokenFile := os.Getenv("VAULT_TOKEN_FILE")
+	if tokenFile == "" {
+		return "", errors.New("neither VAULT_TOKEN nor VAULT_TOKEN_FILE is set")
+	}
+	return readTokenFile("VAULT_TOKEN_FILE", tokenFile)
+}
+
+// Returns the admin token from ADMIN_TOKEN, or else from the file named by ADMIN_TOKEN_FILE. Empty if neither is set.
+func loadAdminToken() (string, error) {
+	if token := strings.TrimSpace(os.Getenv("ADMIN_TOKEN")); token != "" {
+		return token, nil
+	}
+
+	tokenFile := os.Getenv("ADMIN_TOKEN_FILE")
+	if tokenFile == "" {
+		return "", nil
+	}
+	return readTokenFile("ADMIN_TOKEN_FILE", tokenFile)
+}
+
+// Returns the token in the file named by the `variable` environment variable, e.g. a mounted Kubernetes secret
+func readTokenFile(variable string, tokenFile string) (string, error) {
+	contents, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", errors.New(variable + " " + tokenFile + " is empty")
+	}
+	return token, nil
+}
+
+// Loads the Config from the environment, e.g. VAULT_ADDR=vault.internal VAULT_PORT=8200 CACHE_SIZE=10000.
+// Unset variables fall back to the constants in config.go. Exits if no Vault token is provided, or the
+// admin token file can't be read.
+func LoadConfigFromEnv() Config {
+	vaultToken, err := loadVaultToken()
+	if err != nil {
+		log.Fatal("No Vault token for the agent: ", err)
+	}
+	adminToken, err := loadAdminToken()
+	if err != nil {
+		log.Fatal("Admin token could not be loaded: ", err)
+	}
+
+	config := Config{
+		VaultToken:         vaultToken,
+		AdminToken:         adminToken,
+		VaultScheme:        envString("VAULT_SCHEME", VAULT_SCHEME),
+		VaultAddr:          envString("VAULT_ADDR", VAULT_ADDR),
+		VaultPort:          envInt("VAULT_PORT", VAULT_PORT),
+		VaultCaCertFile:    envString("VAULT_CA_CERT_FILE", VAULT_CA_CERT_FILE),
+		VaultTlsSkipVerify: envBool("VAULT_TLS_SKIP_VERIFY", VAULT_TLS_SKIP_VERIFY),
+		VaultOutboundProxy: envString("VAULT_OUTBOUND_PROXY", VAULT_OUTBOUND_PROXY),
+		ProxyAddr:          envString("PROXY_ADDR", PROXY_ADDR),
+		ProxyPort:          envInt("PROXY_PORT", PROXY_PORT),
+		AdminAddr:          envString("ADMIN_ADDR", ADMIN_ADDR),
+		AdminPort:          envInt("ADMIN_PORT", ADMIN_PORT),
+
+		VaultCacheDefaultExpiration: envInt("VAULT_CACHE_DEFAULT_EXPIRATION", VAULT_CACHE_DEFAULT_EXPIRATION),
+		VaultCachePurgeFrequency:    envInt("VAULT_CACHE_PURGE_FREQUENCY", VAULT_CACHE_PURGE_FREQUENCY),
+		VaultCacheMinTtl:            envInt("VAULT_CACHE_MIN_TTL", VAULT_CACHE_MIN_TTL),
+		VaultCacheMaxTtl:            envInt("VAULT_CACHE_MAX_TTL", VAULT_CACHE_MAX_TTL),
+		CacheSize:                   envInt("CACHE_SIZE", CACHE_SIZE),
+		MaxCacheBytes:               envInt("MAX_CACHE_BYTES", MAX_CACHE_BYTES),
+		CacheHitRatioAlertWebhook:   envString("CACHE_HIT_RATIO_ALERT_WEBHOOK", CACHE_HIT_RATIO_ALERT_WEBHOOK),
+		CacheBackend:                envString("CACHE_BACKEND", CACHE_BACKEND),
+		CacheMemoryLimitMb:          envInt("CACHE_MEMORY_LIMIT_MB", CACHE_MEMORY_LIMIT_MB),
+		CacheEncryptionKey:          envString("CACHE_ENCRYPTION_KEY", CACHE_ENCRYPTION_KEY),
+
+		RateLimiterDefaultExpiration: envInt("RATE_LIMITER_DEFAULT_EXPIRATION", RATE_LIMITER_DEFAULT_EXPIRATION),
+		RateLimiterPurgeFrequency:    envInt("RATE_LIMITER_PURGE_FREQUENCY", RATE_LIMITER_PURGE_FREQUENCY),
+		RateLimiterMaxLifetime:       envInt("RATE_LIMITER_MAX_LIFETIME", RATE_LIMITER_MAX_LIFETIME),
+		BurstLimitPerSecond:          envInt("BURST_LIMIT_PER_SECOND", BURST_LIMIT_PER_SECOND),
+		RateLimitPerMinute:           envInt("RATE_LIMIT_PER_MINUTE", RATE_LIMIT_PER_MINUTE),
+		RateLimiterBucketSize:        envInt("RATE_LIMITER_BUCKET_SIZE", RATE_LIMITER_BUCKET_SIZE),
+		RateLimiterCacheSize:         envInt("RATE_LIMITER_CACHE_SIZE", RATE_LIMITER_CACHE_SIZE),
+		RateLimiterBackend:           envString("RATE_LIMITER_BACKEND", RATE_LIMITER_BACKEND),
+
+		RedisAddr:     envString("REDIS_ADDR", REDIS_ADDR),
+		RedisPassword: envString("REDIS_PASSWORD", REDIS_PASSWORD),
+		RedisDb:       envInt("REDIS_DB", REDIS_DB),
+
+		VaultConfigCheckFrequency: envInt("VAULT_CONFIG_CHECK_FREQUENCY", VAULT_CONFIG_CHECK_FREQUENCY),
+		VaultConfigTimeout:        envInt("VAULT_CONFIG_TIMEOUT", VAULT_CONFIG_TIMEOUT),
+		AgentVaultPortDiff:        envInt("AGENT_VAULT_PORT_DIFF", AGENT_VAULT_PORT_DIFF),
+		DevMode:                   envBool("VAULT_PROXY_DEV", VAULT_PROXY_DEV),
+		AgentRequestTimeout:       envInt("AGENT_REQUEST_TIMEOUT", AGENT_REQUEST_TIMEOUT),
+
+		ProxyRequestTimeout:  envInt("PROXY_REQUEST_TIMEOUT", PROXY_REQUEST_TIMEOUT),
+		ShutdownDrainTimeout: envInt("SHUTDOWN_DRAIN_TIMEOUT", SHUTDOWN_DRAIN_TIMEOUT),
+
+		ShadowVaultAddr:      envString("SHADOW_VAULT_ADDR", SHADOW_VAULT_ADDR),
+		ShadowVaultPort:      envInt("SHADOW_VAULT_PORT", SHADOW_VAULT_PORT),
+		ShadowSamplePercent:  envInt("SHADOW_SAMPLE_PERCENT", SHADOW_SAMPLE_PERCENT),
+		ShadowRequestTimeout: envInt("SHADOW_REQUEST_TIMEOUT", SHADOW_REQUEST_TIMEOUT),
+	}
+
+	// The config-fetch upstream defaults to the (possibly overridden) data upstream
+	config.VaultConfigScheme = envString("VAULT_CONFIG_SCHEME", config.VaultScheme)
+	config.VaultConfigAddr = envString("VAULT_CONFIG_ADDR", config.VaultAddr)
+	config.VaultConfigPort = envInt("VAULT_CONFIG_PORT", config.VaultPort)
+
+	return config
+}
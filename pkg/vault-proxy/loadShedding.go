@@ -0,0 +1,75 @@
+package vault_proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upstream latency sample
+type latencySample struct {
+	at       int64 // Millis since epoch the upstream call finished
+	duration time.Duration
+}
+
+// Rolling window of recent upstream call latencies, used to shed load while Vault is slow
+type latencyWindow struct {
+	lock       sync.Mutex
+	samples    []latencySample // ring buffer of at most maxSamples entries
+	next       int
+	maxSamples int
+	window     time.Duration
+	threshold  time.Duration // LOAD_SHED_P95_THRESHOLD_MS, 0 disables shedding
+}
+
+// Should ALWAYS be used as the "constructor" for the latencyWindow.
+func newLatencyWindow(threshold time.Duration, window time.Duration, maxSamples int) *latencyWindow {
+	return &latencyWindow{
+		samples:    make([]latencySample, 0, maxSamples),
+		maxSamples: maxSamples,
+		window:     window,
+		threshold:  threshold,
+	}
+}
+
+// Records the duration of one upstream call
+func (w *latencyWindow) observe(duration time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sample := latencySample{time.Now().UnixMilli(), duration}
+	if len(w.samples) < w.maxSamples {
+		w.samples = append(w.samples, sample)
+	} else {
+		w.samples[w.next] = sample
+	}
+	w.next = (w.next + 1) % w.maxSamples
+}
+
+// Returns the 95th percentile of the latencies observed within the window, 0 if there are none.
+// Old samples age out, so the value recovers once Vault is fast again (or stops being called).
+func (w *latencyWindow) p95() time.Duration {
+	w.lock.Lock()
+	cutoff := time.Now().UnixMilli() - w.window.Milliseconds()
+	durations := make([]time.Duration, 0, len(w.samples))
+	for _, sample := range w.samples {
+		if sample.at >= cutoff {
+			durations = append(durations, sample.duration)
+		}
+	}
+	w.lock.Unlock()
+
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	return durations[(len(durations)*95-1)/100]
+}
+
+// Returns `true` if non-cacheable requests should be shed because upstream p95 latency is above the threshold
+func (w *latencyWindow) shouldShed() bool {
+	return w.threshold > 0 && w.p95() > w.threshold
+}
@@ -0,0 +1,72 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSlowVaultShedsUncacheableRequestsUntilItRecovers(t *testing.T) {
+	var delay int64
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	proxy.upstreamLatency = newLatencyWindow(50*time.Millisecond, 300*time.Millisecond, 100)
+	chain := NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+	write := newTestRequest(http.MethodPost, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	read := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+
+	if statuses := serveTimes(chain, write, 2); countStatus(statuses, http.StatusOK) != 2 {
+		t.Fatalf("got statuses %v while Vault is fast, want no shedding", statuses)
+	}
+
+	// One slow call puts the p95 past the threshold
+	atomic.StoreInt64(&delay, int64(100*time.Millisecond))
+	if statuses := serveTimes(chain, write, 1); statuses[0] != http.StatusOK {
+		t.Fatalf("got status %d for the slow call", statuses[0])
+	}
+	atomic.StoreInt64(&delay, 0)
+	if statuses := serveTimes(chain, write, 3); countStatus(statuses, http.StatusServiceUnavailable) != 3 {
+		t.Errorf("got statuses %v for writes while Vault is slow, want them shed", statuses)
+	}
+	if statuses := serveTimes(chain, read, 1); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d for a cacheable read while shedding, want it served", statuses[0])
+	}
+
+	// The slow sample ages out of the window, and writes reach Vault again
+	time.Sleep(350 * time.Millisecond)
+	if statuses := serveTimes(chain, write, 3); countStatus(statuses, http.StatusOK) != 3 {
+		t.Errorf("got statuses %v once the slow call left the window, want shedding to stop", statuses)
+	}
+}
+
+func TestLatencyWindowP95(t *testing.T) {
+	window := newLatencyWindow(50*time.Millisecond, time.Minute, 20)
+	for i := 0; i < 19; i++ {
+		window.observe(10 * time.Millisecond)
+	}
+	window.observe(time.Second)
+	if window.shouldShed() {
+		t.Errorf("one outlier in 20 calls sheds load, p95 is %v", window.p95())
+	}
+
+	// Older samples are overwritten once the window holds maxSamples
+	for i := 0; i < 20; i++ {
+		window.observe(100 * time.Millisecond)
+	}
+	if p95 := window.p95(); p95 != 100*time.Millisecond || !window.shouldShed() {
+		t.Errorf("got p95 %v, want 100ms and shedding", p95)
+	}
+
+	disabled := newLatencyWindow(0, time.Minute, 20)
+	disabled.observe(time.Hour)
+	if disabled.shouldShed() {
+		t.Error("a zero threshold sheds load")
+	}
+}
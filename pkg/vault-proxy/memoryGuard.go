@@ -0,0 +1,55 @@
+package vault_proxy
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Returns `true` while memory pressure has disabled new cache entries
+func (c *vaultCache) areWritesDisabled() bool {
+	return atomic.LoadInt32(&c.writesDisabled) == 1
+}
+
+// Flips new cache entries off once the heap exceeds `limitBytes`, and back on once it drops below
+// CACHE_MEMORY_RESUME_FRACTION of it. While over the limit a quarter of the entries is evicted per sample
+// if CACHE_MEMORY_PRESSURE_EVICT is set.
+func (c *vaultCache) checkMemory(heapBytes uint64, limitBytes uint64) {
+	if heapBytes > limitBytes {
+		if atomic.CompareAndSwapInt32(&c.writesDisabled, 0, 1) {
+			log.Printf("MEMORY GUARD: heap of %d MB is above %d MB, no longer caching new entries.", heapBytes>>20, limitBytes>>20)
+			cacheWritesDisabled.Set(1)
+		}
+		if CACHE_MEMORY_PRESSURE_EVICT {
+			c.lock.Lock()
+			c.evictLruEntries()
+			cacheEntries.Set(float64(len(c.cache)))
+			c.lock.Unlock()
+		}
+	} else if float64(heapBytes) < float64(limitBytes)*CACHE_MEMORY_RESUME_FRACTION {
+		if atomic.CompareAndSwapInt32(&c.writesDisabled, 1, 0) {
+			log.Printf("MEMORY GUARD: heap of %d MB is back below the limit, caching new entries again.", heapBytes>>20)
+			cacheWritesDisabled.Set(0)
+		}
+	}
+}
+
+// Samples the heap every `interval` until the process exits, see checkMemory. A CacheMemoryLimitMb of 0 disables the guard.
+func (c *vaultCache) StartMemoryGuard(interval time.Duration) {
+	if interval <= 0 || c.config.CacheMemoryLimitMb <= 0 {
+		return
+	}
+
+	limitBytes := uint64(c.config.CacheMemoryLimitMb) << 20
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var stats runtime.MemStats
+		for range ticker.C {
+			runtime.ReadMemStats(&stats)
+			c.checkMemory(stats.HeapAlloc, limitBytes)
+		}
+	}()
+}
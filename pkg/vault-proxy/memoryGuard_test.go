@@ -0,0 +1,52 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemoryPressureSkipsNewWritesUntilRecovered(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheSize = 100
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+	const limitBytes = 100 << 20
+	store := func(path string) bool {
+		request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", "token"))
+		response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+			return newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil), nil
+		})
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+		if body := readBody(t, response); body != `{"data":{"value":"secret"}}` {
+			t.Errorf("%s: got body %q, want the upstream body either way", path, body)
+		}
+		_, isCached := cache.getFromCache(cache.getEntryKey(request))
+		return isCached
+	}
+
+	// A sample above the limit disables new entries
+	cache.checkMemory(limitBytes+1, limitBytes)
+	if !cache.areWritesDisabled() || testutil.ToFloat64(cacheWritesDisabled) != 1 {
+		t.Fatal("a heap above the limit did not disable cache writes")
+	}
+	if store("/v1/secret/data/under-pressure") {
+		t.Error("a new entry was cached while memory is above the limit")
+	}
+
+	// Dropping just below the limit is not enough to resume
+	cache.checkMemory(limitBytes-1, limitBytes)
+	if !cache.areWritesDisabled() {
+		t.Error("cache writes resumed before the heap dropped below the resume fraction")
+	}
+
+	cache.checkMemory(0, limitBytes)
+	if cache.areWritesDisabled() || testutil.ToFloat64(cacheWritesDisabled) != 0 {
+		t.Fatal("a recovered heap did not resume cache writes")
+	}
+	if !store("/v1/secret/data/recovered") {
+		t.Error("a new entry was not cached once memory recovered")
+	}
+}
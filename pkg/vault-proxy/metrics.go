@@ -0,0 +1,187 @@
+package vault_proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Purge Metrics - purges hold the cache/limiter write lock, so their duration shows up as request latency
+var purgeOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_purge_operations_total",
+	Help: "Number of cache and rate-limiter purge operations.",
+}, []string{"purge"})
+
+var purgeDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "vault_proxy_purge_duration_seconds",
+	Help:    "Time spent purging cache or rate-limiter entries while holding the write lock.",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to ~2.6s
+}, []string{"purge"})
+
+// Request Metrics
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_requests_total",
+	Help: "Requests received by the proxy, by Vault namespace (unlisted namespaces are counted as \"other\").",
+}, []string{"namespace"})
+
+var upstreamRequestDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "vault_proxy_upstream_request_duration_seconds",
+	Help:    "Latency of requests proxied to Vault.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14), // 1ms to ~8s
+})
+
+var rateLimitDeniedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_ratelimit_denied_total",
+	Help: "Requests rejected with a 429 by the per-token rate limiter.",
+})
+
+// Cache Metrics
+var cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_cache_hits_total",
+	Help: "Cacheable reads served from the cache.",
+})
+
+var cacheNegativeHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_cache_negative_hits_total",
+	Help: "Cache hits served from a cached error response, e.g. a 404 cached for NEGATIVE_CACHE_TTL. Also counted in vault_proxy_cache_hits_total.",
+})
+
+var cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_cache_misses_total",
+	Help: "Cacheable reads not found in the cache, expired or bypassed because of an in-flight write.",
+})
+
+var cacheHitRatioAlertsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_cache_hit_ratio_alerts_total",
+	Help: "Times the cache hit ratio dropped below CACHE_HIT_RATIO_ALERT_THRESHOLD.",
+})
+
+var cacheRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_cache_refreshes_total",
+	Help: "Cache misses fetched from Vault, by result (\"cached\", \"uncached\" or \"error\"), or \"shared\" for misses served by a concurrent fetch.",
+}, []string{"result"})
+
+var cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_cache_entries",
+	Help: "Responses currently held in the cache.",
+})
+
+var cacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_cache_bytes",
+	Help: "Body bytes of the responses currently held in the cache, as counted against MAX_CACHE_BYTES.",
+})
+
+var cacheWritesDisabled = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_cache_writes_disabled",
+	Help: "1 while memory is above CACHE_MEMORY_LIMIT_MB and new responses are not cached, 0 otherwise.",
+})
+
+// Agent Metrics
+var agentForwardsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_agent_forwards_total",
+	Help: "Cacheable reads forwarded to the agent owning the routing key.",
+})
+
+var agentForwardErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_agent_forward_errors_total",
+	Help: "Forwards to another agent that failed and were served locally, by reason (\"timeout\", \"error\" or \"loop\").",
+}, []string{"reason"})
+
+var routingDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_routing_decisions_total",
+	Help: "Cacheable reads by the agent they were routed to: \"local\" or the peer's address from the routing table.",
+}, []string{"node"})
+
+// Shutdown Metrics
+var inFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_in_flight_requests",
+	Help: "Requests currently being served by the proxy.",
+})
+
+// Rate-limiter Cache Metrics - purge counts are in vault_proxy_purge_operations_total
+var rateLimiterCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_rate_limiter_cache_entries",
+	Help: "Rate limiters currently held in the rate-limiters cache.",
+})
+
+var rateLimiterCacheCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vault_proxy_rate_limiter_cache_capacity",
+	Help: "Configured RATE_LIMITER_CACHE_SIZE.",
+})
+
+var rateLimiterEvictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_rate_limiter_evictions_total",
+	Help: "Rate limiters removed from the rate-limiters cache by LRU or expiry purges.",
+})
+
+// Circuit Breaker Metrics
+var tokenCircuitBreaksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vault_proxy_token_circuit_breaks_total",
+	Help: "Times a token's circuit opened after too many upstream errors.",
+})
+
+// Redis Metrics
+var redisErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vault_proxy_redis_errors_total",
+	Help: "Failed Redis calls, by operation; each one falls back to the agent's own state for REDIS_RETRY_INTERVAL. cache_replicate counts shared cache writes that reached fewer than REDIS_CACHE_MIN_REPLICAS replicas.",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(
+		purgeOperationsTotal,
+		purgeDurationSeconds,
+		requestsTotal,
+		upstreamRequestDurationSeconds,
+		rateLimitDeniedTotal,
+		cacheHitsTotal,
+		cacheNegativeHitsTotal,
+		cacheMissesTotal,
+		cacheHitRatioAlertsTotal,
+		cacheRefreshesTotal,
+		cacheEntries,
+		cacheBytes,
+		cacheWritesDisabled,
+		agentForwardsTotal,
+		agentForwardErrorsTotal,
+		routingDecisionsTotal,
+		inFlightRequests,
+		rateLimiterCacheEntries,
+		rateLimiterCacheCapacity,
+		rateLimiterEvictionsTotal,
+		tokenCircuitBreaksTotal,
+		redisErrorsTotal,
+	)
+}
+
+// Maps a routing target to its metric label. Targets only come from the routing table, so labels stay
+// bounded to the known server set.
+func routingNodeLabel(routingServer string, myAddress string) string {
+	if routingServer == myAddress {
+		return "local"
+	}
+	return routingServer
+}
+
+// Maps a Vault namespace to its metric label. Only namespaces in METRIC_NAMESPACE_ALLOWLIST
+// get their own label, everything else folds into "other" to keep label cardinality bounded.
+func namespaceLabel(namespace string) string {
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" {
+		namespace = "root"
+	}
+
+	for _, allowed := range METRIC_NAMESPACE_ALLOWLIST {
+		if namespace == allowed {
+			return namespace
+		}
+	}
+
+	return "other"
+}
+
+// Records one purge operation and how long it took since `start`
+func observePurge(purge string, start time.Time) {
+	purgeOperationsTotal.WithLabelValues(purge).Inc()
+	purgeDurationSeconds.WithLabelValues(purge).Observe(time.Since(start).Seconds())
+}
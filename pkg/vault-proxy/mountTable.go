@@ -0,0 +1,170 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Mounts of a single Vault namespace
+type namespaceMounts struct {
+	accessors   map[string]string // Mount path (e.g. "secret/") -> mount accessor
+	lastFetched int64             // Millis since epoch of the last fetch attempt
+}
+
+// Cached Vault mount tables, used to fold the mount accessor into cache keys
+type mountTable struct {
+	config           Config
+	lock             sync.RWMutex
+	namespaces       map[string]*namespaceMounts // Keyed on the client-supplied namespace, so bounded by maxNamespaces
+	fetches          singleflight.Group          // Collapses concurrent fetches of a namespace into one
+	refreshFrequency int64                       // MOUNT_TABLE_REFRESH_FREQUENCY
+	maxNamespaces    int                         // MAX_MOUNT_TABLE_NAMESPACES
+}
+
+// Response of GET /v1/sys/mounts
+type vaultMountsResponse struct {
+	Data map[string]struct {
+		Accessor string `json:"accessor"`
+	} `json:"data"`
+}
+
+// Should ALWAYS be used as the "constructor" for the mountTable.
+func newMountTable(config Config) *mountTable {
+	return &mountTable{
+		config:           config,
+		namespaces:       make(map[string]*namespaceMounts),
+		refreshFrequency: MOUNT_TABLE_REFRESH_FREQUENCY,
+		maxNamespaces:    MAX_MOUNT_TABLE_NAMESPACES,
+	}
+}
+
+// Fetches the mount table of a namespace from Vault
+func (m *mountTable) fetchMounts(namespace string) (map[string]string, error) {
+	addr := fmt.Sprintf("%s://%s:%d/v1/sys/mounts", m.config.VaultScheme, m.config.VaultAddr, m.config.VaultPort)
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add(VAULT_TOKEN_HEADER, m.config.VaultToken)
+	if namespace != "" {
+		req.Header.Add(VAULT_NAMESPACE_HEADER, namespace)
+	}
+	if err = signUpstreamRequest(req); err != nil {
+		return nil, err
+	}
+
+	client := newVaultClient(m.config, time.Duration(m.config.AgentRequestTimeout)*time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseObject vaultMountsResponse
+	if err = json.Unmarshal(bodyBytes, &responseObject); err != nil {
+		return nil, err
+	}
+
+	accessors := make(map[string]string, len(responseObject.Data))
+	for mountPath, mount := range responseObject.Data {
+		accessors[mountPath] = mount.Accessor
+	}
+	return accessors, nil
+}
+
+// Fetches the mount table of a namespace and stores it. On a failed fetch the previous table is kept.
+// Evicts the least recently fetched namespace when MAX_MOUNT_TABLE_NAMESPACES are already stored.
+func (m *mountTable) refreshMounts(namespace string) map[string]string {
+	accessors, err := m.fetchMounts(namespace)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	previous, exists := m.namespaces[namespace]
+	if err != nil {
+		log.Printf("Could not fetch mount table for namespace '%s': %v", namespace, err)
+		if exists {
+			accessors = previous.accessors
+		}
+	}
+	if !exists && len(m.namespaces) >= m.maxNamespaces {
+		m.evictOldestNamespace()
+	}
+
+	// Stored entries are never mutated, so readers can use them after releasing the lock
+	m.namespaces[namespace] = &namespaceMounts{accessors: accessors, lastFetched: time.Now().UnixMilli()}
+	return accessors
+}
+
+// Removes the namespace fetched the longest ago. Must be called with the write lock held.
+func (m *mountTable) evictOldestNamespace() {
+	oldest := ""
+	var oldestFetched int64 = math.MaxInt64
+	for namespace, mounts := range m.namespaces {
+		if mounts.lastFetched < oldestFetched {
+			oldest = namespace
+			oldestFetched = mounts.lastFetched
+		}
+	}
+	delete(m.namespaces, oldest)
+}
+
+// Returns the mount table of a namespace. The first request for a namespace waits for its table; after
+// that the stored table is served while it is refetched in the background every refreshFrequency seconds.
+// Concurrent fetches of a namespace are collapsed into one.
+func (m *mountTable) getMounts(namespace string) map[string]string {
+	m.lock.RLock()
+	mounts, exists := m.namespaces[namespace]
+	m.lock.RUnlock()
+
+	refresh := func() (interface{}, error) {
+		return m.refreshMounts(namespace), nil
+	}
+	if !exists {
+		accessors, _, _ := m.fetches.Do(namespace, refresh)
+		return accessors.(map[string]string)
+	}
+	if time.Now().UnixMilli()-m.refreshFrequency*1000 > mounts.lastFetched {
+		m.fetches.DoChan(namespace, refresh)
+	}
+	return mounts.accessors
+}
+
+// Returns the accessor of the mount serving the path, "" if it is unknown
+func (m *mountTable) getMountAccessor(namespace string, path string) string {
+	relativePath := strings.TrimPrefix(path, "/v1/")
+	if !strings.HasSuffix(relativePath, "/") {
+		relativePath += "/"
+	}
+
+	// The longest matching mount path wins, e.g. "secret/team/" over "secret/"
+	accessor := ""
+	longestMatch := 0
+	for mountPath, mountAccessor := range m.getMounts(namespace) {
+		if len(mountPath) > longestMatch && strings.HasPrefix(relativePath, mountPath) {
+			accessor = mountAccessor
+			longestMatch = len(mountPath)
+		}
+	}
+
+	return accessor
+}
@@ -0,0 +1,84 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves /v1/sys/mounts with a "secret/" mount whose accessor is returned by `accessor`, counting the fetches
+func newMountsVault(t *testing.T, accessor func(namespace string) string) (Config, *int32) {
+	var fetches int32
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(writer, `{"data":{"secret/":{"accessor":%q}}}`, accessor(request.Header.Get(VAULT_NAMESPACE_HEADER)))
+	})
+	return config, &fetches
+}
+
+func TestRemountedPathDoesNotShareEntries(t *testing.T) {
+	var accessor atomic.Value
+	accessor.Store("kv_1")
+	config, _ := newMountsVault(t, func(string) string { return accessor.Load().(string) })
+	parseHeader := NewParseHeader(config)
+	parseHeader.mounts = newMountTable(config)
+	parseHeader.mounts.refreshFrequency = 0
+	cacheKey := func() string {
+		return parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")).GetVaultCacheKey()
+	}
+
+	before := cacheKey()
+	accessor.Store("kv_2")
+
+	// The remount is picked up by a background refresh, so the previous key is served meanwhile
+	deadline := time.Now().Add(2 * time.Second)
+	for cacheKey() == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cacheKey() == before {
+		t.Error("path on the new mount shares the cache key of the previous mount")
+	}
+}
+
+func TestConcurrentFirstUsesShareOneMountsFetch(t *testing.T) {
+	config, fetches := newMountsVault(t, func(string) string { return "kv_1" })
+	mounts := newMountTable(config)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if accessor := mounts.getMountAccessor("team-a", "/v1/secret/data/foo"); accessor != "kv_1" {
+				t.Errorf("got accessor %q, want kv_1", accessor)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(fetches); got != 1 {
+		t.Errorf("got %d mount table fetches, want 1", got)
+	}
+}
+
+func TestMountTableNamespacesAreBounded(t *testing.T) {
+	config, _ := newMountsVault(t, func(namespace string) string { return "kv_" + namespace })
+	mounts := newMountTable(config)
+	mounts.maxNamespaces = 2
+
+	for i := 0; i < 5; i++ {
+		mounts.getMounts(fmt.Sprintf("made-up-%d", i))
+	}
+
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	if len(mounts.namespaces) != 2 {
+		t.Errorf("got %d namespaces stored, want 2", len(mounts.namespaces))
+	}
+	if _, exists := mounts.namespaces["made-up-4"]; !exists {
+		t.Error("latest namespace was evicted")
+	}
+}
@@ -0,0 +1,145 @@
+package vault_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const clientIdentityContextKey contextKey = "clientIdentity"
+
+// Returns the CA pool read from a PEM bundle
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+// Returns the TLS config of the proxy listener, nil when PROXY_TLS_CERT_FILE is unset (plain HTTP).
+// With PROXY_CLIENT_CA_FILE set, clients must present a certificate signed by that CA.
+func NewProxyTLSConfig() (*tls.Config, error) {
+	return newProxyTLSConfig(PROXY_TLS_CERT_FILE, PROXY_TLS_KEY_FILE, PROXY_CLIENT_CA_FILE)
+}
+
+// Returns the TLS config serving the certificate, requiring client certificates signed by `clientCaFile` unless it is ""
+func newProxyTLSConfig(certFile string, keyFile string, clientCaFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCaFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(clientCaFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// Returns the scheme and client agents use to reach each other. When the listener serves TLS, agents
+// connect over https, present the proxy certificate and verify peers against PROXY_CLIENT_CA_FILE.
+func newAgentClient(config Config) (string, *http.Client) {
+	client := &http.Client{Timeout: time.Duration(config.AgentRequestTimeout) * time.Second}
+	if PROXY_TLS_CERT_FILE == "" {
+		return "http", client
+	}
+
+	certificate, err := tls.LoadX509KeyPair(PROXY_TLS_CERT_FILE, PROXY_TLS_KEY_FILE)
+	if err != nil {
+		log.Fatal("Could not load the proxy certificate for agent connections: ", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if PROXY_CLIENT_CA_FILE != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(PROXY_CLIENT_CA_FILE); err != nil {
+			log.Fatal("Could not load the client CA for agent connections: ", err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return "https", client
+}
+
+// Returns the identity of a verified client certificate: its CN, else its first DNS, URI or email SAN
+func certificateIdentity(request *http.Request) string {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	certificate := request.TLS.VerifiedChains[0][0]
+	switch {
+	case certificate.Subject.CommonName != "":
+		return certificate.Subject.CommonName
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	case len(certificate.URIs) > 0:
+		return certificate.URIs[0].String()
+	case len(certificate.EmailAddresses) > 0:
+		return certificate.EmailAddresses[0]
+	}
+
+	return ""
+}
+
+// Returns `true` if the identity belongs to a peer agent allowed to vouch for the original client
+func isTrustedAgentIdentity(identity string) bool {
+	for _, trusted := range TRUSTED_AGENT_IDENTITIES {
+		if identity == trusted {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the verified client identity of the request, "" when the client presented no certificate
+func GetClientIdentity(ctx context.Context) string {
+	identity, _ := ctx.Value(clientIdentityContextKey).(string)
+	return identity
+}
+
+// Puts the verified client certificate identity into the request context. Requests routed from a
+// trusted peer agent carry the original client's identity in CLIENT_IDENTITY_HEADER; from anyone
+// else that header is dropped so it can't be spoofed.
+func ClientIdentityHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		identity := certificateIdentity(request)
+		if forwarded := request.Header.Get(CLIENT_IDENTITY_HEADER); forwarded != "" && isTrustedAgentIdentity(identity) {
+			identity = forwarded
+		}
+		request.Header.Del(CLIENT_IDENTITY_HEADER)
+
+		if identity != "" {
+			log.Printf("Client identity: %s Path: %s", identity, request.URL.Path)
+		}
+
+		ctx := context.WithValue(request.Context(), clientIdentityContextKey, identity)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
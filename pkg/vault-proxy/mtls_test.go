@@ -0,0 +1,156 @@
+package vault_proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test certificate authority, signing leaf certificates
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// Returns a new self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	ca.certificate, ca.key = ca.sign(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// Signs the template with the CA (self-signed while the CA has no certificate yet), returning the certificate and its key
+func (ca *testCA) sign(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	parent, signer := template, key
+	if ca.certificate != nil {
+		parent, signer = ca.certificate, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+// Returns a leaf certificate for the subject, usable by servers and clients
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	certificate, key := ca.sign(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	return tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key, Leaf: certificate}
+}
+
+// Writes PEM blocks to a file in the test's temporary directory, returning its path
+func writePem(t *testing.T, name string, blocks ...*pem.Block) string {
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, block := range blocks {
+		pem.Encode(file, block)
+	}
+	return path
+}
+
+// Starts a server on the proxy listener's TLS config, requiring client certificates signed by `ca`, that answers
+// with the client identity
+func startMtlsServer(t *testing.T, ca *testCA) *httptest.Server {
+	serverCertificate := ca.issue(t, "vault-proxy")
+	keyDer, err := x509.MarshalECPrivateKey(serverCertificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := newProxyTLSConfig(
+		writePem(t, "proxy.crt", &pem.Block{Type: "CERTIFICATE", Bytes: serverCertificate.Leaf.Raw}),
+		writePem(t, "proxy.key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		writePem(t, "client-ca.crt", &pem.Block{Type: "CERTIFICATE", Bytes: ca.certificate.Raw}),
+	)
+	if err != nil {
+		t.Fatalf("loading the TLS config: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(ClientIdentityHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, GetClientIdentity(request.Context()))
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Returns a client trusting `ca` for the server, presenting the certificates
+func newMtlsClient(ca *testCA, certificates ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+}
+
+func TestMtlsRequiresAValidClientCertificate(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	server := startMtlsServer(t, ca)
+
+	for name, client := range map[string]*http.Client{
+		"no certificate":          newMtlsClient(ca),
+		"certificate of other CA": newMtlsClient(ca, otherCA.issue(t, "intruder")),
+	} {
+		if response, err := client.Get(server.URL + "/v1/secret/data/foo"); err == nil {
+			response.Body.Close()
+			t.Errorf("%s: got status %d, want the handshake rejected", name, response.StatusCode)
+		}
+	}
+}
+
+func TestMtlsExposesTheClientIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	server := startMtlsServer(t, ca)
+
+	for name, tc := range map[string]struct {
+		certificate tls.Certificate
+		want        string
+	}{
+		"common name": {ca.issue(t, "billing-service"), "billing-service"},
+		"DNS SAN":     {ca.issue(t, "", "billing.internal"), "billing.internal"},
+	} {
+		response, err := newMtlsClient(ca, tc.certificate).Get(server.URL + "/v1/secret/data/foo")
+		if err != nil {
+			t.Fatalf("%s: request with a valid certificate failed: %v", name, err)
+		}
+		if identity := readBody(t, response); identity != tc.want {
+			t.Errorf("%s: got client identity %q, want %q", name, identity, tc.want)
+		}
+	}
+}
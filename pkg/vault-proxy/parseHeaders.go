@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync/atomic"
 )
 
 // Context Key
@@ -15,48 +17,178 @@ type contextKey string
 
 const parsedHeaderContextKey contextKey = "parsedHeadersValues"
 
-// Parse Header
+// Parse Header. Shared by all requests, so it only holds configuration - parsed values live in parsedHeaders.
 type parseHeader struct {
+	methodsToIgnore atomic.Value              // []string; swapped atomically by SetMethodsToIgnore
+	mounts          *mountTable               // nil unless INCLUDE_MOUNT_ACCESSOR_IN_KEY
+	entities        *entityTable              // nil unless CACHE_KEY_BY_ENTITY
+	pathPatterns    map[string]*regexp.Regexp // Compiled CACHE_KEY_RULES PathPatterns
+
+	cacheKeyRules            []CacheKeyRule // CACHE_KEY_RULES
+	normalizeTrailingSlash   bool           // NORMALIZE_TRAILING_SLASH
+	canaryTokenHashes        []string       // CANARY_TOKEN_HASHES
+	duplicateNamespacePolicy string         // DUPLICATE_NAMESPACE_HEADER_POLICY
+}
+
+// Values parsed from a single request, stored in its context under parsedHeaderContextKey. Never mutated once stored.
+type parsedHeaders struct {
 	vaultCacheKey      string
+	pathCacheKey       string // vaultCacheKey without its method, Accept, body or query parts, the key writes to the path are made under
 	limiterCacheKey    string
+	tokenKey           string // Hashed Vault token, "" for unauthenticated requests
 	isPathCacheable    bool
 	isRequestIgnorable bool
+	isCanary           bool
+}
+
+// Should ALWAYS be used as the "constructor" for the parseHeader.
+func NewParseHeader(config Config) *parseHeader {
+	h := &parseHeader{
+		pathPatterns:             compileKeyPathPatterns(CACHE_KEY_RULES[:]),
+		cacheKeyRules:            CACHE_KEY_RULES[:],
+		normalizeTrailingSlash:   NORMALIZE_TRAILING_SLASH,
+		canaryTokenHashes:        CANARY_TOKEN_HASHES[:],
+		duplicateNamespacePolicy: DUPLICATE_NAMESPACE_HEADER_POLICY,
+	}
+	h.SetMethodsToIgnore(METHODS_TO_IGNORE[:])
+	if INCLUDE_MOUNT_ACCESSOR_IN_KEY {
+		h.mounts = newMountTable(config)
+	}
+	if CACHE_KEY_BY_ENTITY {
+		h.entities = newEntityTable(config)
+	}
+	return h
+}
+
+// Get the methods currently treated as ignorable (create/update/delete)
+func (h *parseHeader) GetMethodsToIgnore() []string {
+	return h.methodsToIgnore.Load().([]string)
 }
 
-// Should ALWAYS be used as the "constructor" for the vaultCache. Initializes cache.
-func NewParseHeader() *parseHeader {
-	return &parseHeader{
-		vaultCacheKey:      "",
-		limiterCacheKey:    "",
-		isPathCacheable:    false,
-		isRequestIgnorable: true,
+// Replaces the ignorable methods list at runtime. Subsequent requests use the new list.
+func (h *parseHeader) SetMethodsToIgnore(methods []string) {
+	methodsToIgnore := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			methodsToIgnore = append(methodsToIgnore, method)
+		}
 	}
+
+	h.methodsToIgnore.Store(methodsToIgnore)
+	log.Printf("Methods to ignore set to: %v", methodsToIgnore)
 }
 
 // Get if path is cacheable
-func (h *parseHeader) IsPathCacheable() bool {
+func (h *parsedHeaders) IsPathCacheable() bool {
 	return h.isPathCacheable
 }
 
 // Get if request is ignorable
-func (h *parseHeader) IsRequestIgnorable() bool {
+func (h *parsedHeaders) IsRequestIgnorable() bool {
 	return h.isRequestIgnorable
 }
 
+// Get if request comes from a canary (monitoring) token that must bypass the cache
+func (h *parsedHeaders) IsCanary() bool {
+	return h.isCanary
+}
+
 // Get vault cache key
-func (h *parseHeader) GetVaultCacheKey() string {
+func (h *parsedHeaders) GetVaultCacheKey() string {
 	return h.vaultCacheKey
 }
 
+// Get the cache key of the path, shared by all read variants of the path and the writes to it
+func (h *parsedHeaders) GetPathCacheKey() string {
+	return h.pathCacheKey
+}
+
 // Get limiter cache key
-func (h *parseHeader) GetLimiterCacheKey() string {
+func (h *parsedHeaders) GetLimiterCacheKey() string {
 	return h.limiterCacheKey
 }
 
-// Returns 'true' if the request path is in the list of CACHEABLE_SUBPATHS provided in config.go
+// Get hashed Vault token key, "" if the request carries no token
+func (h *parsedHeaders) GetTokenKey() string {
+	return h.tokenKey
+}
+
+// Canonicalizes trailing slashes when NORMALIZE_TRAILING_SLASH is enabled, so
+// `/v1/secret/data/foo` and `/v1/secret/data/foo/` share cacheability and cache keys.
+func normalizePath(path string) string {
+	if !NORMALIZE_TRAILING_SLASH {
+		return path
+	}
+	return trimTrailingSlashes(path)
+}
+
+// Canonicalizes trailing slashes of paths checked for cacheability or keyed, when normalizeTrailingSlash is set
+func (h *parseHeader) normalizePath(path string) string {
+	if !h.normalizeTrailingSlash {
+		return path
+	}
+	return trimTrailingSlashes(path)
+}
+
+// Strips trailing slashes, leaving the root path "/" as is
+func trimTrailingSlashes(path string) string {
+	if len(path) <= 1 {
+		return path
+	}
+
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// Returns 'true' if the path is `subpath` itself or below it, matching whole path segments only.
+// A path equal to `subpath` (ignoring trailing slashes) only matches if `allowBase` is set.
+// Path-style namespaces match too, e.g. /v1/team-a/secret/data/foo is under /v1/secret/data.
+func isUnderSubpath(path string, subpath string, allowBase bool) bool {
+	subpath = strings.TrimRight(subpath, "/")
+	if hasSubpathPrefix(path, subpath, allowBase) {
+		return true
+	}
+	if !strings.HasPrefix(subpath, "/v1/") || !strings.HasPrefix(path, "/v1/") {
+		return false
+	}
+
+	// The namespace can't be told apart from the rest of the path, so try the subpath after every leading segment
+	apiPath := subpath[len("/v1"):]
+	for i := len("/v1/"); i < len(path); i++ {
+		if path[i] == '/' && hasSubpathPrefix(path[i:], apiPath, allowBase) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns 'true' if the path starts with `subpath` (no trailing slash) at a segment boundary
+func hasSubpathPrefix(path string, subpath string, allowBase bool) bool {
+	if !strings.HasPrefix(path, subpath) {
+		return false
+	}
+
+	leaf := path[len(subpath):]
+	if leaf != "" && leaf[0] != '/' {
+		return false
+	}
+	return allowBase || strings.Trim(leaf, "/") != ""
+}
+
+// Returns 'true' if the request path is under one of the CACHEABLE_SUBPATHS provided in config.go
+// and isn't under any of NEVER_CACHEABLE_SUBPATHS, in any namespace
 func (h *parseHeader) checkPathCacheable(path string) bool {
+	path = h.normalizePath(path)
+	for _, neverCacheableSubPath := range NEVER_CACHEABLE_SUBPATHS {
+		if isUnderSubpath(path, neverCacheableSubPath, true) {
+			return false
+		}
+	}
+
 	for _, cacheableSubPath := range CACHEABLE_SUBPATHS {
-		if strings.Contains(path, cacheableSubPath) {
+		if isUnderSubpath(path, cacheableSubPath, CACHE_SUBPATH_BASE_REQUESTS) {
 			return true
 		}
 	}
@@ -64,9 +196,15 @@ func (h *parseHeader) checkPathCacheable(path string) bool {
 	return false
 }
 
-// Returns 'true' if the request method is in the list of METHODS_TO_IGNORE provided in config.go
+// Returns 'true' if responses to the request method may be cached
+func (h *parseHeader) checkMethodCacheable(method string) bool {
+	return method != http.MethodHead || CACHE_HEAD_REQUESTS
+}
+
+// Returns 'true' if the request method is in the current list of methods to ignore
+// (METHODS_TO_IGNORE from config.go unless replaced at runtime)
 func (h *parseHeader) checkRequestIgnorable(method string) bool {
-	for _, methodName := range METHODS_TO_IGNORE {
+	for _, methodName := range h.GetMethodsToIgnore() {
 		if strings.Contains(method, methodName) {
 			return true
 		}
@@ -75,34 +213,130 @@ func (h *parseHeader) checkRequestIgnorable(method string) bool {
 	return false
 }
 
+// Returns the bearer token from the Authorization header, or "" if it isn't a bearer credential.
+func getBearerToken(request *http.Request) string {
+	authorization := request.Header.Get(AUTHORIZATION_HEADER)
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ""
+}
+
+// Returns the Vault token from X-Vault-Token or the Authorization bearer header,
+// honoring TOKEN_HEADER_PRECEDENCE when both are present.
+func getVaultToken(request *http.Request) string {
+	vaultToken := request.Header.Get(VAULT_TOKEN_HEADER)
+	bearerToken := getBearerToken(request)
+
+	if vaultToken == "" {
+		return bearerToken
+	}
+	if bearerToken != "" && strings.EqualFold(TOKEN_HEADER_PRECEDENCE, AUTHORIZATION_HEADER) {
+		return bearerToken
+	}
+
+	return vaultToken
+}
+
+// Returns 'true' if the limiter key belongs to one of the CANARY_TOKEN_HASHES provided in config.go
+func (h *parseHeader) checkCanary(limiterCacheKey string) bool {
+	for _, canaryTokenHash := range h.canaryTokenHashes {
+		if limiterCacheKey == canaryTokenHash {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Parses relevant data from the request object as needed for caching.
 func (h *parseHeader) parseVaultRequest(request *http.Request) (string, string, string) {
-	return request.Header.Get(VAULT_TOKEN_HEADER),
+	return getVaultToken(request),
 		request.Header.Get(VAULT_NAMESPACE_HEADER),
-		request.URL.Path
+		h.normalizePath(request.URL.Path)
 }
 
-// Converts request details into a hashed cache key
-func (h *parseHeader) getMD5HashedCacheKey(request *http.Request) string {
+// Converts request details into a hashed cache key, and the hashed key of the path the request is under,
+// without its method, Accept, body or query parts
+func (h *parseHeader) getMD5HashedCacheKey(request *http.Request) (string, string) {
 	token, namespace, path := h.parseVaultRequest(request)
 
+	// Per-subpath composition - excluded parts are left blank so default keys are unchanged
+	rule := h.getCacheKeyRule(path)
+	keyToken, keyNamespace := token, namespace
+	if !rule.Token {
+		keyToken = ""
+	}
+	if !rule.Namespace {
+		keyNamespace = ""
+	}
+
+	// Tokens of the same identity share entries, once EntityLookupHandler has looked the token up
+	if keyToken != "" && h.entities != nil {
+		if identity := h.entities.getIdentity(h.getMD5HashedLimiterKey(token)); identity != "" {
+			keyToken = identity
+		}
+	}
+
 	log.Printf("Fetching for: path %s \n", path)
-	vaultHashKey := fmt.Sprintf("%s-%s-%s", token, path, namespace)
+	vaultHashKey := fmt.Sprintf("%s-%s-%s", keyToken, normalizeKeyPath(rule, path, h.pathPatterns), keyNamespace)
+
+	// A remounted path gets a new accessor, so it never reuses entries of the previous mount
+	if h.mounts != nil {
+		vaultHashKey = fmt.Sprintf("%s-%s", vaultHashKey, h.mounts.getMountAccessor(namespace, path))
+	}
+
+	// Writes are tracked under the key of the path alone, and the cache drops every variant of the path with it:
+	// reads keyed apart by method, Accept, body, HEAD or query (e.g. ?list=true or KV v2 ?version=2).
+	pathKey := vaultHashKey
+
+	if rule.Method && request.Method != http.MethodHead {
+		vaultHashKey = fmt.Sprintf("%s-%s", vaultHashKey, request.Method)
+	}
+	if rule.Accept {
+		vaultHashKey = fmt.Sprintf("%s-a=%s", vaultHashKey, normalizeAccept(request))
+	}
+	if rule.Body {
+		vaultHashKey = fmt.Sprintf("%s-b=%s", vaultHashKey, hashRequestBody(request))
+	}
+
+	// HEAD responses have no body, key them apart so they can never be served for a GET
+	if request.Method == http.MethodHead {
+		vaultHashKey = fmt.Sprintf("%s-%s", vaultHashKey, request.Method)
+	}
+
+	isRead := request.Method == http.MethodGet || request.Method == http.MethodHead
+	if query := canonicalQuery(request); isRead && query != "" {
+		vaultHashKey = fmt.Sprintf("%s-q=%s", vaultHashKey, query)
+	}
 
 	// Generate MD5 hash from vault token/path/namespace
-	hasher := md5.New()
-	hasher.Write([]byte(vaultHashKey))
-	md5Hex := hex.EncodeToString(hasher.Sum(nil))
+	return md5Hex(vaultHashKey), md5Hex(pathKey)
+}
 
-	return md5Hex
+func md5Hex(key string) string {
+	hasher := md5.New()
+	hasher.Write([]byte(key))
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// Converts request details into a hashed cache key
-func (h *parseHeader) getMD5HashedLimiterKey(request *http.Request) string {
-	token, _, _ := h.parseVaultRequest(request)
+// Returns the value driving routing affinity: the value of `routingKeyHeader` (ROUTING_KEY_HEADER) when
+// configured and present, otherwise the Vault token
+func getRoutingKey(request *http.Request, routingKeyHeader string) string {
+	if routingKeyHeader != "" {
+		if routingKey := request.Header.Get(routingKeyHeader); routingKey != "" {
+			return routingKey
+		}
+	}
+
+	return getVaultToken(request)
+}
 
-	// Generate MD5 hash from vault token
-	rateLimitingHashKey := fmt.Sprintf("%s-%s-%s", RATELIMITING_HASHING_KEY_PREFIX, token, RATELIMITING_HASHING_KEY_SUFFIX)
+// Converts a token (or other limiter key) into a hashed limiter key
+func (h *parseHeader) getMD5HashedLimiterKey(key string) string {
+	// Generate MD5 hash from the key
+	rateLimitingHashKey := fmt.Sprintf("%s-%s-%s", RATELIMITING_HASHING_KEY_PREFIX, key, RATELIMITING_HASHING_KEY_SUFFIX)
 	hasher := md5.New()
 	hasher.Write([]byte(rateLimitingHashKey))
 	md5Hex := hex.EncodeToString(hasher.Sum(nil))
@@ -110,16 +344,80 @@ func (h *parseHeader) getMD5HashedLimiterKey(request *http.Request) string {
 	return md5Hex
 }
 
+// Returns `true` if all values are identical
+func isSingleValue(values []string) bool {
+	for _, value := range values[1:] {
+		if value != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
 // Parses header to get cache and limiter keys
 func (h *parseHeader) ParseHeaderHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		h.vaultCacheKey = h.getMD5HashedCacheKey(request)
-		h.limiterCacheKey = h.getMD5HashedLimiterKey(request)
-		h.isPathCacheable = h.checkPathCacheable(request.URL.Path)
-		h.isRequestIgnorable = h.checkRequestIgnorable(request.Method)
-		ctx := context.WithValue(request.Context(), parsedHeaderContextKey, h)
-		log.Printf("Headers Parsed: Vault cache key: %s Limiter cache key: %s \n", h.vaultCacheKey, h.limiterCacheKey)
+		// Keying and forwarding must agree on the token and namespace, whatever case the client used
+		canonicalizeHeader(request.Header, VAULT_TOKEN_HEADER)
+		canonicalizeHeader(request.Header, AUTHORIZATION_HEADER)
+		canonicalizeHeader(request.Header, VAULT_NAMESPACE_HEADER)
+
+		// Duplicate namespace headers - key on and forward exactly the one Vault would use
+		if namespaces := request.Header.Values(VAULT_NAMESPACE_HEADER); len(namespaces) > 1 {
+			if !isSingleValue(namespaces) && h.duplicateNamespacePolicy == "reject" {
+				log.Printf("Rejecting request with %d conflicting %s headers", len(namespaces), VAULT_NAMESPACE_HEADER)
+				writeVaultError(writer, http.StatusBadRequest, "multiple conflicting X-Vault-Namespace headers")
+				return
+			}
+			request.Header.Set(VAULT_NAMESPACE_HEADER, namespaces[0])
+		}
+
+		// Forward the resolved token as X-Vault-Token so Vault authenticates the same token we keyed on
+		if token := getVaultToken(request); token != request.Header.Get(VAULT_TOKEN_HEADER) {
+			if request.Header.Get(VAULT_TOKEN_HEADER) != "" {
+				log.Printf("X-Vault-Token and Authorization bearer token disagree, using %s \n", TOKEN_HEADER_PRECEDENCE)
+			}
+			request.Header.Set(VAULT_TOKEN_HEADER, token)
+		}
+
+		parsed := &parsedHeaders{}
+		parsed.vaultCacheKey, parsed.pathCacheKey = h.getMD5HashedCacheKey(request)
+		// Never the client-chosen routing key, which could be rotated for fresh buckets or set to drain another's
+		limiterKey := getVaultToken(request)
+		if identity := GetClientIdentity(request.Context()); RATE_LIMIT_BY_CLIENT_IDENTITY && identity != "" {
+			limiterKey = "identity:" + identity
+		}
+		parsed.limiterCacheKey = h.getMD5HashedLimiterKey(limiterKey)
+		// A response-wrapped request returns a single-use wrapping token, which must never be shared
+		isWrapped := request.Header.Get(VAULT_WRAP_TTL_HEADER) != ""
+		// Entries shared across tokens (CACHE_KEY_RULES Token: false) must never answer a request without one
+		isTokenless := getVaultToken(request) == "" && !h.getCacheKeyRule(h.normalizePath(request.URL.Path)).Token
+		parsed.isPathCacheable = h.checkPathCacheable(request.URL.Path) && h.checkMethodCacheable(request.Method) && !isWrapped && !isTokenless
+		parsed.isRequestIgnorable = h.checkRequestIgnorable(request.Method)
+		tokenHash := h.getMD5HashedLimiterKey(getVaultToken(request))
+		parsed.isCanary = h.checkCanary(tokenHash)
+		if getVaultToken(request) != "" {
+			parsed.tokenKey = tokenHash
+		}
+		requestsTotal.WithLabelValues(namespaceLabel(request.Header.Get(VAULT_NAMESPACE_HEADER))).Inc()
+
+		ctx := context.WithValue(request.Context(), parsedHeaderContextKey, parsed)
+		log.Printf("Headers Parsed: Vault cache key: %s Limiter cache key: %s \n", parsed.vaultCacheKey, parsed.limiterCacheKey)
 
 		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
 }
+
+// Looks up the identity behind the token of cacheable requests, for CACHE_KEY_BY_ENTITY. Placed behind the rate
+// limiter so clients can't make the agent call Vault faster than their limit; the identity keys the token's
+// requests once the lookup completes.
+func (h *parseHeader) EntityLookupHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsPathCacheable()
+		if token := getVaultToken(request); h.entities != nil && isPathCacheable && token != "" {
+			h.entities.lookupIdentity(h.getMD5HashedLimiterKey(token), token, request.Header.Get(VAULT_NAMESPACE_HEADER))
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,276 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckPathCacheable(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/v1/secret/data/foo", true},
+		{"/v1/secret/data", false},
+		{"/v1/secret/data/", false},
+		{"/v1/othersecret/data-like", false},
+		{"/v1/secret/database/foo", false},
+		{"/v1/team-a/secret/data/foo", true},
+		{"/v1/team-a/child/secret/data/foo", true},
+		{"/v1/team-a/secret/data", false},
+		{"/v1/team-a/othersecret/data/foo", false},
+	} {
+		if got := parseHeader.checkPathCacheable(tc.path); got != tc.want {
+			t.Errorf("checkPathCacheable(%s) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestWrappingIsUnderNeverCacheableInAnyNamespace(t *testing.T) {
+	for _, path := range []string{"/v1/sys/wrapping/unwrap", "/v1/team-a/sys/wrapping/unwrap", "/v1/team-a/child/sys/wrapping/lookup"} {
+		if !isUnderSubpath(path, NEVER_CACHEABLE_SUBPATHS[0], true) {
+			t.Errorf("%s is not under %s", path, NEVER_CACHEABLE_SUBPATHS[0])
+		}
+	}
+	if isUnderSubpath("/v1/team-a/sys/wrappingkey", NEVER_CACHEABLE_SUBPATHS[0], true) {
+		t.Errorf("/v1/team-a/sys/wrappingkey is under %s", NEVER_CACHEABLE_SUBPATHS[0])
+	}
+}
+
+func TestUnwrapIsNeverCachedUnderACacheablePrefix(t *testing.T) {
+	defer func(subpaths [len(CACHEABLE_SUBPATHS)]string) { CACHEABLE_SUBPATHS = subpaths }(CACHEABLE_SUBPATHS)
+	CACHEABLE_SUBPATHS[0] = "/v1/sys"
+	var fetches int32
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+
+	for _, tc := range []struct {
+		path        string
+		wrapTtl     string
+		wantFetches int32
+	}{
+		{"/v1/sys/wrapping/unwrap", "", 3},
+		{"/v1/team-a/sys/wrapping/unwrap", "", 3},
+		{"/v1/sys/mounts/secret", "5m", 3},
+		{"/v1/sys/mounts/secret", "", 1},
+	} {
+		atomic.StoreInt32(&fetches, 0)
+		request := newTestRequest(http.MethodGet, tc.path, "172.16.0.1:1234", "token")
+		if tc.wrapTtl != "" {
+			request.Header.Set(VAULT_WRAP_TTL_HEADER, tc.wrapTtl)
+		}
+		if statuses := serveTimes(chain, request, 3); countStatus(statuses, http.StatusOK) != 3 {
+			t.Fatalf("%s: got statuses %v", tc.path, statuses)
+		}
+		if fetches := atomic.LoadInt32(&fetches); fetches != tc.wantFetches {
+			t.Errorf("%s with wrap TTL %q: got %d fetches from Vault for 3 reads, want %d", tc.path, tc.wrapTtl, fetches, tc.wantFetches)
+		}
+	}
+}
+
+func TestBearerOnlyRequestIsKeyedOnItsToken(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	bearer := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "")
+	bearer.Header.Set(AUTHORIZATION_HEADER, "Bearer token-a")
+
+	forwarded := parsedRequest(parseHeader, bearer)
+	if token := forwarded.Header.Get(VAULT_TOKEN_HEADER); token != "token-a" {
+		t.Errorf("bearer token was forwarded as %s %q, want %q", VAULT_TOKEN_HEADER, token, "token-a")
+	}
+
+	parsed := parseRequest(parseHeader, bearer)
+	same := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+	other := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-b"))
+	if !parsed.IsPathCacheable() {
+		t.Error("bearer-only read is not cacheable")
+	}
+	if parsed.GetVaultCacheKey() != same.GetVaultCacheKey() || parsed.GetLimiterCacheKey() != same.GetLimiterCacheKey() {
+		t.Error("bearer-only request is keyed differently from the same token in X-Vault-Token")
+	}
+	if parsed.GetVaultCacheKey() == other.GetVaultCacheKey() || parsed.GetLimiterCacheKey() == other.GetLimiterCacheKey() {
+		t.Error("bearer-only request shares its keys with another token")
+	}
+}
+
+func TestDisagreeingTokenHeadersFollowPrecedence(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a")
+	request.Header.Set(AUTHORIZATION_HEADER, "Bearer token-b")
+
+	parsed := parseRequest(parseHeader, request)
+	want := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+	if parsed.GetVaultCacheKey() != want.GetVaultCacheKey() || parsed.GetLimiterCacheKey() != want.GetLimiterCacheKey() {
+		t.Errorf("request was not keyed on the %s token", TOKEN_HEADER_PRECEDENCE)
+	}
+	if token := parsedRequest(parseHeader, request).Header.Get(VAULT_TOKEN_HEADER); token != "token-a" {
+		t.Errorf("forwarded %s %q, want the %s token %q", VAULT_TOKEN_HEADER, token, TOKEN_HEADER_PRECEDENCE, "token-a")
+	}
+}
+
+func TestTrailingSlashFormsShareAnEntryWhenNormalized(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	keys := func() (string, string) {
+		bare := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		slashed := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo//", "172.16.0.1:1234", "token"))
+		return bare.GetVaultCacheKey(), slashed.GetVaultCacheKey()
+	}
+
+	if bare, slashed := keys(); !NORMALIZE_TRAILING_SLASH && bare == slashed {
+		t.Error("trailing slash forms share an entry with NORMALIZE_TRAILING_SLASH off")
+	}
+
+	parseHeader.normalizeTrailingSlash = true
+	if bare, slashed := keys(); bare != slashed {
+		t.Error("trailing slash forms are keyed apart with NORMALIZE_TRAILING_SLASH on")
+	}
+	if parseHeader.checkPathCacheable("/v1/secret/data/") {
+		t.Error("/v1/secret/data/ became cacheable once normalized")
+	}
+	if !parseHeader.checkPathCacheable("/v1/secret/data/foo/") {
+		t.Error("/v1/secret/data/foo/ is not cacheable once normalized")
+	}
+}
+
+func TestNamespaceMetricLabelsAreBounded(t *testing.T) {
+	defer func(allowlist [len(METRIC_NAMESPACE_ALLOWLIST)]string) { METRIC_NAMESPACE_ALLOWLIST = allowlist }(METRIC_NAMESPACE_ALLOWLIST)
+	METRIC_NAMESPACE_ALLOWLIST[0] = "team-a"
+	parseHeader := NewParseHeader(newTestConfig(t))
+
+	before := map[string]float64{}
+	for _, label := range []string{"team-a", "team-b", "team-c", "other"} {
+		before[label] = testutil.ToFloat64(requestsTotal.WithLabelValues(label))
+	}
+	for _, namespace := range []string{"team-a", "/team-a/", "team-b", "team-c"} {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+		request.Header.Set(VAULT_NAMESPACE_HEADER, namespace)
+		parseRequest(parseHeader, request)
+	}
+
+	for label, want := range map[string]float64{"team-a": 2, "team-b": 0, "team-c": 0, "other": 2} {
+		if got := testutil.ToFloat64(requestsTotal.WithLabelValues(label)) - before[label]; got != want {
+			t.Errorf("got %v requests labeled %q, want %v", got, label, want)
+		}
+	}
+}
+
+func TestMixedCaseTokenHeaderIsKeyedAndForwarded(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	canonical := parseRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token-a"))
+
+	for _, name := range []string{"x-vault-token", "X-VAULT-TOKEN", "x-Vault-tOKEN"} {
+		// Set by direct map access, as a client library or middleware might, bypassing canonicalization
+		newMixedCaseRequest := func() *http.Request {
+			request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "")
+			request.Header[name] = []string{"token-a"}
+			return request
+		}
+
+		parsed := parseRequest(parseHeader, newMixedCaseRequest())
+		if parsed.GetVaultCacheKey() != canonical.GetVaultCacheKey() || parsed.GetLimiterCacheKey() != canonical.GetLimiterCacheKey() {
+			t.Errorf("token in %s is keyed differently from %s", name, VAULT_TOKEN_HEADER)
+		}
+		if !parsed.IsPathCacheable() {
+			t.Errorf("read with the token in %s is treated as tokenless", name)
+		}
+
+		forwarded := parsedRequest(parseHeader, newMixedCaseRequest())
+		if tokens := forwarded.Header.Values(VAULT_TOKEN_HEADER); len(tokens) != 1 || tokens[0] != "token-a" {
+			t.Errorf("token in %s was forwarded as %s %q", name, VAULT_TOKEN_HEADER, tokens)
+		}
+		if _, isLeft := forwarded.Header[name]; isLeft {
+			t.Errorf("non-canonical %s header is forwarded alongside %s", name, VAULT_TOKEN_HEADER)
+		}
+	}
+}
+
+func TestDuplicateNamespaceHeaders(t *testing.T) {
+	newDuplicateRequest := func(namespaces ...string) *http.Request {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+		request.Header[VAULT_NAMESPACE_HEADER] = namespaces
+		return request
+	}
+
+	// "first" keys on and forwards only the namespace Vault reads
+	parseHeader := NewParseHeader(newTestConfig(t))
+	parseHeader.duplicateNamespacePolicy = "first"
+	first := parseRequest(parseHeader, newDuplicateRequest("team-a"))
+	if duplicate := parseRequest(parseHeader, newDuplicateRequest("team-a", "team-b")); duplicate.GetVaultCacheKey() != first.GetVaultCacheKey() {
+		t.Error("duplicate namespaces are not keyed on the first one")
+	}
+	if namespaces := parsedRequest(parseHeader, newDuplicateRequest("team-a", "team-b")).Header.Values(VAULT_NAMESPACE_HEADER); len(namespaces) != 1 || namespaces[0] != "team-a" {
+		t.Errorf("duplicate namespaces were forwarded as %q, want just the first", namespaces)
+	}
+
+	// "reject" answers 400 for conflicting namespaces, identical ones are collapsed
+	parseHeader.duplicateNamespacePolicy = "reject"
+	var forwarded []string
+	handler := parseHeader.ParseHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		forwarded = request.Header.Values(VAULT_NAMESPACE_HEADER)
+	}))
+	if statuses := serveTimes(handler, newDuplicateRequest("team-a", "team-b"), 1); statuses[0] != http.StatusBadRequest || forwarded != nil {
+		t.Errorf("got status %d for conflicting namespaces, want %d without forwarding", statuses[0], http.StatusBadRequest)
+	}
+	if statuses := serveTimes(handler, newDuplicateRequest("team-a", "team-a"), 1); statuses[0] != http.StatusOK || len(forwarded) != 1 {
+		t.Errorf("got status %d and namespaces %q for identical namespaces, want them collapsed into one", statuses[0], forwarded)
+	}
+}
+
+func TestConcurrentMixedRequestsKeepTheirOwnParsedValues(t *testing.T) {
+	parseHeader := NewParseHeader(newTestConfig(t))
+	newRequest := func(method string, path int) *http.Request {
+		return newTestRequest(method, fmt.Sprintf("/v1/secret/data/path-%d", path), "172.16.0.1:1234", fmt.Sprintf("token-%d", path))
+	}
+
+	// Keys each request should get, parsed one at a time
+	const paths = 10
+	wantKeys := make(map[string]string, 2*paths)
+	for path := 0; path < paths; path++ {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			wantKeys[fmt.Sprintf("%s %d", method, path)] = parseRequest(parseHeader, newRequest(method, path)).GetVaultCacheKey()
+		}
+	}
+
+	var misparsed int32
+	handler := parseHeader.ParseHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// Give other requests a chance to be parsed while this one is in flight
+		runtime.Gosched()
+		parsed := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders)
+		var path int
+		fmt.Sscanf(request.URL.Path, "/v1/secret/data/path-%d", &path)
+		isRead := request.Method == http.MethodGet
+		if parsed.GetVaultCacheKey() != wantKeys[fmt.Sprintf("%s %d", request.Method, path)] || !parsed.IsPathCacheable() || parsed.IsRequestIgnorable() == isRead {
+			atomic.AddInt32(&misparsed, 1)
+		}
+	}))
+
+	var wg sync.WaitGroup
+	for client := 0; client < 20; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				method := http.MethodGet
+				if (client+i)%2 == 1 {
+					method = http.MethodPost
+				}
+				handler.ServeHTTP(httptest.NewRecorder(), newRequest(method, (client*7+i)%paths))
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if misparsed != 0 {
+		t.Errorf("%d of 2000 concurrent requests saw another request's parsed values", misparsed)
+	}
+}
@@ -0,0 +1,71 @@
+package vault_proxy
+
+import (
+	"time"
+)
+
+// Write state of a cache key, used to keep reads from caching pre-write data while a write is in flight
+type writeState struct {
+	pending   int   // writes currently in flight for the key
+	lastWrite int64 // Millis since epoch a write for the key last started or finished
+}
+
+// Marks a write for the key as in flight and invalidates its cached entry.
+// Reads for the key skip the cache until the matching endWrite.
+func (c *vaultCache) beginWrite(key string) {
+	c.writesLock.Lock()
+	state, exists := c.writes[key]
+	if !exists {
+		state = &writeState{}
+		c.writes[key] = state
+	}
+	state.pending++
+	state.lastWrite = time.Now().UnixMilli()
+	c.writesLock.Unlock()
+
+	c.removeFromCache(key)
+}
+
+// Marks a write for the key as finished and invalidates anything cached while it was in flight
+func (c *vaultCache) endWrite(key string) {
+	c.writesLock.Lock()
+	if state, exists := c.writes[key]; exists {
+		state.pending--
+		state.lastWrite = time.Now().UnixMilli()
+	}
+	c.writesLock.Unlock()
+
+	c.removeFromCache(key)
+}
+
+// Returns `true` if a write for the key is in flight
+func (c *vaultCache) isWriteInFlight(key string) bool {
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+
+	state, exists := c.writes[key]
+	return exists && state.pending > 0
+}
+
+// Returns `true` if a write for the key was in flight at any point since `since` (millis since epoch),
+// meaning a response fetched since then may predate the write.
+func (c *vaultCache) writtenSince(key string, since int64) bool {
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+
+	state, exists := c.writes[key]
+	return exists && (state.pending > 0 || state.lastWrite >= since)
+}
+
+// Forgets finished writes older than any in-flight read could be (ProxyRequestTimeout)
+func (c *vaultCache) purgeFinishedWrites() {
+	c.writesLock.Lock()
+	defer c.writesLock.Unlock()
+
+	cutoff := time.Now().UnixMilli() - int64(c.config.ProxyRequestTimeout)*1000
+	for key, state := range c.writes {
+		if state.pending <= 0 && state.lastWrite < cutoff {
+			delete(c.writes, key)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package vault_proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadOverlappingSlowWriteIsNotCached(t *testing.T) {
+	var value atomic.Value
+	value.Store("old")
+	var holdReads int32
+	writeStarted, releaseWrite := make(chan struct{}), make(chan struct{})
+	readStarted, releaseRead := make(chan struct{}), make(chan struct{})
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodPost {
+			close(writeStarted)
+			<-releaseWrite
+			value.Store("new")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Vault reads the value as it is when the request arrives, however late it answers
+		current := value.Load().(string)
+		if atomic.CompareAndSwapInt32(&holdReads, 1, 0) {
+			close(readStarted)
+			<-releaseRead
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"data":{"value":"`+current+`"}}`)
+	})
+	serve := func(method string) string {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		return recorder.Body.String()
+	}
+
+	if body := serve(http.MethodGet); body != `{"data":{"value":"old"}}` {
+		t.Fatalf("first read got %q", body)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		serve(http.MethodPost)
+	}()
+	<-writeStarted
+
+	// A read sent while the write is in flight, answered with the old value only after the write finished
+	atomic.StoreInt32(&holdReads, 1)
+	go func() {
+		defer wg.Done()
+		if body := serve(http.MethodGet); body != `{"data":{"value":"old"}}` {
+			t.Errorf("read during the write was served %q, want the value Vault answered with", body)
+		}
+	}()
+	<-readStarted
+	close(releaseWrite)
+	time.Sleep(20 * time.Millisecond)
+	close(releaseRead)
+	wg.Wait()
+
+	if body := serve(http.MethodGet); body != `{"data":{"value":"new"}}` {
+		t.Errorf("read after the write got %q, want the written value", body)
+	}
+}
@@ -0,0 +1,57 @@
+package vault_proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// Filters the proxy's own control headers (e.g. BURST_OVERRIDE_HEADER) out of requests from peers that may not
+// set them. Only the agent a client connects to vets them: agents forward every client header, so a peer agent's
+// request carries what its first hop let through and is passed on as is.
+// AGENT_FORWARDED_HEADER is never dropped: it only ever keeps a request on the agent it reached, so a forged one
+// grants nothing, and loop prevention must work without AGENT_PEER_CIDRS.
+type proxyHeaderFilter struct {
+	agentPeers         []*net.IPNet // AGENT_PEER_CIDRS
+	burstOverridePeers []*net.IPNet // BURST_OVERRIDE_TRUSTED_CIDRS
+	routeOverridePeers []*net.IPNet // ROUTE_OVERRIDE_TRUSTED_CIDRS
+}
+
+// Should ALWAYS be used as the "constructor" for the proxyHeaderFilter.
+func NewProxyHeaderFilter(agentPeerCIDRs []string, burstOverrideCIDRs []string, routeOverrideCIDRs []string) *proxyHeaderFilter {
+	return &proxyHeaderFilter{
+		agentPeers:         parseCIDRs(agentPeerCIDRs, "agent peer"),
+		burstOverridePeers: parseCIDRs(burstOverrideCIDRs, "burst override trusted"),
+		routeOverridePeers: parseCIDRs(routeOverrideCIDRs, "route override trusted"),
+	}
+}
+
+// Returns `true` if the request comes from another agent: from `agentPeers` (AGENT_PEER_CIDRS) or with a
+// verified certificate of one of the TRUSTED_AGENT_IDENTITIES
+func isPeerAgent(request *http.Request, agentPeers []*net.IPNet) bool {
+	return isPeerInNetworks(request, agentPeers) || isTrustedAgentIdentity(certificateIdentity(request))
+}
+
+// Removes the header if the request has it, logging why
+func dropProxyHeader(request *http.Request, name string) {
+	if request.Header.Get(name) != "" {
+		log.Printf("Ignoring %s from untrusted peer %s", name, request.RemoteAddr)
+		request.Header.Del(name)
+	}
+}
+
+// Drops control headers the immediate peer isn't trusted with, before anything routes or rate-limits on them
+func (f *proxyHeaderFilter) ProxyHeaderHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !isPeerAgent(request, f.agentPeers) {
+			if !isPeerInNetworks(request, f.burstOverridePeers) {
+				dropProxyHeader(request, BURST_OVERRIDE_HEADER)
+			}
+			if !isPeerInNetworks(request, f.routeOverridePeers) {
+				dropProxyHeader(request, ROUTE_NODE_HEADER)
+			}
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,81 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Returns the header filter, header parsing and rate limiting in front of an always-200 upstream, with burst
+// overrides up to `burstOverrideMax` trusted from 10.0.0.0/8 and agents in 192.168.0.0/16
+func newBurstOverrideChain(t *testing.T, burstOverrideMax int) http.Handler {
+	config := newTestConfig(t)
+	filter := NewProxyHeaderFilter([]string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}, nil)
+	limiter := NewTokenRateLimiter(config, NewVaultCache(config))
+	limiter.burstOverrideMax = burstOverrideMax
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+	return filter.ProxyHeaderHandler(NewParseHeader(config).ParseHeaderHandler(limiter.RateLimitHandler(upstream)))
+}
+
+func TestBurstOverride(t *testing.T) {
+	// Without an override the per-second limiter only lets one request through at once
+	const requests, baseline = 10, 1
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		wantOk     int
+	}{
+		{"no header", "10.0.0.1:1234", "", baseline},
+		{"trusted peer", "10.0.0.1:1234", "5", 5},
+		{"trusted peer clamped to max", "10.0.0.1:1234", "1000", 8},
+		{"untrusted peer", "172.16.0.1:1234", "5", baseline},
+		{"malformed", "10.0.0.1:1234", "lots", baseline},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := newBurstOverrideChain(t, 8)
+			request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", test.remoteAddr, "token-"+test.name)
+			if test.header != "" {
+				request.Header.Set(BURST_OVERRIDE_HEADER, test.header)
+			}
+
+			if ok := countStatus(serveTimes(chain, request, requests), http.StatusOK); ok != test.wantOk {
+				t.Errorf("got %d requests allowed, want %d", ok, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestBurstOverrideRoutedThroughAgent(t *testing.T) {
+	filter := NewProxyHeaderFilter([]string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}, nil)
+	var forwarded http.Header
+	firstHop := filter.ProxyHeaderHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		forwarded = request.Header.Clone()
+	}))
+
+	// An untrusted client loses the header at the agent it connects to, so the owning agent never sees it
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	request.Header.Set(BURST_OVERRIDE_HEADER, "10")
+	serveTimes(firstHop, request, 1)
+	if forwarded.Get(BURST_OVERRIDE_HEADER) != "" {
+		t.Fatalf("first hop let %s of an untrusted client through", BURST_OVERRIDE_HEADER)
+	}
+
+	// A trusted client's header is kept by the first hop and honored on the owning agent, which only sees the peer agent
+	request = newTestRequest(http.MethodGet, "/v1/secret/data/foo", "10.0.0.1:1234", "token")
+	request.Header.Set(BURST_OVERRIDE_HEADER, "10")
+	serveTimes(firstHop, request, 1)
+	if forwarded.Get(BURST_OVERRIDE_HEADER) != "10" {
+		t.Fatalf("first hop dropped %s of a trusted client", BURST_OVERRIDE_HEADER)
+	}
+
+	routed := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "192.168.0.2:1234", "token")
+	routed.Header = forwarded
+	if ok := countStatus(serveTimes(newBurstOverrideChain(t, 10), routed, 10), http.StatusOK); ok != 10 {
+		t.Errorf("got %d routed requests allowed, want 10", ok)
+	}
+}
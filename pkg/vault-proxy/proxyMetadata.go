@@ -0,0 +1,139 @@
+package vault_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const proxyMetadataContextKey contextKey = "proxyMetadata"
+
+// Debugging details about how the proxy served a request, injected as `_proxy` into JSON response bodies
+type proxyMetadata struct {
+	Cache      string `json:"cache"`                 // "hit", "miss", "forwarded" or "bypass"
+	Node       string `json:"node"`                  // Agent that served the request
+	AgeSeconds *int64 `json:"age_seconds,omitempty"` // Age of the cached entry, only on hits
+}
+
+// Proxy Metadata
+type proxyMetadataInjector struct {
+	node       string
+	adminToken string
+	enabled    bool // INJECT_PROXY_METADATA
+}
+
+// Should ALWAYS be used as the "constructor" for the proxyMetadataInjector.
+func NewProxyMetadataInjector(config Config, proxyAddress string) *proxyMetadataInjector {
+	return &proxyMetadataInjector{node: proxyAddress, adminToken: config.AdminToken, enabled: INJECT_PROXY_METADATA}
+}
+
+// Returns the metadata being collected for the request, nil unless it asked for debug metadata
+func getProxyMetadata(ctx context.Context) *proxyMetadata {
+	metadata, _ := ctx.Value(proxyMetadataContextKey).(*proxyMetadata)
+	return metadata
+}
+
+// Records how the request was served, if it is collecting debug metadata
+func setProxyMetadataCache(request *http.Request, cache string, node string) {
+	if metadata := getProxyMetadata(request.Context()); metadata != nil {
+		metadata.Cache = cache
+		if node != "" {
+			metadata.Node = node
+		}
+	}
+}
+
+// Buffers the response so it can be rewritten once the rest of the chain is done with it
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// Returns the body with `metadata` added as its top-level `_proxy` field, or `false` if the body
+// is not a JSON object or already carries `_proxy` (e.g. injected by the agent it was forwarded to).
+func injectProxyMetadata(body []byte, metadata *proxyMetadata) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+	if _, exists := fields["_proxy"]; exists {
+		return nil, false
+	}
+
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, false
+	}
+	fields["_proxy"] = encoded
+
+	rewritten, err := json.Marshal(fields)
+	return rewritten, err == nil
+}
+
+// Returns `true` for uncompressed JSON responses
+func isRewritableJson(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// Injects `_proxy` metadata into JSON responses when INJECT_PROXY_METADATA is enabled and the request
+// carries a valid admin token. The admin token header is stripped so it is never forwarded to Vault or agents.
+func (i *proxyMetadataInjector) ProxyMetadataHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !i.enabled || request.Header.Get(ADMIN_TOKEN_HEADER) == "" {
+			request.Header.Del(ADMIN_TOKEN_HEADER)
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		isAuthorized := isAdminAuthorized(request, i.adminToken)
+		request.Header.Del(ADMIN_TOKEN_HEADER)
+		if !isAuthorized {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		metadata := &proxyMetadata{Cache: "bypass", Node: i.node}
+		buffered := &bufferedResponseWriter{header: writer.Header()}
+		next.ServeHTTP(buffered, request.WithContext(context.WithValue(request.Context(), proxyMetadataContextKey, metadata)))
+
+		body := buffered.body.Bytes()
+		if isRewritableJson(buffered.header) {
+			if rewritten, ok := injectProxyMetadata(body, metadata); ok {
+				body = rewritten
+				buffered.header.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+
+		if buffered.statusCode == 0 {
+			buffered.statusCode = http.StatusOK
+		}
+		writer.WriteHeader(buffered.statusCode)
+		writer.Write(body)
+	})
+}
@@ -0,0 +1,59 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestInjectedMetadataKeepsTheBodyValidJson(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get(ADMIN_TOKEN_HEADER) != "" {
+			t.Error("the admin token was forwarded to Vault")
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	injector := NewProxyMetadataInjector(config, "127.0.0.1:7444")
+	injector.enabled = true
+	chain := NewParseHeader(config).ParseHeaderHandler(injector.ProxyMetadataHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy))))
+
+	for _, want := range []string{"miss", "hit"} {
+		request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+		request.Header.Set(ADMIN_TOKEN_HEADER, "admin-secret")
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, request)
+		body := recorder.Body.String()
+
+		var parsed struct {
+			Data  map[string]string `json:"data"`
+			Proxy *proxyMetadata    `json:"_proxy"`
+		}
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+			t.Fatalf("%s: rewritten body %q is not valid JSON: %v", want, body, err)
+		}
+		if parsed.Data["value"] != "secret" {
+			t.Errorf("%s: got data %v, want Vault's data untouched", want, parsed.Data)
+		}
+		if parsed.Proxy == nil || parsed.Proxy.Cache != want || parsed.Proxy.Node != "127.0.0.1:7444" || (want == "hit") != (parsed.Proxy.AgeSeconds != nil) {
+			t.Errorf("%s: got _proxy %+v, want cache %s from 127.0.0.1:7444", want, parsed.Proxy, want)
+		}
+		if contentLength := recorder.Header().Get("Content-Length"); contentLength != strconv.Itoa(len(body)) {
+			t.Errorf("%s: got Content-Length %s for a %d byte body", want, contentLength, len(body))
+		}
+	}
+
+	// Without the admin token the body is Vault's
+	recorder := httptest.NewRecorder()
+	chain.ServeHTTP(recorder, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if body := recorder.Body.String(); body != `{"data":{"value":"secret"}}` {
+		t.Errorf("got body %q without the admin token, want no metadata", body)
+	}
+}
@@ -2,10 +2,12 @@ package vault_proxy
 
 import (
 	"context"
-	"io"
 	"log"
+	"math"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,17 +19,34 @@ type RateLimiter interface {
 	Allow() bool
 	Wait(context.Context) error
 	Limit() rate.Limit
+	Tokens() float64
+	Burst() int
+}
+
+// Limits of a namespace in NAMESPACE_RATE_LIMITS, enforced next to BURST_LIMIT_PER_SECOND, RATE_LIMIT_PER_MINUTE
+// and RATE_LIMITER_BUCKET_SIZE for the tokens using it
+type NamespaceRateLimit struct {
+	BurstLimitPerSecond int
+	RateLimitPerMinute  int
+	BucketSize          int
 }
 
 type multiLimiter struct {
-	limiters []RateLimiter
+	limiters  []RateLimiter
+	perMinute int // Sustained limit reported in X-RateLimit-Limit
+
+	// Burst override - while active, replaces the limiters with one of the slowest rate but a bigger bucket
+	overrideLock  sync.Mutex
+	override      *rate.Limiter
+	overrideUntil int64 // Millis since epoch
 }
 
 // Visitor struct which holds the rate limiter for each
-// visitor and the last time that it was used.
+// visitor, the last time that it was used and when it was created.
 type visitor struct {
 	limiter  *multiLimiter
 	lastUsed int64
+	created  int64
 }
 
 // Token Rate Limiter
@@ -37,20 +56,75 @@ type tokenRateLimiter struct {
 	burstLimitPerSec      int
 	rateLimitPerMin       int
 	rateLimiterBucketSize int
-	lastRateLimiterPurge  int64 // Millis since epoch of last RateLimiter purge; Used by purgeTokenLimiters()
-	vaultCache            *vaultCache
+	burstOverrideMax      int               // BURST_OVERRIDE_MAX
+	limitByNamespace      bool              // RATE_LIMIT_BY_NAMESPACE
+	backend               string            // RATE_LIMITER_BACKEND
+	backendByPath         map[string]string // RATE_LIMITER_BACKEND_BY_PATH
+	redis                 *redisBackend     // nil unless RATE_LIMITER_BACKEND or a RATE_LIMITER_BACKEND_BY_PATH entry is "redis"
+	lastRateLimiterPurge  int64             // Millis since epoch of last RateLimiter purge; Used by purgeTokenLimiters()
+	vaultCache            Cache
+	config                Config
+
+	// Purge accounting, guarded by lock
+	lruPurges    int64
+	expiryPurges int64
+	evictedTotal int64
+}
+
+// Occupancy of the rate-limiters cache, e.g. to tune RateLimiterCacheSize
+type limiterCacheStats struct {
+	Size         int   `json:"size"`
+	Capacity     int   `json:"capacity"`
+	LruPurges    int64 `json:"lru_purges"`
+	ExpiryPurges int64 `json:"expiry_purges"`
+	Evicted      int64 `json:"evicted"`
 }
 
 // Should ALWAYS be used as the "constructor" for the tokenRateLimiter. Initializes rate-limiting.
-func NewTokenRateLimiter(burstPerSec int, ratePerMin int, limiterBucketSize int, cache *vaultCache) *tokenRateLimiter {
+func NewTokenRateLimiter(config Config, cache Cache) *tokenRateLimiter {
+	rateLimiterCacheCapacity.Set(float64(config.RateLimiterCacheSize))
+	usesRedis := false
+	switch config.RateLimiterBackend {
+	case "memory":
+	case "redis":
+		usesRedis = true
+	default:
+		log.Fatalf("Invalid RATE_LIMITER_BACKEND %q: must be \"memory\" or \"redis\"", config.RateLimiterBackend)
+	}
+	for subpath, pathBackend := range RATE_LIMITER_BACKEND_BY_PATH {
+		switch pathBackend {
+		case "memory":
+		case "redis":
+			usesRedis = true
+		default:
+			log.Fatalf("Invalid RATE_LIMITER_BACKEND_BY_PATH entry for '%s': %q must be \"memory\" or \"redis\"", subpath, pathBackend)
+		}
+	}
+	var backend *redisBackend
+	if usesRedis {
+		backend = newRedisBackend(config)
+	}
+
+	for namespace, limits := range NAMESPACE_RATE_LIMITS {
+		if limits.BurstLimitPerSecond <= 0 || limits.RateLimitPerMinute <= 0 || limits.BucketSize <= 0 {
+			log.Fatalf("Invalid NAMESPACE_RATE_LIMITS entry for namespace '%s': all limits must be positive", namespace)
+		}
+	}
+
 	return &tokenRateLimiter{
 		limiterCache:          make(map[string]*visitor),
 		lock:                  &sync.RWMutex{},
-		burstLimitPerSec:      burstPerSec,
-		rateLimitPerMin:       ratePerMin,
-		rateLimiterBucketSize: limiterBucketSize,
+		burstLimitPerSec:      config.BurstLimitPerSecond,
+		rateLimitPerMin:       config.RateLimitPerMinute,
+		rateLimiterBucketSize: config.RateLimiterBucketSize,
+		burstOverrideMax:      BURST_OVERRIDE_MAX,
+		limitByNamespace:      RATE_LIMIT_BY_NAMESPACE,
+		backend:               config.RateLimiterBackend,
+		backendByPath:         RATE_LIMITER_BACKEND_BY_PATH,
+		redis:                 backend,
 		lastRateLimiterPurge:  time.Now().UnixMilli(),
 		vaultCache:            cache,
+		config:                config,
 	}
 }
 
@@ -66,6 +140,10 @@ func MultiLimiter(limiters ...RateLimiter) *multiLimiter {
 
 // Consumes token and returns immedietly
 func (l *multiLimiter) Allow() bool {
+	if override := l.getOverride(); override != nil {
+		return override.Allow()
+	}
+
 	for _, l := range l.limiters {
 		if !l.Allow() {
 			return false
@@ -76,6 +154,10 @@ func (l *multiLimiter) Allow() bool {
 
 // Consumes token and waits if the token is not present for use
 func (l *multiLimiter) Wait(ctx context.Context) error {
+	if override := l.getOverride(); override != nil {
+		return override.Wait(ctx)
+	}
+
 	for _, l := range l.limiters {
 		if err := l.Wait(ctx); err != nil {
 			return err
@@ -88,15 +170,108 @@ func (l *multiLimiter) Limit() rate.Limit {
 	return l.limiters[0].Limit()
 }
 
+// Returns the active burst override limiter, or nil once it has expired
+func (l *multiLimiter) getOverride() *rate.Limiter {
+	l.overrideLock.Lock()
+	defer l.overrideLock.Unlock()
+
+	if l.override != nil && time.Now().UnixMilli() >= l.overrideUntil {
+		l.override = nil
+	}
+	return l.override
+}
+
+// Lets up to `burst` requests through at once until `until` (millis since epoch), refilling at the slowest
+// limiter's rate so the sustained rate is unchanged. An active override of at least `burst` is only extended,
+// so repeating the header can't refill the bucket.
+func (l *multiLimiter) elevateBurst(burst int, until int64) {
+	l.overrideLock.Lock()
+	defer l.overrideLock.Unlock()
+
+	if l.override == nil || time.Now().UnixMilli() >= l.overrideUntil || l.override.Burst() < burst {
+		l.override = rate.NewLimiter(l.Limit(), burst)
+	}
+	l.overrideUntil = until
+}
+
+// Returns the limiter currently allowing the fewest requests - the burst override while one is active
+func (l *multiLimiter) mostConstraining() RateLimiter {
+	if override := l.getOverride(); override != nil {
+		return override
+	}
+
+	constraining := l.limiters[0]
+	for _, limiter := range l.limiters[1:] {
+		if limiter.Tokens() < constraining.Tokens() {
+			constraining = limiter
+		}
+	}
+	return constraining
+}
+
+// Sets X-RateLimit-Limit (the per-minute limit), X-RateLimit-Remaining (requests the most constraining
+// limiter would allow right now) and X-RateLimit-Reset (seconds until its bucket is full again) so clients can self-throttle
+func (l *tokenRateLimiter) setRateLimitHeaders(header http.Header, limiter *multiLimiter) {
+	constraining := limiter.mostConstraining()
+	tokens := constraining.Tokens()
+
+	remaining := int(math.Floor(tokens))
+	if remaining < 0 {
+		remaining = 0
+	}
+	reset := 0
+	if missing := float64(constraining.Burst()) - tokens; missing > 0 && constraining.Limit() > 0 {
+		reset = int(math.Ceil(missing / float64(constraining.Limit())))
+	}
+
+	header.Set("X-RateLimit-Limit", strconv.Itoa(limiter.perMinute))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(reset))
+}
+
+// Returns how long until every limiter has a token again, in whole seconds between 1 and RATE_LIMIT_RETRY_AFTER_MAX.
+// Computed from the tokens left, so no token is consumed.
+func (l *multiLimiter) RetryAfter() int {
+	limiters := l.limiters
+	if override := l.getOverride(); override != nil {
+		limiters = []RateLimiter{override}
+	}
+
+	delay := 0.0
+	for _, limiter := range limiters {
+		if limiter.Burst() <= 0 || limiter.Limit() <= 0 {
+			// The limiter can never grant a token, e.g. a zero bucket size
+			return RATE_LIMIT_RETRY_AFTER_MAX
+		}
+		if d := (1 - limiter.Tokens()) / float64(limiter.Limit()); d > delay {
+			delay = d
+		}
+	}
+
+	seconds := int(math.Ceil(delay))
+	if seconds < 1 {
+		return 1
+	}
+	if seconds > RATE_LIMIT_RETRY_AFTER_MAX {
+		return RATE_LIMIT_RETRY_AFTER_MAX
+	}
+	return seconds
+}
+
+// Returns `true` once the visitor's limiter has outlived RateLimiterMaxLifetime and must be recreated
+func (l *tokenRateLimiter) isPastMaxLifetime(v *visitor) bool {
+	return l.config.RateLimiterMaxLifetime > 0 && time.Now().UnixMilli()-v.created > int64(l.config.RateLimiterMaxLifetime)*1000
+}
+
 // getFromLimiterCache returns the rate limiter for the provided token if it exists.
-// Otherwise calls setInLimiterCache to add token to the map
-func (l *tokenRateLimiter) getFromLimiterCache(token string) *multiLimiter {
+// Otherwise (or once it outlived RateLimiterMaxLifetime) calls setInLimiterCache to add token to the map
+func (l *tokenRateLimiter) getFromLimiterCache(token string, limits NamespaceRateLimit, backend string) *multiLimiter {
 	l.lock.RLock()
 
 	visitor, exists := l.limiterCache[token]
-	if !exists {
+	if !exists || l.isPastMaxLifetime(visitor) {
 		l.lock.RUnlock()
-		return l.setInLimiterCache(token)
+		return l.setInLimiterCache(token, limits, backend)
 	}
 	visitor.lastUsed = time.Now().UnixMilli()
 	l.lock.RUnlock()
@@ -104,30 +279,108 @@ func (l *tokenRateLimiter) getFromLimiterCache(token string) *multiLimiter {
 	return visitor.limiter
 }
 
-// setInLimiterCache creates a new rate limiter and adds it to the limiterCache map,
+// Returns the global limits every token is held to
+func (l *tokenRateLimiter) getTokenRateLimit() NamespaceRateLimit {
+	return NamespaceRateLimit{l.burstLimitPerSec, l.rateLimitPerMin, l.rateLimiterBucketSize}
+}
+
+// Returns the limiter of the token within the namespace if RATE_LIMIT_BY_NAMESPACE is set and the namespace has a
+// NAMESPACE_RATE_LIMITS entry, else nil. Namespaces without an entry get no limiter, so made-up namespaces
+// neither grow the limiter cache nor escape the token's own limiter.
+func (l *tokenRateLimiter) getNamespaceLimiter(token string, namespace string, backend string) *multiLimiter {
+	if !l.limitByNamespace {
+		return nil
+	}
+
+	namespace = strings.Trim(namespace, "/")
+	limits, ok := NAMESPACE_RATE_LIMITS[namespace]
+	if !ok {
+		return nil
+	}
+	return l.getFromLimiterCache(token+"-ns="+namespace, limits, backend)
+}
+
+// Returns the backend limiting requests to the path: the RATE_LIMITER_BACKEND_BY_PATH entry of the longest
+// matching subpath, else RATE_LIMITER_BACKEND
+func (l *tokenRateLimiter) getBackend(path string) string {
+	backend, longestMatch := l.backend, 0
+	for subpath, pathBackend := range l.backendByPath {
+		if len(subpath) > longestMatch && isUnderSubpath(path, subpath, true) {
+			backend, longestMatch = pathBackend, len(subpath)
+		}
+	}
+	return backend
+}
+
+// setInLimiterCache creates a new rate limiter with the limits on the backend and adds it to the limiterCache map,
 // using the token as the key
-func (l *tokenRateLimiter) setInLimiterCache(token string) *multiLimiter {
+func (l *tokenRateLimiter) setInLimiterCache(token string, limits NamespaceRateLimit, backend string) *multiLimiter {
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
+	// Another request may have (re)created the limiter while the lock was released
+	if visitor, exists := l.limiterCache[token]; exists && !l.isPastMaxLifetime(visitor) {
+		visitor.lastUsed = time.Now().UnixMilli()
+		return visitor.limiter
+	}
+
 	// Checks if rate-limiters cache is full and removes item using LRU policy
 	l.purgeLruTokenLimiters()
 
 	limiter := MultiLimiter(
-		rate.NewLimiter(Per(int(l.burstLimitPerSec), time.Second), 1),                 // burst requests
-		rate.NewLimiter(Per(l.rateLimitPerMin, time.Minute), l.rateLimiterBucketSize), // normal requests
+		l.newLimiter(token+":burst", Per(limits.BurstLimitPerSecond, time.Second), 1, backend),                 // burst requests
+		l.newLimiter(token+":normal", Per(limits.RateLimitPerMinute, time.Minute), limits.BucketSize, backend), // normal requests
 	)
-	l.limiterCache[token] = &visitor{limiter, time.Now().UnixMilli()}
+	limiter.perMinute = limits.RateLimitPerMinute
+	now := time.Now().UnixMilli()
+	l.limiterCache[token] = &visitor{limiter, now, now}
+	rateLimiterCacheEntries.Set(float64(len(l.limiterCache)))
 	return limiter
 }
 
+// Pings the Redis holding shared buckets, nil if no backend is "redis"
+func (l *tokenRateLimiter) PingBackend() error {
+	if l.redis == nil {
+		return nil
+	}
+	return l.redis.ping()
+}
+
+// Returns a limiter of the backend, `name` identifies its bucket in Redis
+func (l *tokenRateLimiter) newLimiter(name string, limit rate.Limit, burst int, backend string) RateLimiter {
+	if backend == "redis" {
+		return newRedisLimiter(l.redis, name, limit, burst)
+	}
+	return rate.NewLimiter(limit, burst)
+}
+
 func Per(eventCount int, duration time.Duration) rate.Limit {
 	return rate.Every(duration / time.Duration(eventCount))
 }
 
+// Returns the burst requested with BURST_OVERRIDE_HEADER clamped to BURST_OVERRIDE_MAX, or 0 if there is none
+// or it's malformed. The proxyHeaderFilter already dropped the header unless a BURST_OVERRIDE_TRUSTED_CIDRS peer sent it.
+func (l *tokenRateLimiter) getBurstOverride(request *http.Request) int {
+	value := request.Header.Get(BURST_OVERRIDE_HEADER)
+	if l.burstOverrideMax <= 0 || value == "" {
+		return 0
+	}
+
+	burst, err := strconv.Atoi(value)
+	if err != nil || burst <= 0 {
+		log.Printf("Ignoring %s: %q is not a positive integer", BURST_OVERRIDE_HEADER, value)
+		return 0
+	}
+	if burst > l.burstOverrideMax {
+		burst = l.burstOverrideMax
+	}
+	return burst
+}
+
 // Purges 1/4 of the least recently used items from rate-limiters cache when full
 func (l *tokenRateLimiter) purgeLruTokenLimiters() {
-	if len(l.limiterCache) >= RATE_LIMITER_CACHE_SIZE {
+	if len(l.limiterCache) >= l.config.RateLimiterCacheSize {
+		defer observePurge("purgeLruTokenLimiters", time.Now())
 		log.Printf("Purging rate-limiters cache because its full.")
 
 		// Get rate-limiters cache keys
@@ -142,27 +395,56 @@ func (l *tokenRateLimiter) purgeLruTokenLimiters() {
 		})
 
 		// Delete 1/4 cache
+		sizeBefore := len(l.limiterCache)
 		for i, k := range keys {
 			delete(l.limiterCache, k)
 			if i >= len(l.limiterCache)/4 {
 				break
 			}
 		}
+
+		l.lruPurges++
+		l.recordEvictions(sizeBefore - len(l.limiterCache))
 	}
 }
 
-// Purge rate-limiters every RATE_LIMITER_PURGE_FREQUENCY which hasn't been used
+// Records rate-limiters removed by a purge. Must be called with the write lock held.
+func (l *tokenRateLimiter) recordEvictions(evicted int) {
+	l.evictedTotal += int64(evicted)
+	rateLimiterEvictionsTotal.Add(float64(evicted))
+	rateLimiterCacheEntries.Set(float64(len(l.limiterCache)))
+}
+
+// Returns the current occupancy and purge counts of the rate-limiters cache
+func (l *tokenRateLimiter) Stats() limiterCacheStats {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return limiterCacheStats{
+		Size:         len(l.limiterCache),
+		Capacity:     l.config.RateLimiterCacheSize,
+		LruPurges:    l.lruPurges,
+		ExpiryPurges: l.expiryPurges,
+		Evicted:      l.evictedTotal,
+	}
+}
+
+// Purge rate-limiters every RateLimiterPurgeFrequency which hasn't been used
 func (l *tokenRateLimiter) purgeTokenLimiters() {
-	if time.Now().UnixMilli()-RATE_LIMITER_PURGE_FREQUENCY*1000 > l.lastRateLimiterPurge {
-		log.Printf("Purging rate-limiters. It has not been purged in %d seconds.", RATE_LIMITER_PURGE_FREQUENCY)
+	if time.Now().UnixMilli()-int64(l.config.RateLimiterPurgeFrequency)*1000 > l.lastRateLimiterPurge {
+		log.Printf("Purging rate-limiters. It has not been purged in %d seconds.", l.config.RateLimiterPurgeFrequency)
 		l.lock.Lock()
 		defer l.lock.Unlock()
+		defer observePurge("purgeTokenLimiters", time.Now())
 
+		sizeBefore := len(l.limiterCache)
 		for token, v := range l.limiterCache {
-			if time.Now().UnixMilli() > v.lastUsed+RATE_LIMITER_DEFAULT_EXPIRATION*1000 {
+			if time.Now().UnixMilli() > v.lastUsed+int64(l.config.RateLimiterDefaultExpiration)*1000 {
 				delete(l.limiterCache, token)
 			}
 		}
+		l.expiryPurges++
+		l.recordEvictions(sizeBefore - len(l.limiterCache))
 		l.lastRateLimiterPurge = time.Now().UnixMilli()
 	}
 }
@@ -172,18 +454,38 @@ func (l *tokenRateLimiter) RateLimitHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		l.purgeTokenLimiters()
 
-		rateLimitingKey := request.Context().Value(parsedHeaderContextKey).(*parseHeader).GetLimiterCacheKey()
-		isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsPathCacheable()
-		isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsRequestIgnorable()
+		rateLimitingKey := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).GetLimiterCacheKey()
+		isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsPathCacheable()
+		isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsRequestIgnorable()
+		isCanary := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsCanary()
 
 		log.Printf("Rate-Limit Check: STARTED: Hashkey: %s \n", rateLimitingKey)
-		limiter := l.getFromLimiterCache(rateLimitingKey)
+		// Paths on another backend than RATE_LIMITER_BACKEND get buckets of their own on that backend
+		backend := l.getBackend(normalizePath(request.URL.Path))
+		limiterKey := rateLimitingKey
+		if backend != l.backend {
+			limiterKey = rateLimitingKey + "-backend=" + backend
+		}
+		limiter := l.getFromLimiterCache(limiterKey, l.getTokenRateLimit(), backend)
+		if burst := l.getBurstOverride(request); burst > 0 {
+			log.Printf("Rate-Limit Check: BURST OVERRIDE: Hashkey: %s burst raised to %d for %ds", rateLimitingKey, burst, BURST_OVERRIDE_DURATION)
+			limiter.elevateBurst(burst, time.Now().UnixMilli()+BURST_OVERRIDE_DURATION*1000)
+		}
 		// Important that this is called before checking cache,
 		// in order to consume one token for rate-limiting
 		isAllowed := limiter.Allow()
 
-		// Read request - Check if response is already cached
-		if isPathCacheable && !isRequestIgnorable {
+		// A namespace limit only narrows the token's limit, the request must pass both
+		if namespaceLimiter := l.getNamespaceLimiter(limiterKey, request.Header.Get(VAULT_NAMESPACE_HEADER), backend); namespaceLimiter != nil && isAllowed {
+			isAllowed = namespaceLimiter.Allow()
+			if !isAllowed || namespaceLimiter.mostConstraining().Tokens() < limiter.mostConstraining().Tokens() {
+				limiter = namespaceLimiter
+			}
+		}
+		l.setRateLimitHeaders(writer.Header(), limiter)
+
+		// Read request - Check if response is already cached. Canary tokens always go upstream.
+		if isPathCacheable && !isRequestIgnorable && !isCanary {
 			log.Printf("Rate-Limit Check: Checking Cache\n")
 			response, err := l.vaultCache.getCachedResponse(request)
 			if err != nil {
@@ -193,11 +495,7 @@ func (l *tokenRateLimiter) RateLimitHandler(next http.Handler) http.Handler {
 
 				copyHeaders(writer.Header(), response.Header)
 				writer.WriteHeader(response.StatusCode)
-				_, err = io.Copy(writer, response.Body)
-
-				if err != nil {
-					log.Fatal("Error copying response from cache.", err)
-				}
+				copyResponseBody(writer, response.Body, "cache")
 				return
 			}
 		}
@@ -205,6 +503,8 @@ func (l *tokenRateLimiter) RateLimitHandler(next http.Handler) http.Handler {
 		// Return 429 error
 		if !isAllowed {
 			log.Printf("Rate-Limit Check: TOO MANY REQUESTS: Hashkey: %s \n", rateLimitingKey)
+			rateLimitDeniedTotal.Inc()
+			writer.Header().Set("Retry-After", strconv.Itoa(limiter.RetryAfter()))
 			http.Error(writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
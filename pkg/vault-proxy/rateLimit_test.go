@@ -0,0 +1,177 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Returns header parsing and rate limiting in front of an always-200 upstream, and the limiter
+func newRateLimitChain(t *testing.T, configure func(*Config)) (http.Handler, *tokenRateLimiter) {
+	config := newTestConfig(t)
+	if configure != nil {
+		configure(&config)
+	}
+	limiter := NewTokenRateLimiter(config, NewVaultCache(config))
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+	return NewParseHeader(config).ParseHeaderHandler(limiter.RateLimitHandler(upstream)), limiter
+}
+
+// Returns a request of the token to the namespace
+func newNamespaceRequest(token string, namespace string) *http.Request {
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", token)
+	request.Header.Set(VAULT_NAMESPACE_HEADER, namespace)
+	return request
+}
+
+func TestMadeUpNamespacesShareTheTokenLimit(t *testing.T) {
+	chain, limiter := newRateLimitChain(t, nil)
+	limiter.limitByNamespace = true
+
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		allowed += countStatus(serveTimes(chain, newNamespaceRequest("token", fmt.Sprintf("ns-%d", i)), 1), http.StatusOK)
+	}
+	if allowed != 1 {
+		t.Errorf("got %d requests allowed across namespaces, want the token's burst of 1", allowed)
+	}
+	if size := limiter.Stats().Size; size != 1 {
+		t.Errorf("got %d limiters for one token, want 1", size)
+	}
+}
+
+func TestNamespaceRateLimitNarrowsTheTokenLimit(t *testing.T) {
+	defer func(limits map[string]NamespaceRateLimit) { NAMESPACE_RATE_LIMITS = limits }(NAMESPACE_RATE_LIMITS)
+	NAMESPACE_RATE_LIMITS = map[string]NamespaceRateLimit{"team-a": {BurstLimitPerSecond: 1, RateLimitPerMinute: 1, BucketSize: 1}}
+
+	// A fast per-second refill, so only the per-minute limits matter after a short pause
+	chain, limiter := newRateLimitChain(t, func(config *Config) { config.BurstLimitPerSecond = 100 })
+	limiter.limitByNamespace = true
+
+	statuses := make([]int, 0, 3)
+	for _, namespace := range []string{"team-a", "team-a", "team-b"} {
+		time.Sleep(20 * time.Millisecond)
+		statuses = append(statuses, serveTimes(chain, newNamespaceRequest("token", namespace), 1)...)
+	}
+
+	want := []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("got statuses %v, want %v", statuses, want)
+		}
+	}
+}
+
+func TestRateLimiterBackendByPath(t *testing.T) {
+	defer func(backends map[string]string) { RATE_LIMITER_BACKEND_BY_PATH = backends }(RATE_LIMITER_BACKEND_BY_PATH)
+	RATE_LIMITER_BACKEND_BY_PATH = map[string]string{"/v1/database/creds/": "redis"}
+
+	var redis *miniredis.Miniredis
+	chain, _ := newRateLimitChain(t, func(config *Config) { redis = newTestRedis(t, config) })
+
+	serveTimes(chain, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"), 1)
+	if keys := redis.Keys(); len(keys) != 0 {
+		t.Errorf("a path without an override has buckets in Redis: %v", keys)
+	}
+
+	// The token spent its in-memory burst of 1 above, the overridden path has buckets of its own
+	if ok := countStatus(serveTimes(chain, newTestRequest(http.MethodGet, "/v1/database/creds/app", "172.16.0.1:1234", "token"), 1), http.StatusOK); ok != 1 {
+		t.Error("request to the overridden path was limited by the token's in-memory buckets")
+	}
+	if keys := redis.Keys(); len(keys) != 2 {
+		t.Errorf("got %d buckets in Redis for the overridden path, want burst and normal: %v", len(keys), keys)
+	}
+}
+
+func TestTrackedNamespacesAreBoundedByTheConfiguredOnes(t *testing.T) {
+	defer func(limits map[string]NamespaceRateLimit) { NAMESPACE_RATE_LIMITS = limits }(NAMESPACE_RATE_LIMITS)
+	NAMESPACE_RATE_LIMITS = map[string]NamespaceRateLimit{
+		"team-a": {BurstLimitPerSecond: 100, RateLimitPerMinute: 100, BucketSize: 100},
+		"team-b": {BurstLimitPerSecond: 100, RateLimitPerMinute: 100, BucketSize: 100},
+	}
+	chain, limiter := newRateLimitChain(t, func(config *Config) {
+		config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 100000, 100000, 100000
+		config.RateLimiterCacheSize = 100
+	})
+	limiter.limitByNamespace = true
+
+	for i := 0; i < 1000; i++ {
+		serveTimes(chain, newNamespaceRequest("token", fmt.Sprintf("ns-%d", i)), 1)
+	}
+	for _, namespace := range []string{"team-a", "/team-b/", "team-a"} {
+		serveTimes(chain, newNamespaceRequest("token", namespace), 1)
+	}
+	if size := limiter.Stats().Size; size != 3 {
+		t.Errorf("got %d limiters after 1000 namespaces, want the token's and one per configured namespace", size)
+	}
+}
+
+func TestLimiterCacheOccupancyIsReported(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	chain, limiter := newRateLimitChain(t, func(config *Config) { config.RateLimiterCacheSize = 4 })
+	config := newTestConfig(t)
+	admin := NewAdminHandler(config, NewParseHeader(config), limiter, NewVaultCache(config), nil)
+
+	for i := 0; i < 3; i++ {
+		serveTimes(chain, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", fmt.Sprintf("token-%d", i)), 1)
+	}
+	if stats := limiter.Stats(); stats != (limiterCacheStats{Size: 3, Capacity: 4}) {
+		t.Errorf("got stats %+v for 3 limiters, want 3 of 4 and no purges", stats)
+	}
+
+	// Filling the cache purges its least recently used limiters
+	for i := 3; i < 10; i++ {
+		serveTimes(chain, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", fmt.Sprintf("token-%d", i)), 1)
+	}
+	stats := limiter.Stats()
+	if stats.Size > stats.Capacity || stats.LruPurges == 0 || int64(stats.Size)+stats.Evicted != 10 {
+		t.Errorf("got stats %+v for 10 limiters, want the evicted and remaining limiters to add up to 10", stats)
+	}
+	if entries := testutil.ToFloat64(rateLimiterCacheEntries); entries != float64(stats.Size) {
+		t.Errorf("got %v limiters in vault_proxy_rate_limiter_cache_entries, want %d", entries, stats.Size)
+	}
+
+	var reported limiterCacheStats
+	recorder := serveAdmin(admin, http.MethodGet, "/admin/stats/rate-limiters", "admin-secret")
+	if err := json.Unmarshal(recorder.Body.Bytes(), &reported); err != nil || reported != stats {
+		t.Errorf("admin endpoint reported %s, want %+v", recorder.Body.String(), stats)
+	}
+}
+
+func TestActiveLimiterIsRecreatedPastItsMaxLifetime(t *testing.T) {
+	chain, limiter := newRateLimitChain(t, func(config *Config) {
+		config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1, 1
+		config.RateLimiterMaxLifetime = 1
+	})
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	if statuses := serveTimes(chain, request, 2); statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests {
+		t.Fatalf("got statuses %v, want the bucket of 1 emptied by the first request", statuses)
+	}
+
+	// The limits are raised while the token keeps its limiter busy
+	limiter.rateLimitPerMin, limiter.rateLimiterBucketSize = 1000, 1000
+	if statuses := serveTimes(chain, request, 1); statuses[0] != http.StatusTooManyRequests {
+		t.Errorf("got status %d within the limiter's lifetime, want the old limits kept", statuses[0])
+	}
+	deadline := time.Now().Add(1100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		serveTimes(chain, request, 1)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if statuses := serveTimes(chain, request, 5); countStatus(statuses, http.StatusOK) != 5 {
+		t.Errorf("got statuses %v past the max lifetime, want the limiter recreated with the raised limits", statuses)
+	}
+	for key, visitor := range limiter.limiterCache {
+		if visitor.limiter.perMinute != 1000 {
+			t.Errorf("recreated limiter %s allows %d per minute, want 1000", key, visitor.limiter.perMinute)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package vault_proxy
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis shared by all agents. After a failed call Redis is skipped for REDIS_RETRY_INTERVAL seconds,
+// so an unreachable Redis costs one timeout per interval instead of one per request.
+type redisBackend struct {
+	client    *redis.Client
+	downUntil int64 // Millis since epoch until which Redis is skipped; accessed atomically
+}
+
+// Should ALWAYS be used as the "constructor" for the redisBackend.
+func newRedisBackend(config Config) *redisBackend {
+	return &redisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:         config.RedisAddr,
+			Password:     config.RedisPassword,
+			DB:           config.RedisDb,
+			DialTimeout:  REDIS_TIMEOUT_MS * time.Millisecond,
+			ReadTimeout:  REDIS_TIMEOUT_MS * time.Millisecond,
+			WriteTimeout: REDIS_TIMEOUT_MS * time.Millisecond,
+		}),
+	}
+}
+
+// Returns `true` unless a recent call failed
+func (r *redisBackend) isAvailable() bool {
+	return time.Now().UnixMilli() >= atomic.LoadInt64(&r.downUntil)
+}
+
+// Records a failed call, skipping Redis for REDIS_RETRY_INTERVAL seconds. `operation` labels the error metric.
+func (r *redisBackend) recordError(operation string, err error) {
+	redisErrorsTotal.WithLabelValues(operation).Inc()
+
+	now := time.Now().UnixMilli()
+	downUntil := atomic.LoadInt64(&r.downUntil)
+	if now >= downUntil && atomic.CompareAndSwapInt64(&r.downUntil, downUntil, now+REDIS_RETRY_INTERVAL*1000) {
+		log.Printf("Redis %s failed, falling back to this agent for %ds: %v", operation, REDIS_RETRY_INTERVAL, err)
+	}
+}
+
+// Pings Redis, even while it is being skipped after a failed call
+func (r *redisBackend) ping() error {
+	ctx, cancel := r.callContext()
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Returns a context bounded by REDIS_TIMEOUT_MS for one Redis call
+func (r *redisBackend) callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), REDIS_TIMEOUT_MS*time.Millisecond)
+}
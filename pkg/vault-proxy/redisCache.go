@@ -0,0 +1,321 @@
+package vault_proxy
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Serialized cachedResponse, as shared through Redis and pushed to neighbor agents. The token is left out so Redis
+// never holds Vault tokens; shared entries are therefore not sampled by token validation on the agents loading
+// them, the agent that fetched them evicts them on revocation.
+type redisCacheEntry struct {
+	StatusCode    int         `json:"status_code"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body"` // Sealed when CACHE_ENCRYPTION_KEY is set
+	Expires       int64       `json:"expires"`
+	SoftExpires   int64       `json:"soft_expires"`
+	StoredAt      int64       `json:"stored_at"`
+	LeaseDuration int64       `json:"lease_duration"`
+	RefreshAt     int64       `json:"refresh_at"`
+	EmptyData     bool        `json:"empty_data"`
+	Negative      bool        `json:"negative"`
+	Path          string      `json:"path"`
+	Namespace     string      `json:"namespace"`
+}
+
+// Entry loaded from Redis, kept serialized so every load decodes its own copy
+type redisHotEntry struct {
+	data     []byte
+	loadedAt int64 // Millis since epoch
+}
+
+// Responses shared by all agents through Redis, below each agent's in-memory cache, so a restarted or newly
+// routed agent starts warm. Entries expire in Redis with their hard TTL plus STALE_GRACE_PERIOD.
+// While Redis is unavailable agents only use their in-memory cache.
+type redisCache struct {
+	redis      *redisBackend
+	bodyCipher cipher.AEAD // Bodies are shared sealed, so agents need the same CACHE_ENCRYPTION_KEY to share entries
+
+	// Entries loaded in the last hotTtl millis, answered without calling Redis again (REDIS_HOT_KEY_TTL_MS)
+	hotLock sync.Mutex
+	hot     map[string]redisHotEntry
+	hotTtl  int64
+	hotSize int // REDIS_HOT_KEY_CACHE_SIZE
+
+	minReplicas    int           // REDIS_CACHE_MIN_REPLICAS
+	replicaTimeout time.Duration // REDIS_CACHE_REPLICA_TIMEOUT_MS
+}
+
+// Should ALWAYS be used as the "constructor" for the redisCache.
+func newRedisCache(backend *redisBackend, bodyCipher cipher.AEAD) *redisCache {
+	return &redisCache{
+		redis:      backend,
+		bodyCipher: bodyCipher,
+		hot:        make(map[string]redisHotEntry),
+		hotTtl:     REDIS_HOT_KEY_TTL_MS,
+		hotSize:    REDIS_HOT_KEY_CACHE_SIZE,
+
+		minReplicas:    REDIS_CACHE_MIN_REPLICAS,
+		replicaTimeout: REDIS_CACHE_REPLICA_TIMEOUT_MS * time.Millisecond,
+	}
+}
+
+// Returns the entry loaded from Redis within the last hotTtl millis, if there is one
+func (r *redisCache) getHot(key string) ([]byte, bool) {
+	if r.hotTtl <= 0 {
+		return nil, false
+	}
+
+	r.hotLock.Lock()
+	defer r.hotLock.Unlock()
+
+	hot, exists := r.hot[key]
+	if !exists || time.Now().UnixMilli()-hot.loadedAt > r.hotTtl {
+		return nil, false
+	}
+	return hot.data, true
+}
+
+// Keeps the entry loaded from Redis for hotTtl millis. A full table drops its expired entries first, then
+// arbitrary ones, so at most hotSize entries are kept.
+func (r *redisCache) setHot(key string, data []byte) {
+	if r.hotTtl <= 0 || r.hotSize <= 0 {
+		return
+	}
+
+	r.hotLock.Lock()
+	defer r.hotLock.Unlock()
+
+	now := time.Now().UnixMilli()
+	if _, exists := r.hot[key]; !exists && len(r.hot) >= r.hotSize {
+		for hotKey, hot := range r.hot {
+			if now-hot.loadedAt > r.hotTtl {
+				delete(r.hot, hotKey)
+			}
+		}
+		for hotKey := range r.hot {
+			if len(r.hot) < r.hotSize {
+				break
+			}
+			delete(r.hot, hotKey)
+		}
+	}
+	r.hot[key] = redisHotEntry{data: data, loadedAt: now}
+}
+
+// Forgets the loaded entries under the keys, e.g. after this agent stored or removed them
+func (r *redisCache) removeHot(keys ...string) {
+	r.hotLock.Lock()
+	defer r.hotLock.Unlock()
+
+	for _, key := range keys {
+		delete(r.hot, key)
+	}
+}
+
+func (r *redisCache) redisKey(key string) string {
+	return REDIS_KEY_PREFIX + "cache:" + key
+}
+
+// Returns the entry shared under the key, if Redis has one. Entries loaded within the last REDIS_HOT_KEY_TTL_MS
+// are answered from this agent, so the hottest keys don't cost a Redis call on every in-memory miss.
+func (r *redisCache) load(key string) (*cachedResponse, bool) {
+	data, isHot := r.getHot(key)
+	if !isHot {
+		if !r.redis.isAvailable() {
+			return nil, false
+		}
+
+		ctx, cancel := r.redis.callContext()
+		defer cancel()
+
+		var err error
+		data, err = r.redis.client.Get(ctx, r.redisKey(key)).Bytes()
+		if err == redis.Nil {
+			return nil, false
+		}
+		if err != nil {
+			r.redis.recordError("cache_get", err)
+			return nil, false
+		}
+		r.setHot(key, data)
+	}
+
+	entry, err := decodeCacheEntry(data, r.bodyCipher)
+	if err != nil {
+		log.Printf("Ignoring shared cache entry %s: %v", key, err)
+		return nil, false
+	}
+	return entry, true
+}
+
+// Returns the entry serialized by encodeCacheEntry. Fails if it is unreadable or its body was sealed under
+// another CACHE_ENCRYPTION_KEY.
+func decodeCacheEntry(data []byte, bodyCipher cipher.AEAD) (*cachedResponse, error) {
+	var stored redisCacheEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	body, err := openBody(bodyCipher, stored.Body)
+	if err != nil {
+		return nil, fmt.Errorf("body sealed under another CACHE_ENCRYPTION_KEY: %v", err)
+	}
+
+	entry := &cachedResponse{
+		response: &http.Response{
+			Status:        http.StatusText(stored.StatusCode),
+			StatusCode:    stored.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        stored.Header,
+			Body:          http.NoBody,
+			ContentLength: int64(len(body)),
+		},
+		bodyData:      stored.Body,
+		bodyCipher:    bodyCipher,
+		expires:       stored.Expires,
+		softExpires:   stored.SoftExpires,
+		lastUsed:      time.Now().UnixMilli(),
+		storedAt:      stored.StoredAt,
+		leaseDuration: stored.LeaseDuration,
+		refreshAt:     stored.RefreshAt,
+		emptyData:     stored.EmptyData,
+		negative:      stored.Negative,
+		path:          stored.Path,
+		namespace:     stored.Namespace,
+	}
+	applyClockSkewTolerance(entry, CLOCK_SKEW_TOLERANCE_MS, time.Now().UnixMilli())
+	return entry, nil
+}
+
+// Interprets the timestamps of an entry stored by another agent, whose clock may be up to `tolerance` millis
+// ahead of this one's: the entry expires and refreshes `tolerance` earlier, so a clock running ahead can't extend
+// its lifetime, and a storedAt later than `now` is clamped to it, so the entry can't pass for newer than a local
+// write. Warns when the entry was stored further in the future than the tolerance.
+func applyClockSkewTolerance(entry *cachedResponse, tolerance int64, now int64) {
+	if skew := entry.storedAt - now; skew > tolerance {
+		log.Printf("Shared cache entry for %s was stored %dms in the future, beyond the %dms CLOCK_SKEW_TOLERANCE_MS; check the agents' clocks", entry.path, skew, tolerance)
+	}
+	if entry.storedAt > now {
+		entry.storedAt = now
+	}
+
+	entry.expires -= tolerance
+	entry.softExpires -= tolerance
+	entry.refreshAt -= tolerance
+}
+
+// Serializes the entry, leaving out its token
+func encodeCacheEntry(entry *cachedResponse) ([]byte, error) {
+	return json.Marshal(redisCacheEntry{
+		StatusCode:    entry.response.StatusCode,
+		Header:        entry.response.Header,
+		Body:          entry.bodyData,
+		Expires:       entry.expires,
+		SoftExpires:   entry.softExpires,
+		StoredAt:      entry.storedAt,
+		LeaseDuration: entry.leaseDuration,
+		RefreshAt:     entry.refreshAt,
+		EmptyData:     entry.emptyData,
+		Negative:      entry.negative,
+		Path:          entry.path,
+		Namespace:     entry.namespace,
+	})
+}
+
+// Shares the entry under the key until it is past its grace period. With REDIS_CACHE_MIN_REPLICAS set, waits for
+// that many replicas to acknowledge the write; an entry that reached fewer is left on the primary, since the
+// response was already fetched and is served either way.
+func (r *redisCache) store(key string, entry *cachedResponse) {
+	ttl := time.Duration(entry.expires+STALE_GRACE_PERIOD*1000-time.Now().UnixMilli()) * time.Millisecond
+	if ttl <= 0 || !r.redis.isAvailable() {
+		return
+	}
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		log.Print("RedisCacheEntryError: ", err)
+		return
+	}
+	r.removeHot(key)
+
+	ctx, cancel := r.redis.callContext()
+	defer cancel()
+
+	// WAIT only counts the writes of its own connection, so it is pipelined with the SET. Each command's
+	// error is checked on its own below.
+	var set *redis.StatusCmd
+	var wait *redis.Cmd
+	r.redis.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		set = pipe.Set(ctx, r.redisKey(key), data, ttl)
+		if r.minReplicas > 0 {
+			wait = pipe.Do(ctx, "wait", r.minReplicas, r.replicaTimeout.Milliseconds())
+		}
+		return nil
+	})
+	if err = set.Err(); err != nil {
+		r.redis.recordError("cache_set", err)
+		return
+	}
+	if wait == nil {
+		return
+	}
+	if replicas, err := wait.Int64(); err != nil || replicas < int64(r.minReplicas) {
+		redisErrorsTotal.WithLabelValues("cache_replicate").Inc()
+		log.Printf("Shared cache entry %s reached %d of %d replicas, keeping it on the primary: %v", key, replicas, r.minReplicas, err)
+	}
+}
+
+// Deletes the shared entries under the keys. Tried even while Redis is considered down, since a missed
+// delete lets agents load an entry that predates a write until it expires.
+func (r *redisCache) remove(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	r.removeHot(keys...)
+
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = r.redisKey(key)
+	}
+
+	ctx, cancel := r.redis.callContext()
+	defer cancel()
+
+	if err := r.redis.client.Del(ctx, redisKeys...).Err(); err != nil {
+		r.redis.recordError("cache_delete", err)
+	}
+}
+
+// Deletes every shared entry
+func (r *redisCache) flush() {
+	r.hotLock.Lock()
+	r.hot = make(map[string]redisHotEntry)
+	r.hotLock.Unlock()
+
+	var cursor uint64
+	for {
+		ctx, cancel := r.redis.callContext()
+		keys, next, err := r.redis.client.Scan(ctx, cursor, r.redisKey("*"), 1000).Result()
+		if err == nil && len(keys) > 0 {
+			err = r.redis.client.Del(ctx, keys...).Err()
+		}
+		cancel()
+
+		if err != nil {
+			r.redis.recordError("cache_flush", err)
+			return
+		}
+		if cursor = next; cursor == 0 {
+			return
+		}
+	}
+}
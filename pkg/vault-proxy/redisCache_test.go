@@ -0,0 +1,178 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Returns a Redis cache on an in-memory Redis holding a 200 entry under `key`
+func newTestRedisCache(t *testing.T, key string) (*redisCache, *miniredis.Miniredis) {
+	config := newTestConfig(t)
+	redis := newTestRedis(t, &config)
+	shared := newRedisCache(newRedisBackend(config), nil)
+
+	data, _ := json.Marshal(redisCacheEntry{
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"data":{"value":"secret"}}`),
+		Expires:    time.Now().UnixMilli() + 60000,
+	})
+	redis.Set(shared.redisKey(key), string(data))
+	return shared, redis
+}
+
+func TestHotKeyIsLoadedFromRedisOncePerLocalTtl(t *testing.T) {
+	shared, redis := newTestRedisCache(t, "key")
+	shared.hotTtl = 100
+
+	commands := redis.CommandCount()
+	for i := 0; i < 20; i++ {
+		if _, isShared := shared.load("key"); !isShared {
+			t.Fatal("entry stored in Redis was not loaded")
+		}
+	}
+	if calls := redis.CommandCount() - commands; calls != 1 {
+		t.Errorf("20 loads within the local TTL called Redis %d times, want 1", calls)
+	}
+
+	// Past the local TTL Redis is asked again, so updates through other agents are seen
+	time.Sleep(150 * time.Millisecond)
+	shared.load("key")
+	if calls := redis.CommandCount() - commands; calls != 2 {
+		t.Errorf("load past the local TTL called Redis %d times in total, want 2", calls)
+	}
+}
+
+func TestRemovedHotKeyIsNotServedLocally(t *testing.T) {
+	shared, _ := newTestRedisCache(t, "key")
+	shared.hotTtl = 60000
+
+	shared.load("key")
+	shared.remove("key")
+	if _, isShared := shared.load("key"); isShared {
+		t.Error("entry removed from Redis was still served from the local copy")
+	}
+}
+
+func TestSharedExpiryToleratesClockSkew(t *testing.T) {
+	// Stored by an agent whose clock runs 2s ahead
+	now := time.Now().UnixMilli()
+	encode := func(expires int64) []byte {
+		data, _ := json.Marshal(redisCacheEntry{StatusCode: http.StatusOK, Expires: expires, SoftExpires: expires, RefreshAt: expires, StoredAt: now + 2000})
+		return data
+	}
+
+	entry, err := decodeCacheEntry(encode(now+CLOCK_SKEW_TOLERANCE_MS/2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.isExpired() {
+		t.Error("entry expiring within the skew tolerance is still served")
+	}
+	if entry.storedAt > time.Now().UnixMilli() {
+		t.Errorf("entry stored in the future keeps storedAt %d", entry.storedAt)
+	}
+
+	entry, _ = decodeCacheEntry(encode(now+60000), nil)
+	if entry.isExpired() || entry.expires != now+60000-CLOCK_SKEW_TOLERANCE_MS {
+		t.Errorf("got expiry %d, want the stored one moved %dms earlier", entry.expires-now, CLOCK_SKEW_TOLERANCE_MS)
+	}
+}
+
+// Returns a Redis-backed cache on an in-memory Redis, waiting for `minReplicas` replicas on writes
+func newRedisBackedCache(t *testing.T, minReplicas int) (*vaultCache, *parseHeader, *miniredis.Miniredis) {
+	config := newTestConfig(t)
+	config.CacheBackend = "redis"
+	redis := newTestRedis(t, &config)
+	cache := NewVaultCache(config).(*vaultCache)
+	cache.shared.minReplicas = minReplicas
+	return cache, NewParseHeader(config), redis
+}
+
+func fetchThroughCache(t *testing.T, cache *vaultCache, parseHeader *parseHeader) *http.Response {
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	return response
+}
+
+func TestUnreplicatedSharedWriteStillServesTheResponse(t *testing.T) {
+	// The in-memory Redis has no replicas to WAIT for
+	cache, parseHeader, redis := newRedisBackedCache(t, 1)
+	failures := testutil.ToFloat64(redisErrorsTotal.WithLabelValues("cache_replicate"))
+
+	response := fetchThroughCache(t, cache, parseHeader)
+	if body := readBody(t, response); response.StatusCode != http.StatusOK || body != `{"data":{"value":"secret"}}` {
+		t.Errorf("got %d %q", response.StatusCode, body)
+	}
+	if testutil.ToFloat64(redisErrorsTotal.WithLabelValues("cache_replicate")) != failures+1 {
+		t.Error("write that reached no replica was not counted")
+	}
+	if len(redis.Keys()) != 1 {
+		t.Errorf("entry was not kept on the primary: %v", redis.Keys())
+	}
+}
+
+func TestFailedSharedWriteStillServesTheResponse(t *testing.T) {
+	cache, parseHeader, redis := newRedisBackedCache(t, 0)
+	redis.Close()
+
+	response := fetchThroughCache(t, cache, parseHeader)
+	if body := readBody(t, response); response.StatusCode != http.StatusOK || body != `{"data":{"value":"secret"}}` {
+		t.Errorf("got %d %q", response.StatusCode, body)
+	}
+}
+
+func TestRestartedAgentIsServedFromRedis(t *testing.T) {
+	config := newTestConfig(t)
+	config.CacheBackend = "redis"
+	redis := newTestRedis(t, &config)
+	parseHeader := NewParseHeader(config)
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+
+	readBody(t, fetchThroughCache(t, NewVaultCache(config).(*vaultCache), parseHeader))
+	keys := redis.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("got shared entries %v, want the fetched one", keys)
+	}
+	if ttl := redis.TTL(keys[0]); ttl <= 0 {
+		t.Errorf("shared entry has TTL %v, want it to expire", ttl)
+	}
+
+	// The cache of an agent that restarted, or of another agent, starts warm
+	restarted := NewVaultCache(config).(*vaultCache)
+	response, err := restarted.getCachedResponse(request)
+	if err != nil {
+		t.Fatalf("restarted agent missed the shared entry: %v", err)
+	}
+	if body := readBody(t, response); response.StatusCode != http.StatusOK || body != `{"data":{"value":"secret"}}` {
+		t.Errorf("got %d %q from the shared entry", response.StatusCode, body)
+	}
+
+	restarted.removeFromCache(restarted.getEntryKey(request))
+	if _, err := NewVaultCache(config).(*vaultCache).getCachedResponse(request); err == nil {
+		t.Error("entry removed by one agent was still served from Redis to another")
+	}
+}
+
+func TestMemoryBackendDoesNotUseRedis(t *testing.T) {
+	config := newTestConfig(t)
+	redis := newTestRedis(t, &config)
+	cache := NewVaultCache(config).(*vaultCache)
+	if cache.shared != nil {
+		t.Fatal("memory backend has a shared cache")
+	}
+
+	readBody(t, fetchThroughCache(t, cache, NewParseHeader(config)))
+	if keys := redis.Keys(); len(keys) != 0 {
+		t.Errorf("memory backend stored %v in Redis", keys)
+	}
+}
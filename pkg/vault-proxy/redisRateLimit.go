@@ -0,0 +1,130 @@
+package vault_proxy
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+// Token bucket shared by all agents. Refills the bucket for the time since the last call (by the Redis
+// clock, so agents' clocks don't matter), takes a token if one is left and returns {allowed, tokens left}.
+// KEYS[1] = bucket, ARGV = tokens per second, bucket size.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RateLimiter enforced fleet-wide through a Redis token bucket, so a token routed across agents still gets
+// the configured limit once. Falls back to an in-memory limiter with the same limits while Redis is unavailable.
+type redisLimiter struct {
+	redis    *redisBackend
+	key      string
+	limit    rate.Limit
+	burst    int
+	fallback *rate.Limiter
+
+	lock       sync.Mutex
+	lastTokens float64 // Tokens left after the last Redis call
+	lastCall   time.Time
+}
+
+// Should ALWAYS be used as the "constructor" for the redisLimiter.
+func newRedisLimiter(backend *redisBackend, key string, limit rate.Limit, burst int) *redisLimiter {
+	return &redisLimiter{
+		redis:      backend,
+		key:        REDIS_KEY_PREFIX + "rl:" + key,
+		limit:      limit,
+		burst:      burst,
+		fallback:   rate.NewLimiter(limit, burst),
+		lastTokens: float64(burst),
+		lastCall:   time.Now(),
+	}
+}
+
+// Takes a token from the shared bucket, or from the in-memory fallback if Redis can't be reached
+func (l *redisLimiter) Allow() bool {
+	if !l.redis.isAvailable() {
+		return l.fallback.Allow()
+	}
+
+	ctx, cancel := l.redis.callContext()
+	defer cancel()
+
+	result, err := tokenBucketScript.Run(ctx, l.redis.client, []string{l.key}, float64(l.limit), l.burst).Slice()
+	if err != nil || len(result) != 2 {
+		l.redis.recordError("rate_limit", err)
+		return l.fallback.Allow()
+	}
+
+	allowed, _ := result[0].(int64)
+	tokensLeft, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(tokensLeft, 64)
+	if err == nil {
+		l.lock.Lock()
+		l.lastTokens, l.lastCall = tokens, time.Now()
+		l.lock.Unlock()
+	}
+
+	return allowed == 1
+}
+
+// Waits until a token is taken or ctx is done
+func (l *redisLimiter) Wait(ctx context.Context) error {
+	for !l.Allow() {
+		delay := time.Duration(math.Max(1-l.Tokens(), 0) / float64(l.limit) * float64(time.Second))
+		if delay < 10*time.Millisecond {
+			delay = 10 * time.Millisecond
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (l *redisLimiter) Limit() rate.Limit {
+	return l.limit
+}
+
+func (l *redisLimiter) Burst() int {
+	return l.burst
+}
+
+// Estimates the tokens left from the last Redis call plus the refill since, without calling Redis again.
+// Other agents may have taken tokens since, so this is an upper bound.
+func (l *redisLimiter) Tokens() float64 {
+	if !l.redis.isAvailable() {
+		return l.fallback.Tokens()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return math.Min(float64(l.burst), l.lastTokens+time.Since(l.lastCall).Seconds()*float64(l.limit))
+}
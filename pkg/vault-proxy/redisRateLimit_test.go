@@ -0,0 +1,73 @@
+package vault_proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func TestRedisRateLimitIsSharedByAgents(t *testing.T) {
+	config := newTestConfig(t)
+	redis := newTestRedis(t, &config)
+
+	// Two agents on the same Redis, each with its own in-memory limiters
+	agents := make([]http.Handler, 2)
+	for i := range agents {
+		agents[i], _ = newRateLimitChain(t, func(agentConfig *Config) {
+			agentConfig.RateLimiterBackend, agentConfig.RedisAddr = "redis", redis.Addr()
+		})
+	}
+
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	statuses := append(serveTimes(agents[0], request, 1), serveTimes(agents[1], request, 1)...)
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests {
+		t.Errorf("got statuses %v across two agents, want the token's burst of 1 allowed once fleet-wide", statuses)
+	}
+}
+
+func TestRedisLimiterFallsBackToMemory(t *testing.T) {
+	config := newTestConfig(t)
+	redis := newTestRedis(t, &config)
+	limiter := newRedisLimiter(newRedisBackend(config), "token", rate.Every(time.Hour), 2)
+	if !limiter.Allow() {
+		t.Fatal("first request was not allowed")
+	}
+
+	// Redis goes away, the agent keeps limiting with in-memory buckets of the same size
+	redis.Close()
+	errorsBefore := testutil.ToFloat64(redisErrorsTotal.WithLabelValues("rate_limit"))
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if limiter.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("got %d requests allowed by the fallback, want its burst of 2", allowed)
+	}
+	if errors := testutil.ToFloat64(redisErrorsTotal.WithLabelValues("rate_limit")) - errorsBefore; errors != 1 {
+		t.Errorf("got %v failed Redis calls, want one before Redis is skipped", errors)
+	}
+	if limiter.redis.isAvailable() {
+		t.Error("Redis is still used right after a failed call")
+	}
+}
+
+func TestRedisLimiterWaitHonorsTheContext(t *testing.T) {
+	config := newTestConfig(t)
+	newTestRedis(t, &config)
+	limiter := newRedisLimiter(newRedisBackend(config), "token", rate.Every(time.Hour), 1)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("waiting for a full bucket failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v waiting on an empty bucket, want %v", err, context.DeadlineExceeded)
+	}
+}
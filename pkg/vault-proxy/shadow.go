@@ -0,0 +1,88 @@
+package vault_proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Shadow Mirror - copies a sample of read requests to a second "shadow" Vault and logs divergences
+type shadowMirror struct {
+	shadowScheme  string
+	shadowAddr    string
+	shadowPort    int
+	samplePercent int
+	client        *http.Client
+}
+
+// Should ALWAYS be used as the "constructor" for the shadowMirror. An empty ShadowVaultAddr disables mirroring.
+func NewShadowMirror(config Config) *shadowMirror {
+	return &shadowMirror{
+		shadowScheme:  config.VaultScheme,
+		shadowAddr:    config.ShadowVaultAddr,
+		shadowPort:    config.ShadowVaultPort,
+		samplePercent: config.ShadowSamplePercent,
+		client:        newVaultClient(config, time.Duration(config.ShadowRequestTimeout)*time.Second),
+	}
+}
+
+// Returns `true` if this request is a read (GET, HEAD or LIST) and was sampled for mirroring. The method is checked
+// here rather than against METHODS_TO_IGNORE, which leaves writes such as PUT out and can be edited at runtime.
+func (s *shadowMirror) shouldMirror(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, "LIST":
+		return s.shadowAddr != "" && rand.Intn(100) < s.samplePercent
+	}
+	return false
+}
+
+// Builds the request sent to the shadow upstream. Must be called before the primary request is sent.
+func (s *shadowMirror) newShadowRequest(request *http.Request) *http.Request {
+	shadowRequest := request.Clone(context.Background())
+	shadowRequest.RequestURI = ""
+	shadowRequest.URL.Scheme = s.shadowScheme
+	shadowRequest.URL.Host = fmt.Sprintf("%s:%d", s.shadowAddr, s.shadowPort)
+	shadowRequest.Body = http.NoBody
+
+	return shadowRequest
+}
+
+// Hashes a response body for comparison between primary and shadow
+func hashBody(body io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Sends the shadow request and logs any divergence from the primary response. Never touches the client response.
+func (s *shadowMirror) mirror(shadowRequest *http.Request, primaryStatus int, primaryBodyHash string) {
+	path := shadowRequest.URL.Path
+
+	response, err := s.client.Do(shadowRequest)
+	if err != nil {
+		log.Printf("SHADOW ERROR: Path: %s %v", path, err)
+		return
+	}
+	defer response.Body.Close()
+
+	shadowBodyHash, err := hashBody(response.Body)
+	if err != nil {
+		log.Printf("SHADOW ERROR: Path: %s reading body: %v", path, err)
+		return
+	}
+
+	if response.StatusCode != primaryStatus || shadowBodyHash != primaryBodyHash {
+		log.Printf("SHADOW DIVERGENCE: Path: %s Primary: %d %s Shadow: %d %s", path, primaryStatus, primaryBodyHash, response.StatusCode, shadowBodyHash)
+	} else {
+		log.Printf("SHADOW MATCH: Path: %s Status: %d", path, primaryStatus)
+	}
+}
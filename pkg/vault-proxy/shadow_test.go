@@ -0,0 +1,101 @@
+package vault_proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Returns header parsing and the proxy in front of the fake Vault `primary`, mirroring every read to `shadow`
+func newShadowedProxy(t *testing.T, primary http.HandlerFunc, shadow http.HandlerFunc) http.Handler {
+	shadowServer := httptest.NewServer(shadow)
+	t.Cleanup(shadowServer.Close)
+
+	config := newTestVault(t, primary)
+	host, port, _ := net.SplitHostPort(shadowServer.Listener.Addr().String())
+	config.ShadowVaultAddr, config.ShadowSamplePercent = host, 100
+	config.ShadowVaultPort, _ = strconv.Atoi(port)
+	return NewParseHeader(config).ParseHeaderHandler(NewVaultProxy(config, NewVaultCache(config), NewShadowMirror(config)))
+}
+
+func TestShadowGetsMirroredReadsAndDivergencesAreLogged(t *testing.T) {
+	logs := captureLogs(t)
+	var lock sync.Mutex
+	var mirrored []string
+	handler := newShadowedProxy(t, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodGet {
+			io.WriteString(writer, `{"data":{"value":"primary"}}`)
+		}
+	}, func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		mirrored = append(mirrored, request.Method+" "+request.URL.Path+" "+request.Header.Get(VAULT_TOKEN_HEADER))
+		lock.Unlock()
+		io.WriteString(writer, `{"data":{"value":"shadow"}}`)
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodPost, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if body := recorder.Body.String(); body != `{"data":{"value":"primary"}}` {
+		t.Errorf("client got %q, want only the primary response", body)
+	}
+
+	if !eventually(func() bool { return strings.Contains(logs.String(), "SHADOW DIVERGENCE: Path: /v1/secret/data/foo") }) {
+		t.Fatal("divergence of the shadow response was not logged")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(mirrored) != 1 || mirrored[0] != "GET /v1/secret/data/foo token" {
+		t.Errorf("shadow received %q, want only the read with its token", mirrored)
+	}
+}
+
+func TestShadowNeverGetsWrites(t *testing.T) {
+	var lock sync.Mutex
+	var mirrored []string
+	handler := newShadowedProxy(t, func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, `{"data":{"value":"primary"}}`)
+	}, func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		mirrored = append(mirrored, request.Method+" "+request.URL.Path)
+		lock.Unlock()
+	})
+
+	// PUT is not in METHODS_TO_IGNORE, yet it is a write and must not be replayed with the client's token
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodPut, "/v1/sys/seal", "172.16.0.1:1234", "token"))
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+
+	if !eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(mirrored) > 0
+	}) {
+		t.Fatal("the read was not mirrored")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(mirrored) != 1 || mirrored[0] != "GET /v1/secret/data/foo" {
+		t.Errorf("shadow received %q, want only the read", mirrored)
+	}
+}
+
+func TestShadowMatchIsNotADivergence(t *testing.T) {
+	logs := captureLogs(t)
+	vault := func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, `{"data":{"value":"same"}}`)
+	}
+	handler := newShadowedProxy(t, vault, vault)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if !eventually(func() bool { return strings.Contains(logs.String(), "SHADOW MATCH: Path: /v1/secret/data/foo") }) {
+		t.Fatal("matching shadow response was not logged")
+	}
+	if strings.Contains(logs.String(), "SHADOW DIVERGENCE") {
+		t.Error("matching shadow response was logged as a divergence")
+	}
+}
@@ -0,0 +1,65 @@
+package vault_proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// In-flight request accounting
+type inFlightTracker struct {
+	count int64 // Requests currently being served; accessed atomically
+}
+
+// Should ALWAYS be used as the "constructor" for the inFlightTracker.
+func NewInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{}
+}
+
+// Returns the number of requests currently being served
+func (t *inFlightTracker) Count() int64 {
+	return atomic.LoadInt64(&t.count)
+}
+
+// Counts the request as in flight until the rest of the chain has served it
+func (t *inFlightTracker) InFlightHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&t.count, 1)
+		inFlightRequests.Inc()
+		defer func() {
+			atomic.AddInt64(&t.count, -1)
+			inFlightRequests.Dec()
+		}()
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// Stops accepting connections and waits up to `timeout` for in-flight requests to finish, then shuts the admin
+// server down within what is left of `timeout`. The admin server stays up while draining, so metrics can still be
+// scraped. Logs the number of requests in flight at shutdown and how long draining took.
+func GracefulShutdown(server *http.Server, adminServer *http.Server, tracker *inFlightTracker, timeout time.Duration) error {
+	inFlight := tracker.Count()
+	log.Printf("Shutting down: %d requests in flight, draining for up to %v", inFlight, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := server.Shutdown(ctx)
+	drainDuration := time.Since(start)
+	if adminErr := adminServer.Shutdown(ctx); adminErr != nil {
+		log.Printf("Admin server shutdown failed: %v", adminErr)
+		adminServer.Close()
+	}
+
+	if err != nil {
+		log.Printf("Shutdown drain timed out after %v with %d of %d requests still in flight: %v", drainDuration, tracker.Count(), inFlight, err)
+		return err
+	}
+
+	log.Printf("Shutdown complete: drained %d in-flight requests in %v", inFlight, drainDuration)
+	return nil
+}
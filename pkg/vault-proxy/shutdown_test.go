@@ -0,0 +1,109 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the handler on a local port, returning the server and the error its Serve returns
+func startTestServer(t *testing.T, handler http.Handler) (*http.Server, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	return server, served
+}
+
+func TestGracefulShutdownStopsAdminServer(t *testing.T) {
+	server, served := startTestServer(t, http.NotFoundHandler())
+	adminServer, adminServed := startTestServer(t, http.NotFoundHandler())
+
+	if err := GracefulShutdown(server, adminServer, NewInFlightTracker(), time.Second); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	for name, served := range map[string]<-chan error{"proxy": served, "admin": adminServed} {
+		select {
+		case err := <-served:
+			if err != http.ErrServerClosed {
+				t.Errorf("%s server stopped with %v, want %v", name, err, http.ErrServerClosed)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s server is still serving after shutdown", name)
+		}
+	}
+}
+
+// Starts `count` requests to the server, returning once all of them are in flight
+func startSlowRequests(t *testing.T, server *http.Server, tracker *inFlightTracker, count int) {
+	for i := 0; i < count; i++ {
+		go func() {
+			if response, err := http.Get(fmt.Sprintf("http://%s/v1/secret/data/foo", server.Addr)); err == nil {
+				response.Body.Close()
+			}
+		}()
+	}
+	if !eventually(func() bool { return tracker.Count() == int64(count) }) {
+		t.Fatalf("got %d requests in flight, want %d", tracker.Count(), count)
+	}
+}
+
+// Serves requests through the tracker, each blocking until `release` is closed
+func startTrackedServer(t *testing.T, release <-chan struct{}) (*http.Server, *inFlightTracker) {
+	tracker := NewInFlightTracker()
+	server, _ := startTestServer(t, tracker.InFlightHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	})))
+	return server, tracker
+}
+
+func TestGracefulShutdownLogsTheDrain(t *testing.T) {
+	release := make(chan struct{})
+	server, tracker := startTrackedServer(t, release)
+	adminServer, _ := startTestServer(t, http.NotFoundHandler())
+	startSlowRequests(t, server, tracker, 3)
+
+	logs := captureLogs(t)
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	if err := GracefulShutdown(server, adminServer, tracker, 5*time.Second); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	if !strings.Contains(logs.String(), "Shutting down: 3 requests in flight") {
+		t.Errorf("shutdown did not log the 3 requests in flight:\n%s", logs)
+	}
+	match := regexp.MustCompile(`drained 3 in-flight requests in (\S+)`).FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("shutdown did not log the drain of the 3 requests:\n%s", logs)
+	}
+	if drain, err := time.ParseDuration(match[1]); err != nil || drain < 150*time.Millisecond || drain > time.Second {
+		t.Errorf("got drain duration %s, want about the 200ms the requests took to finish", match[1])
+	}
+	if tracker.Count() != 0 {
+		t.Errorf("got %d requests in flight after the drain", tracker.Count())
+	}
+}
+
+func TestGracefulShutdownLogsRequestsLeftInFlight(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	server, tracker := startTrackedServer(t, release)
+	adminServer, _ := startTestServer(t, http.NotFoundHandler())
+	startSlowRequests(t, server, tracker, 2)
+
+	logs := captureLogs(t)
+	if err := GracefulShutdown(server, adminServer, tracker, 100*time.Millisecond); err == nil {
+		t.Fatal("shutdown succeeded with requests still in flight")
+	}
+	if !strings.Contains(logs.String(), "with 2 of 2 requests still in flight") {
+		t.Errorf("timed out shutdown did not log the 2 requests left:\n%s", logs)
+	}
+}
@@ -0,0 +1,26 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Signs (or otherwise decorates) a request just before it is sent to Vault, e.g. with AWS SigV4 for a
+// proxy in front of Vault. An error fails the request instead of sending it unsigned.
+type UpstreamRequestSigner func(*http.Request) error
+
+var upstreamRequestSigner atomic.Value // UpstreamRequestSigner
+
+// Installs the signer applied to every request sent to Vault: proxied requests, refresh-ahead,
+// the raft configuration and mount table fetches and token validation. nil removes it.
+func SetUpstreamRequestSigner(signer UpstreamRequestSigner) {
+	upstreamRequestSigner.Store(signer)
+}
+
+// Applies the configured UpstreamRequestSigner, if any
+func signUpstreamRequest(request *http.Request) error {
+	if signer, _ := upstreamRequestSigner.Load().(UpstreamRequestSigner); signer != nil {
+		return signer(request)
+	}
+	return nil
+}
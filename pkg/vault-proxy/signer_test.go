@@ -0,0 +1,68 @@
+package vault_proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSignerDecoratesEveryUpstreamRequest(t *testing.T) {
+	var lock sync.Mutex
+	signatures := map[string]string{}
+	chain, agent := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		signatures[request.Method+" "+request.URL.Path] = request.Header.Get("X-Signature")
+		lock.Unlock()
+		io.WriteString(writer, `{"data":{"value":"secret"}}`)
+	})
+	SetUpstreamRequestSigner(func(request *http.Request) error {
+		request.Header.Set("X-Signature", "signed "+request.URL.Path)
+		return nil
+	})
+	t.Cleanup(func() { SetUpstreamRequestSigner(nil) })
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		chain.ServeHTTP(httptest.NewRecorder(), newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	}
+	agent.refreshVaultConfig()
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/secret/data/foo"},
+		{http.MethodPost, "/v1/secret/data/foo"},
+		{http.MethodGet, "/v1/sys/storage/raft/configuration"},
+	} {
+		lock.Lock()
+		signature, isSent := signatures[tc.method+" "+tc.path]
+		lock.Unlock()
+		if !isSent || signature != "signed "+tc.path {
+			t.Errorf("%s %s reached Vault with signature %q (sent %v), want %q", tc.method, tc.path, signature, isSent, "signed "+tc.path)
+		}
+	}
+}
+
+func TestSignerErrorFailsTheRequestCleanly(t *testing.T) {
+	var fetches int32
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+	})
+	SetUpstreamRequestSigner(func(request *http.Request) error {
+		return errors.New("signing credentials expired")
+	})
+	t.Cleanup(func() { SetUpstreamRequestSigner(nil) })
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		if recorder.Code != http.StatusServiceUnavailable || !strings.HasPrefix(recorder.Body.String(), `{"errors":["vault proxy could not`) {
+			t.Errorf("%s: got status %d and body %q, want a Vault-format 503", method, recorder.Code, recorder.Body.String())
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 0 {
+		t.Errorf("%d unsigned requests reached Vault", fetches)
+	}
+}
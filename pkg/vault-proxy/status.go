@@ -0,0 +1,117 @@
+package vault_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Build version, set at build time with
+// -ldflags "-X github.com/zendesk/vault-proxy/pkg/vault-proxy.Version=v1.2.3"
+var Version = "dev"
+
+var processStart = time.Now()
+
+// Occupancy of the response cache
+type cacheStats struct {
+	Size      int     `json:"size"`
+	Capacity  int     `json:"capacity"`
+	Bytes     int64   `json:"bytes"`
+	MaxBytes  int     `json:"max_bytes"` // 0 when MAX_CACHE_BYTES is disabled
+	Hits      int64   `json:"hits"`      // Since startup, as are misses and evictions
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+// Routing state of the agent
+type routingStatus struct {
+	MyAddress         string         `json:"my_address"`
+	RoutingTable      map[int]string `json:"routing_table"`
+	LastConfigCheck   *time.Time     `json:"last_config_check"`   // null until the first check
+	LastConfigSuccess *time.Time     `json:"last_config_success"` // null until Vault returned a non-empty raft configuration
+	Ready             bool           `json:"ready"`
+}
+
+// Everything served by /admin/status
+type proxyStatus struct {
+	Version       string            `json:"version"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	Cache         cacheStats        `json:"cache"`
+	RateLimiters  limiterCacheStats `json:"rate_limiters"`
+	Routing       routingStatus     `json:"routing"`
+}
+
+// Returns the current occupancy of the response cache and its hit, miss and eviction counts since startup
+func (c *vaultCache) Stats() cacheStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	hits, misses := atomic.LoadInt64(&c.totals.hits), atomic.LoadInt64(&c.totals.misses)
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	return cacheStats{
+		Size:      len(c.cache),
+		Capacity:  c.config.CacheSize,
+		Bytes:     c.bytes,
+		MaxBytes:  c.config.MaxCacheBytes,
+		Hits:      hits,
+		Misses:    misses,
+		Evictions: atomic.LoadInt64(&c.totals.evictions),
+		HitRatio:  hitRatio,
+	}
+}
+
+// Converts millis since epoch to a time, nil for 0 (never happened)
+func millisToTime(millis int64) *time.Time {
+	if millis == 0 {
+		return nil
+	}
+	t := time.UnixMilli(millis).UTC()
+	return &t
+}
+
+// Returns the current routing table and when the Vault configuration was last checked
+func (a *vaultAgent) RoutingStatus() routingStatus {
+	a.lock.RLock()
+	routingTable := make(map[int]string, len(a.agentRoutingTable))
+	for i, address := range a.agentRoutingTable {
+		routingTable[i] = address
+	}
+	status := routingStatus{
+		MyAddress:         a.myAddress,
+		RoutingTable:      routingTable,
+		LastConfigCheck:   millisToTime(a.lastConfigCheck),
+		LastConfigSuccess: millisToTime(a.lastConfigSuccess),
+	}
+	a.lock.RUnlock()
+
+	status.Ready = a.isReady()
+	return status
+}
+
+// GET returns the version, uptime, cache and rate-limiter stats and the routing state in one view
+func (a *adminHandler) statusHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", "GET")
+		writeVaultError(writer, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	status := proxyStatus{
+		Version:       Version,
+		UptimeSeconds: int64(time.Since(processStart).Seconds()),
+		Cache:         a.vaultCache.Stats(),
+		RateLimiters:  a.rateLimiter.Stats(),
+		Routing:       a.agent.RoutingStatus(),
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
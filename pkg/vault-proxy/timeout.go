@@ -0,0 +1,41 @@
+package vault_proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Request Timeout
+type requestTimeout struct {
+	timeout time.Duration
+}
+
+// Should ALWAYS be used as the "constructor" for the requestTimeout. Sets the overall per-request deadline.
+func NewRequestTimeout(timeoutSeconds int) *requestTimeout {
+	return &requestTimeout{
+		timeout: time.Duration(timeoutSeconds) * time.Second,
+	}
+}
+
+// Returns `true` if the error was caused by an exceeded deadline or a network timeout.
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Attaches the per-request deadline to the request context so every upstream and agent call honors it
+func (t *requestTimeout) RequestTimeoutHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := context.WithTimeout(request.Context(), t.timeout)
+		defer cancel()
+
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
@@ -0,0 +1,97 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream error count of one token over the current window
+type tokenErrorCount struct {
+	windowStart int64 // Millis since epoch the current error window started
+	errors      int
+	openUntil   int64 // Millis since epoch the circuit stays open, 0 while closed
+}
+
+// Short-circuits the requests of a token whose requests keep making Vault fail (e.g. a bad policy
+// triggering 5xx), so it can't hammer Vault. Tokens are tracked by hash, never in the clear.
+type tokenCircuitBreaker struct {
+	lock      sync.Mutex
+	tokens    map[string]*tokenErrorCount
+	threshold int
+	window    int64 // Millis
+	cooldown  int64 // Millis
+	lastPurge int64
+}
+
+// Should ALWAYS be used as the "constructor" for the tokenCircuitBreaker. A zero threshold disables it.
+func newTokenCircuitBreaker(threshold int, windowSeconds int, cooldownSeconds int) *tokenCircuitBreaker {
+	return &tokenCircuitBreaker{
+		tokens:    make(map[string]*tokenErrorCount),
+		threshold: threshold,
+		window:    int64(windowSeconds) * 1000,
+		cooldown:  int64(cooldownSeconds) * 1000,
+		lastPurge: time.Now().UnixMilli(),
+	}
+}
+
+// Returns the remaining cooldown and `true` if the circuit of the token is open
+func (b *tokenCircuitBreaker) isOpen(tokenKey string) (time.Duration, bool) {
+	if b.threshold <= 0 || tokenKey == "" {
+		return 0, false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	count, ok := b.tokens[tokenKey]
+	if !ok {
+		return 0, false
+	}
+	remaining := count.openUntil - time.Now().UnixMilli()
+	if remaining <= 0 {
+		return 0, false
+	}
+	return time.Duration(remaining) * time.Millisecond, true
+}
+
+// Counts an upstream 5xx against the token, opening its circuit for the cooldown once more than
+// `threshold` errors happen within the window. Connection errors and timeouts concern Vault as a
+// whole rather than the token, so they aren't counted.
+func (b *tokenCircuitBreaker) recordResponse(tokenKey string, response *http.Response, err error) {
+	if b.threshold <= 0 || tokenKey == "" || err != nil || response.StatusCode < 500 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().UnixMilli()
+	b.purgeExpired(now)
+
+	count, ok := b.tokens[tokenKey]
+	if !ok || now-count.windowStart > b.window {
+		count = &tokenErrorCount{windowStart: now}
+		b.tokens[tokenKey] = count
+	}
+
+	count.errors++
+	if count.errors > b.threshold && count.openUntil < now {
+		count.openUntil = now + b.cooldown
+		tokenCircuitBreaksTotal.Inc()
+	}
+}
+
+// Drops tokens whose window and cooldown are both over, once per window. Caller must hold the lock.
+func (b *tokenCircuitBreaker) purgeExpired(now int64) {
+	if now-b.lastPurge < b.window {
+		return
+	}
+	b.lastPurge = now
+
+	for tokenKey, count := range b.tokens {
+		if now-count.windowStart > b.window && count.openUntil < now {
+			delete(b.tokens, tokenKey)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenOverItsErrorThresholdIsShortCircuited(t *testing.T) {
+	var fetches int32
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if request.Header.Get(VAULT_TOKEN_HEADER) == "bad-policy" {
+			writeVaultError(writer, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writer.Write([]byte(`{"data":{}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	proxy.tokenErrors = newTokenCircuitBreaker(3, 60, 0)
+	proxy.tokenErrors.cooldown = 200 // Millis
+	chain := NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+	bad := newTestRequest(http.MethodPost, "/v1/secret/data/foo", "172.16.0.1:1234", "bad-policy")
+
+	// More than 3 errors within the window open the token's circuit
+	if statuses := serveTimes(chain, bad, 4); countStatus(statuses, http.StatusInternalServerError) != 4 {
+		t.Fatalf("got statuses %v, want Vault's 500 until the threshold is exceeded", statuses)
+	}
+	statuses := serveTimes(chain, bad, 3)
+	if countStatus(statuses, http.StatusServiceUnavailable) != 3 || atomic.LoadInt32(&fetches) != 4 {
+		t.Errorf("got statuses %v and %d fetches during the cooldown, want 503s without reaching Vault", statuses, atomic.LoadInt32(&fetches))
+	}
+	if statuses := serveTimes(chain, newTestRequest(http.MethodPost, "/v1/secret/data/foo", "172.16.0.1:1234", "good"), 1); statuses[0] != http.StatusOK {
+		t.Errorf("got status %d for another token, want it unaffected", statuses[0])
+	}
+
+	// Once the cooldown is over the token reaches Vault again
+	time.Sleep(250 * time.Millisecond)
+	fetchesBefore := atomic.LoadInt32(&fetches)
+	if statuses := serveTimes(chain, bad, 1); statuses[0] != http.StatusInternalServerError || atomic.LoadInt32(&fetches) != fetchesBefore+1 {
+		t.Errorf("got status %d after the cooldown, want the request to reach Vault", statuses[0])
+	}
+}
@@ -0,0 +1,91 @@
+package vault_proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Validates one sampled cached token against Vault every TOKEN_VALIDATION_FREQUENCY seconds.
+// Revocation can't be observed through the proxy, so entries of a revoked token would otherwise be served until expiry.
+func (c *vaultCache) validateCachedTokens() {
+	if TOKEN_VALIDATION_FREQUENCY <= 0 {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	lastValidation := atomic.LoadInt64(&c.lastTokenValidation)
+	if now-TOKEN_VALIDATION_FREQUENCY*1000 <= lastValidation || !atomic.CompareAndSwapInt64(&c.lastTokenValidation, lastValidation, now) {
+		return
+	}
+
+	if token := c.sampleCachedToken(); token != "" {
+		go c.validateToken(token)
+	}
+}
+
+// Returns the token of an arbitrary cached entry, relying on Go's randomized map iteration order
+func (c *vaultCache) sampleCachedToken() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, cachedResponse := range c.cache {
+		if cachedResponse.token != "" {
+			return cachedResponse.token
+		}
+	}
+
+	return ""
+}
+
+// Looks the token up against Vault and evicts all of its entries if Vault no longer accepts it
+func (c *vaultCache) validateToken(token string) {
+	addr := fmt.Sprintf("%s://%s:%d/v1/auth/token/lookup-self", c.config.VaultScheme, c.config.VaultAddr, c.config.VaultPort)
+	request, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	request.Header.Set(VAULT_TOKEN_HEADER, token)
+	if err = signUpstreamRequest(request); err != nil {
+		log.Printf("Token validation could not be signed, keeping cached entries: %v", err)
+		return
+	}
+
+	client := newVaultClient(c.config, time.Duration(c.config.AgentRequestTimeout)*time.Second)
+	response, err := client.Do(request)
+	if err != nil {
+		log.Printf("Token validation failed, keeping cached entries: %v", err)
+		return
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	// Vault answers 403 permission denied for revoked or expired tokens
+	if response.StatusCode == http.StatusForbidden {
+		removed := c.removeTokenEntries(token)
+		log.Printf("Revoked token detected, removed %d entries from cache.", removed)
+	}
+}
+
+// Deletes every cached entry fetched with the given token. Returns the number of entries removed.
+func (c *vaultCache) removeTokenEntries(token string) int {
+	c.lock.Lock()
+	removed := []string{}
+	for key, cachedResponse := range c.cache {
+		if cachedResponse.token == token {
+			c.deleteEntry(key)
+			removed = append(removed, key)
+		}
+	}
+	cacheEntries.Set(float64(len(c.cache)))
+	c.lock.Unlock()
+
+	if c.shared != nil {
+		c.shared.remove(removed...)
+	}
+	return len(removed)
+}
@@ -0,0 +1,54 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Caches a read of `path` fetched with `token`, returning its entry key
+func cacheReadWithToken(t *testing.T, cache *vaultCache, parseHeader *parseHeader, path string, token string) string {
+	request := parsedRequest(parseHeader, newTestRequest(http.MethodGet, path, "172.16.0.1:1234", token))
+	response, err := cache.refreshCache(request, func(request *http.Request) (*http.Response, error) {
+		return newVaultResponse(request, http.StatusOK, `{"data":{"value":"secret"}}`, nil), nil
+	})
+	if err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	readBody(t, response)
+	return cache.getEntryKey(request)
+}
+
+func TestRevokedTokenEntriesArePurged(t *testing.T) {
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/v1/auth/token/lookup-self" {
+			t.Errorf("token validated against %s", request.URL.Path)
+		}
+		if request.Header.Get(VAULT_TOKEN_HEADER) == "revoked" {
+			writeVaultError(writer, http.StatusForbidden, "permission denied")
+			return
+		}
+		writer.Write([]byte(`{"data":{}}`))
+	})
+	cache, parseHeader := NewVaultCache(config).(*vaultCache), NewParseHeader(config)
+
+	revoked := []string{
+		cacheReadWithToken(t, cache, parseHeader, "/v1/secret/data/foo", "revoked"),
+		cacheReadWithToken(t, cache, parseHeader, "/v1/secret/data/bar", "revoked"),
+	}
+	kept := cacheReadWithToken(t, cache, parseHeader, "/v1/secret/data/foo", "valid")
+
+	cache.validateToken("valid")
+	if _, isCached := cache.getFromCache(kept); !isCached {
+		t.Fatal("entry of a token Vault still accepts was removed")
+	}
+
+	cache.validateToken("revoked")
+	for _, key := range revoked {
+		if _, isCached := cache.getFromCache(key); isCached {
+			t.Errorf("entry %s of the revoked token is still cached", key)
+		}
+	}
+	if _, isCached := cache.getFromCache(kept); !isCached {
+		t.Error("entry of another token was removed with the revoked token's")
+	}
+}
@@ -0,0 +1,71 @@
+package vault_proxy
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var vaultTransportOnce sync.Once
+var sharedVaultTransport *http.Transport
+
+// Returns the TLS config used to verify Vault: system roots, or VaultCaCertFile when set
+func newVaultTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.VaultTlsSkipVerify,
+	}
+
+	if config.VaultCaCertFile != "" {
+		pool, err := loadCertPool(config.VaultCaCertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// Returns the transport shared by every client talking to Vault, so connections are pooled across
+// proxied requests, the raft configuration fetch, mount table fetches and token validation.
+// Built from the Config of the first caller; every component is constructed from the same Config.
+func vaultTransport(config Config) *http.Transport {
+	vaultTransportOnce.Do(func() {
+		sharedVaultTransport = newVaultTransport(config)
+	})
+
+	return sharedVaultTransport
+}
+
+// Returns a transport for Vault with its TLS config and VaultOutboundProxy applied
+func newVaultTransport(config Config) *http.Transport {
+	tlsConfig, err := newVaultTLSConfig(config)
+	if err != nil {
+		log.Fatal("Vault TLS configuration: ", err)
+	}
+	if config.VaultTlsSkipVerify {
+		log.Printf("WARNING: VAULT_TLS_SKIP_VERIFY is set, the Vault server certificate is not verified")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if config.VaultOutboundProxy != "" {
+		proxyUrl, err := url.Parse(config.VaultOutboundProxy)
+		if err != nil || proxyUrl.Host == "" {
+			log.Fatalf("Invalid VAULT_OUTBOUND_PROXY %q: %v", redactUrlPassword(config.VaultOutboundProxy), err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	return transport
+}
+
+// Returns a client for Vault over the shared transport. A zero timeout relies on the request context deadline.
+func newVaultClient(config Config, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: vaultTransport(config), Timeout: timeout}
+}
@@ -0,0 +1,37 @@
+package vault_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaultTransportRoutesThroughTheOutboundProxy(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		t.Error("Vault was called directly, bypassing the outbound proxy")
+	}))
+	t.Cleanup(vault.Close)
+
+	// A stub corporate proxy, receiving the absolute URL of every request it forwards
+	proxied := make(chan *http.Request, 1)
+	outboundProxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		proxied <- request
+		writer.Write([]byte(`{"data":{}}`))
+	}))
+	t.Cleanup(outboundProxy.Close)
+
+	config := newTestConfig(t)
+	config.VaultOutboundProxy = outboundProxy.URL
+	client := &http.Client{Transport: newVaultTransport(config)}
+
+	response, err := client.Get(vault.URL + "/v1/sys/storage/raft/configuration")
+	if err != nil {
+		t.Fatalf("calling Vault through the outbound proxy: %v", err)
+	}
+	readBody(t, response)
+
+	request := <-proxied
+	if want := vault.URL + "/v1/sys/storage/raft/configuration"; request.RequestURI != want {
+		t.Errorf("outbound proxy got request for %q, want %q", request.RequestURI, want)
+	}
+}
@@ -1,12 +1,243 @@
 package vault_proxy
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"syscall"
+)
 
-// Copies headers between http.Header objects.
+// Hop-by-hop headers describe a single connection and must not be forwarded by a proxy.
+// https://www.rfc-editor.org/rfc/rfc7230#section-6.1
+var hopByHopHeaders = [...]string{
+	"Connection",
+	"Proxy-Connection", // non-standard, sent by some HTTP/1.0 clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Copies headers between http.Header objects, skipping hop-by-hop headers of the source.
 func copyHeaders(dst http.Header, src http.Header) {
+	skip := connectionHeaderNames(src)
 	for k, vv := range src {
+		if skip[textproto.CanonicalMIMEHeaderKey(k)] {
+			continue
+		}
 		for _, v := range vv {
 			dst.Add(k, v)
 		}
 	}
 }
+
+// Returns the canonical names of the hop-by-hop headers, including any header named in the Connection header.
+func connectionHeaderNames(header http.Header) map[string]bool {
+	names := make(map[string]bool, len(hopByHopHeaders))
+	for _, name := range hopByHopHeaders {
+		names[name] = true
+	}
+
+	for _, connectionField := range header.Values("Connection") {
+		for _, name := range strings.Split(connectionField, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				names[textproto.CanonicalMIMEHeaderKey(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// Folds every case variant of a header name (e.g. "x-vault-token" set by direct map access) into its
+// canonical key, so http.Header.Get sees all of them and only the canonical form is forwarded.
+func canonicalizeHeader(header http.Header, name string) {
+	canonicalName := textproto.CanonicalMIMEHeaderKey(name)
+	for key, values := range header {
+		if key != canonicalName && strings.EqualFold(key, canonicalName) {
+			header[canonicalName] = append(header[canonicalName], values...)
+			delete(header, key)
+		}
+	}
+}
+
+// Removes hop-by-hop headers, including any header named in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for name := range connectionHeaderNames(header) {
+		header.Del(name)
+	}
+}
+
+// Parses CIDR strings from config.go, exiting on an invalid one. `purpose` names the setting in the error.
+func parseCIDRs(cidrs []string, purpose string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("Invalid %s CIDR: %s", purpose, cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Returns `true` if any of the networks contains the IP
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns `true` if the immediate peer of the request (never X-Forwarded-For) is in one of the networks
+func isPeerInNetworks(request *http.Request, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && networksContain(networks, ip)
+}
+
+// Appends the immediate client address to X-Forwarded-For, so the next hop can recover the client IP
+func appendForwardedFor(request *http.Request) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	if prior := request.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		host = strings.Join(prior, ", ") + ", " + host
+	}
+	request.Header.Set("X-Forwarded-For", host)
+}
+
+// Readies an inbound request to be re-sent upstream. The client's connection semantics
+// (e.g. an HTTP/1.0 client without keep-alive) are handled by net/http on the client leg
+// and must not leak onto the pooled upstream connection.
+func prepareUpstreamRequest(request *http.Request, scheme string, host string) {
+	// Request URI must be dumped, it can't be set in client requests.
+	// http://golang.org/src/pkg/net/http/client.go
+	request.RequestURI = ""
+	request.URL.Scheme = scheme
+	request.URL.Host = host
+	request.Close = false
+	removeHopByHopHeaders(request.Header)
+}
+
+// Returned by bufferRequestBody for bodies above MAX_REQUEST_BODY_BYTES, answered with 413
+var errRequestBodyTooLarge = errors.New("request body is larger than MAX_REQUEST_BODY_BYTES")
+
+// Request body that failed to buffer, so later reads of it fail the same way instead of seeing a partial body
+type failedBody struct {
+	err error
+}
+
+func (b failedBody) Read([]byte) (int, error) { return 0, b.err }
+func (b failedBody) Close() error             { return nil }
+
+// Reads the full request body into memory so it can be replayed for the upstream call.
+// Chunked bodies (no Content-Length) are drained completely before forwarding, and
+// ContentLength/TransferEncoding are reset so the upstream request carries a fixed length body.
+// Bodies above MAX_REQUEST_BODY_BYTES fail with errRequestBodyTooLarge.
+func bufferRequestBody(request *http.Request) error {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+	if MAX_REQUEST_BODY_BYTES > 0 && request.ContentLength > MAX_REQUEST_BODY_BYTES {
+		request.Body.Close()
+		request.Body = failedBody{errRequestBodyTooLarge}
+		return errRequestBodyTooLarge
+	}
+
+	reader := request.Body
+	if MAX_REQUEST_BODY_BYTES > 0 {
+		reader = http.MaxBytesReader(nil, request.Body, MAX_REQUEST_BODY_BYTES)
+	}
+	bodyBytes, err := ioutil.ReadAll(reader)
+	request.Body.Close()
+	if err != nil {
+		// MaxBytesReader reads up to the cap before failing, a shorter read failed for another reason
+		if MAX_REQUEST_BODY_BYTES > 0 && len(bodyBytes) >= MAX_REQUEST_BODY_BYTES {
+			err = errRequestBodyTooLarge
+		}
+		request.Body = failedBody{err}
+		return err
+	}
+
+	request.ContentLength = int64(len(bodyBytes))
+	request.TransferEncoding = nil
+	request.Header.Del("Transfer-Encoding")
+
+	// A zero ContentLength with a non-nil Body is treated as unknown length by http.Client
+	if len(bodyBytes) == 0 {
+		request.Body = http.NoBody
+		request.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(bodyBytes)), nil
+	}
+	request.Body, _ = request.GetBody()
+
+	return nil
+}
+
+// Answers a request whose body could not be buffered: 413 above MAX_REQUEST_BODY_BYTES, else 400
+func writeRequestBodyError(writer http.ResponseWriter, err error) {
+	log.Print("RequestBodyError: ", err)
+	if errors.Is(err, errRequestBodyTooLarge) {
+		writeVaultError(writer, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	http.Error(writer, "Bad Request", http.StatusBadRequest)
+}
+
+// Returns `true` if the error means the client went away mid-response, which is routine for a proxy
+func isClientDisconnect(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.Canceled)
+}
+
+// Streams a response body from `source` (cache, agent or vault) to the client. A failed copy only
+// affects this request: it is logged and returned, never fatal.
+func copyResponseBody(writer io.Writer, body io.Reader, source string) error {
+	_, err := io.Copy(writer, body)
+	if err == nil {
+		return nil
+	}
+
+	if isClientDisconnect(err) {
+		log.Printf("Client disconnected while copying response from %s: %v", source, err)
+	} else {
+		log.Printf("WARNING: Error copying response from %s: %v", source, err)
+	}
+	return err
+}
+
+// Writes an error response in Vault's API format, e.g. {"errors":["request timed out at proxy"]}
+func writeVaultError(writer http.ResponseWriter, statusCode int, messages ...string) {
+	body, _ := json.Marshal(struct {
+		Errors []string `json:"errors"`
+	}{messages})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(body)
+}
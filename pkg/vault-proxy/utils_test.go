@@ -0,0 +1,78 @@
+package vault_proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBufferRequestBodyAboveCap(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), MAX_REQUEST_BODY_BYTES+1)
+	for name, contentLength := range map[string]int64{"chunked": -1, "content-length": int64(len(body))} {
+		request := newTestRequest(http.MethodPut, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+		request.Body, request.ContentLength = io.NopCloser(bytes.NewReader(body)), contentLength
+
+		err := bufferRequestBody(request)
+		if !errors.Is(err, errRequestBodyTooLarge) {
+			t.Fatalf("%s body above the cap got error %v", name, err)
+		}
+		if _, err := request.Body.Read(make([]byte, 1)); !errors.Is(err, errRequestBodyTooLarge) {
+			t.Errorf("%s body above the cap can still be read after buffering failed", name)
+		}
+
+		recorder := httptest.NewRecorder()
+		writeRequestBodyError(recorder, err)
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s body above the cap got status %d, want 413", name, recorder.Code)
+		}
+	}
+}
+
+func TestBufferRequestBodyAtCap(t *testing.T) {
+	request := newTestRequest(http.MethodPut, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+	request.Body, request.ContentLength = io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("a"), MAX_REQUEST_BODY_BYTES))), -1
+
+	if err := bufferRequestBody(request); err != nil {
+		t.Fatalf("body at the cap failed to buffer: %v", err)
+	}
+	if request.ContentLength != MAX_REQUEST_BODY_BYTES {
+		t.Errorf("buffered body has Content-Length %d, want %d", request.ContentLength, MAX_REQUEST_BODY_BYTES)
+	}
+}
+
+func TestChunkedWriteReachesVaultWhole(t *testing.T) {
+	payload := strings.Repeat(`{"data":{"value":"secret"}}`, 10000)
+	var received string
+	var contentLength int64
+	var transferEncoding []string
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		received, contentLength, transferEncoding = string(body), request.ContentLength, request.TransferEncoding
+		writer.WriteHeader(http.StatusNoContent)
+	})
+	proxy := httptest.NewServer(chain)
+	t.Cleanup(proxy.Close)
+
+	// A reader of unknown length makes the client send the body chunked
+	request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/secret/data/foo", io.MultiReader(strings.NewReader(payload)))
+	request.Header.Set(VAULT_TOKEN_HEADER, "token")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	if received != payload {
+		t.Errorf("Vault received %d of the %d bytes written", len(received), len(payload))
+	}
+	if contentLength != int64(len(payload)) || len(transferEncoding) != 0 {
+		t.Errorf("Vault got Content-Length %d and Transfer-Encoding %v, want the buffered length %d", contentLength, transferEncoding, len(payload))
+	}
+}
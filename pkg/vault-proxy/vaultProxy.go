@@ -1,66 +1,173 @@
 package vault_proxy
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // Proxies
 type vaultProxy struct {
-	vaultAddr  string
-	vaultPort  int16
-	vaultCache *vaultCache
+	vaultScheme string
+	vaultAddr   string
+	vaultPort   int
+	vaultCache  Cache
+	shadow      *shadowMirror
+	client      *http.Client
+
+	upstreamLatency *latencyWindow
+	tokenErrors     *tokenCircuitBreaker
 }
 
 // Should ALWAYS be used as the "constructor" for the vaultProxy. Initializes cache and important defaults.
-func NewVaultProxy(vaultAddr string, vaultPort int16, vaultCache *vaultCache) *vaultProxy {
+func NewVaultProxy(config Config, vaultCache Cache, shadow *shadowMirror) *vaultProxy {
+	validateDegradationOrder()
+
 	vp := new(vaultProxy)
-	vp.vaultAddr = vaultAddr
-	vp.vaultPort = vaultPort
+	vp.vaultScheme = config.VaultScheme
+	vp.vaultAddr = config.VaultAddr
+	vp.vaultPort = config.VaultPort
 	vp.vaultCache = vaultCache
+	vp.shadow = shadow
+	vp.client = newVaultClient(config, 0) // bounded by the per-request deadline of RequestTimeoutHandler
+	vp.upstreamLatency = newLatencyWindow(LOAD_SHED_P95_THRESHOLD_MS*time.Millisecond, LOAD_SHED_WINDOW*time.Second, LOAD_SHED_MAX_SAMPLES)
+	vp.tokenErrors = newTokenCircuitBreaker(TOKEN_ERROR_THRESHOLD, TOKEN_ERROR_WINDOW, TOKEN_ERROR_COOLDOWN)
 	return vp
 }
 
+// Signs and sends the request to Vault, recording its latency for load-shedding
+func (p *vaultProxy) doUpstream(client *http.Client, request *http.Request) (*http.Response, error) {
+	if err := signUpstreamRequest(request); err != nil {
+		log.Print("UpstreamRequestSignerError: ", err)
+		return nil, err
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	p.upstreamLatency.observe(time.Since(start))
+	upstreamRequestDurationSeconds.Observe(time.Since(start).Seconds())
+
+	return response, err
+}
+
+// Writes the client response for a failed upstream call.
+func (p *vaultProxy) writeUpstreamError(writer http.ResponseWriter, err error, unavailableMessage string) {
+	if isTimeoutError(err) {
+		writeVaultError(writer, http.StatusGatewayTimeout, "request timed out at proxy")
+		return
+	}
+
+	// Vault accepted the connection, then closed or reset it before sending response headers
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		writeVaultError(writer, UPSTREAM_CLOSED_STATUS, "vault closed the connection without sending a response")
+		return
+	}
+
+	// Todo: this should throw an alert in Datadog.
+	writer.Header().Set("Retry-After", strconv.Itoa(UNAVAILABLE_RETRY_AFTER))
+	writeVaultError(writer, http.StatusServiceUnavailable, unavailableMessage)
+}
+
 // Serves all HTTP traffic.
 func (p *vaultProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// Request URI must be dumped, it can't be set in client requests.
-	// http://golang.org/src/pkg/net/http/client.go
-	request.RequestURI = ""
-	request.URL.Scheme = "http"
-	request.URL.Host = fmt.Sprintf("%s:%d", p.vaultAddr, p.vaultPort)
+	prepareUpstreamRequest(request, p.vaultScheme, fmt.Sprintf("%s:%d", p.vaultAddr, p.vaultPort))
 
 	path := request.URL.Path
 	method := request.Method
 
-	client := &http.Client{}
+	client := p.client
 	response := new(http.Response)
 	var err error = nil
 
-	isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsPathCacheable()
-	isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parseHeader).IsRequestIgnorable()
+	isPathCacheable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsPathCacheable()
+	isRequestIgnorable := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsRequestIgnorable()
+	isCanary := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).IsCanary()
+	tokenKey := request.Context().Value(parsedHeaderContextKey).(*parsedHeaders).GetTokenKey()
+
+	// Canaries are never short-circuited, they must keep observing Vault itself
+	if isCanary {
+		tokenKey = ""
+	}
+
+	// Token keeps making Vault fail - protect Vault until its cooldown is over
+	if cooldown, isOpen := p.tokenErrors.isOpen(tokenKey); isOpen {
+		log.Printf("CIRCUIT OPEN: Method: %s Path: %s token exceeded %d upstream errors, short-circuiting", method, path, p.tokenErrors.threshold)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cooldown.Seconds()))))
+		writeVaultError(writer, http.StatusServiceUnavailable, "vault proxy is short-circuiting this token after repeated vault errors")
+		return
+	}
+
+	// Buffer the body so chunked uploads reach Vault with a fixed Content-Length, and oversized bodies are refused
+	if err = bufferRequestBody(request); err != nil {
+		writeRequestBodyError(writer, err)
+		return
+	}
+
+	// Read request - sample it for the shadow upstream before the primary request consumes it
+	var shadowRequest *http.Request
+	if p.shadow.shouldMirror(request) {
+		shadowRequest = p.shadow.newShadowRequest(request)
+	}
 
 	// Read request - cache it
-	if isPathCacheable && !isRequestIgnorable {
+	if isPathCacheable && !isRequestIgnorable && !isCanary {
 		log.Printf("Method: %s Path: %s is cachable!", method, path)
-		response, err = p.vaultCache.refreshCache(request, func() (*http.Response, error) {
-			return client.Do(request)
+		setProxyMetadataCache(request, "miss", "")
+		response, err = p.vaultCache.refreshCache(request, func(outbound *http.Request) (*http.Response, error) {
+			response, err := p.doUpstream(client, outbound)
+			p.tokenErrors.recordResponse(tokenKey, response, err)
+			return response, err
 		})
 
+		// Refresh of an entry in its grace window failed - serve the stale entry instead of erroring
+		if err != nil || response.StatusCode >= 500 {
+			if stale, ok := p.vaultCache.getGraceResponse(request); ok {
+				log.Printf("STALE GRACE: Method: %s Path: %s refresh failed, serving stale cached response", method, path)
+				if err == nil {
+					response.Body.Close()
+				}
+				response, err = stale, nil
+			}
+		}
+
 		if err != nil {
-			// Todo: this should throw an alert in Datadog.
-			http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
+			// Routing fell through to this agent and the cache missed, so Vault was the last option
 			log.Print("CacheableRequestError: ", err)
+			if response, err = p.degrade(request, err); err != nil {
+				p.writeUpstreamError(writer, err, "vault proxy could not serve the request from any agent, the cache or vault")
+				return
+			}
 		}
 	} else {
-		log.Printf("Method: %s Path: %s is not cacheable, proxying without cache...", method, path)
-		response, err = client.Do(request)
+		if isCanary {
+			log.Printf("Method: %s Path: %s is from a canary token, proxying without cache...", method, path)
+		} else {
+			log.Printf("Method: %s Path: %s is not cacheable, proxying without cache...", method, path)
+		}
+
+		// Vault is slow - shed non-cacheable requests to protect both the proxy and Vault
+		if p.upstreamLatency.shouldShed() {
+			log.Printf("LOAD SHEDDING: Method: %s Path: %s upstream p95 latency %v is above %v", method, path, p.upstreamLatency.p95(), p.upstreamLatency.threshold)
+			writer.Header().Set("Retry-After", strconv.Itoa(UNAVAILABLE_RETRY_AFTER))
+			writeVaultError(writer, http.StatusServiceUnavailable, "vault proxy is shedding load because vault is responding slowly")
+			return
+		}
+
+		response, err = p.doUpstream(client, request)
+		p.tokenErrors.recordResponse(tokenKey, response, err)
 
 		if err != nil {
-			// Todo: this should throw an alert in Datadog.
-			http.Error(writer, "Internal Server Error", http.StatusInternalServerError)
 			log.Print("UncacheableRequestError: ", err)
+			p.writeUpstreamError(writer, err, "vault proxy could not reach vault")
+			return
 		}
 	}
 
@@ -68,9 +175,15 @@ func (p *vaultProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request
 
 	copyHeaders(writer.Header(), response.Header)
 	writer.WriteHeader(response.StatusCode)
-	_, err = io.Copy(writer, response.Body)
 
-	if err != nil {
-		log.Fatal("Error copying response from cache.", err)
+	if shadowRequest != nil {
+		// Hash the primary body as it streams to the client, then compare against the shadow asynchronously
+		hasher := sha256.New()
+		// A truncated body would always mismatch, so only complete copies are compared
+		if copyResponseBody(io.MultiWriter(writer, hasher), response.Body, "vault") == nil {
+			go p.shadow.mirror(shadowRequest, response.StatusCode, hex.EncodeToString(hasher.Sum(nil)))
+		}
+	} else {
+		copyResponseBody(writer, response.Body, "vault")
 	}
 }
@@ -0,0 +1,226 @@
+package vault_proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVaultClosingBeforeHeadersIsBadGateway(t *testing.T) {
+	// Vault accepts the connection, then hangs up without writing anything
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		connection, _, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijacking the connection: %v", err)
+			return
+		}
+		connection.Close()
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		recorder := httptest.NewRecorder()
+		chain.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		if recorder.Code != http.StatusBadGateway {
+			t.Errorf("%s: got status %d, want %d", method, recorder.Code, http.StatusBadGateway)
+		}
+		if body := recorder.Body.String(); !strings.Contains(body, "vault closed the connection without sending a response") {
+			t.Errorf("%s: got body %q, want the closed connection error", method, body)
+		}
+	}
+}
+
+func TestSlowVaultTimesOutWithVaultError(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-release:
+		case <-request.Context().Done():
+		}
+	})
+	timeout := &requestTimeout{timeout: 50 * time.Millisecond}
+	handler := timeout.RequestTimeoutHandler(chain)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newTestRequest(method, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: answered after %v, want soon after the 50ms deadline", method, elapsed)
+		}
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: got status %d, want %d", method, recorder.Code, http.StatusGatewayTimeout)
+		}
+		if body := recorder.Body.String(); body != `{"errors":["request timed out at proxy"]}` {
+			t.Errorf("%s: got body %q, want the Vault-format timeout error", method, body)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", method, contentType)
+		}
+	}
+}
+
+// Returns the address of a port nothing listens on anymore
+func closedAddress(t *testing.T) string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := server.Listener.Addr().String()
+	server.Close()
+	return address
+}
+
+func TestAllPathsFailedIsStructuredUnavailable(t *testing.T) {
+	host, port, _ := net.SplitHostPort(closedAddress(t))
+	t.Setenv("VAULT_SCHEME", "http")
+	t.Setenv("VAULT_ADDR", host)
+	t.Setenv("VAULT_PORT", port)
+	config := newTestConfig(t)
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+
+	// The owning agent is down too, and nothing is cached
+	agent := newTestAgent(t, "127.0.0.1:7444", closedAddress(t))
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	chain := NewParseHeader(config).ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+
+	recorder := httptest.NewRecorder()
+	chain.ServeHTTP(recorder, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if body := recorder.Body.String(); body != `{"errors":["vault proxy could not serve the request from any agent, the cache or vault"]}` {
+		t.Errorf("got body %q, want the Vault-format error naming every failed path", body)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != strconv.Itoa(UNAVAILABLE_RETRY_AFTER) {
+		t.Errorf("got Retry-After %q, want %d", retryAfter, UNAVAILABLE_RETRY_AFTER)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+}
+
+func TestHttp10ClientConnectionHeadersStayOnItsLeg(t *testing.T) {
+	upstream := make(chan *http.Request, 2)
+	chain, _ := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		upstream <- request
+		writer.Header().Set("Connection", "X-Vault-Hop")
+		writer.Header().Set("X-Vault-Hop", "vault")
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	server := httptest.NewServer(chain)
+	t.Cleanup(server.Close)
+
+	connection, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("connecting to the proxy: %v", err)
+	}
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+
+	// A legacy client asks to keep its HTTP/1.0 connection open, for a read and then a write
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		fmt.Fprintf(connection, "%s /v1/secret/data/foo HTTP/1.0\r\nHost: vault\r\n%s: token\r\nContent-Length: 0\r\n"+
+			"Connection: keep-alive, X-Client-Hop\r\nKeep-Alive: timeout=5\r\nProxy-Connection: keep-alive\r\nX-Client-Hop: client\r\n\r\n", method, VAULT_TOKEN_HEADER)
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: reading the response: %v", method, err)
+		}
+		readBody(t, response)
+
+		if response.StatusCode != http.StatusOK || response.ProtoMajor != 1 || response.ProtoMinor != 0 {
+			t.Errorf("%s: got %s %d, want HTTP/1.0 200", method, response.Proto, response.StatusCode)
+		}
+		if connectionHeader := response.Header.Get("Connection"); !strings.EqualFold(connectionHeader, "keep-alive") {
+			t.Errorf("%s: got Connection %q on the client leg, want keep-alive", method, connectionHeader)
+		}
+		if hop := response.Header.Get("X-Vault-Hop"); hop != "" {
+			t.Errorf("%s: Vault's hop-by-hop header reached the client: %q", method, hop)
+		}
+
+		request := <-upstream
+		if request.ProtoMajor != 1 || request.ProtoMinor != 1 || request.Close {
+			t.Errorf("%s: upstream request is %s with Close %v, want a persistent HTTP/1.1 connection", method, request.Proto, request.Close)
+		}
+		for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "X-Client-Hop"} {
+			if value := request.Header.Get(name); value != "" {
+				t.Errorf("%s: hop-by-hop header %s leaked upstream: %q", method, name, value)
+			}
+		}
+	}
+}
+
+func TestCanaryTokenIsNeverServedFromCache(t *testing.T) {
+	var fetches int32
+	config := newTestVault(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		writer.Write([]byte(`{"data":{"value":"secret"}}`))
+	})
+	config.BurstLimitPerSecond, config.RateLimitPerMinute, config.RateLimiterBucketSize = 1000000, 1000000, 1000000
+	agent := newTestAgent(t, "127.0.0.1:7444", "127.0.0.1:7444")
+	rateLimiter := NewTokenRateLimiter(config, agent.vaultCache)
+	proxy := NewVaultProxy(config, agent.vaultCache, NewShadowMirror(config))
+	parseHeader := NewParseHeader(config)
+	parseHeader.canaryTokenHashes = []string{parseHeader.getMD5HashedLimiterKey("canary")}
+	chain := parseHeader.ParseHeaderHandler(agent.VaultAgentHandler(rateLimiter.RateLimitHandler(proxy)))
+
+	// A valid entry for the canary's own key, as cached before it became a canary
+	cache := agent.vaultCache.(*vaultCache)
+	entryKey := cacheReadWithToken(t, cache, NewParseHeader(config), "/v1/secret/data/foo", "canary")
+	if _, isCached := cache.getFromCache(entryKey); !isCached {
+		t.Fatal("the canary's entry was not cached")
+	}
+
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "canary")
+	if statuses := serveTimes(chain, request, 3); countStatus(statuses, http.StatusOK) != 3 {
+		t.Fatalf("got statuses %v for the canary", statuses)
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 3 {
+		t.Errorf("got %d fetches from Vault for 3 canary reads, want every read to reach Vault", fetches)
+	}
+
+	// Other tokens are still answered from cache
+	atomic.StoreInt32(&fetches, 0)
+	serveTimes(chain, newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token"), 3)
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Errorf("got %d fetches from Vault for 3 reads of another token, want 1", fetches)
+	}
+}
+
+func TestConfiguredForbiddenIsCachedForItsTtl(t *testing.T) {
+	defer func(ttls map[int]int) { CACHEABLE_ERROR_STATUS_TTLS = ttls }(CACHEABLE_ERROR_STATUS_TTLS)
+	CACHEABLE_ERROR_STATUS_TTLS = map[int]int{http.StatusForbidden: 2}
+	var fetches int32
+	chain, agent := newTestProxyChain(t, func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		writeVaultError(writer, http.StatusForbidden, "permission denied")
+	})
+	request := newTestRequest(http.MethodGet, "/v1/secret/data/foo", "172.16.0.1:1234", "token")
+
+	// A client polling until its policy is attached
+	if statuses := serveTimes(chain, request, 3); countStatus(statuses, http.StatusForbidden) != 3 {
+		t.Fatalf("got statuses %v, want the 403 every time", statuses)
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Errorf("got %d fetches from Vault within the 403's TTL, want 1", fetches)
+	}
+
+	cache := agent.vaultCache.(*vaultCache)
+	for key, entry := range cache.cache {
+		if ttl := time.Until(time.UnixMilli(entry.expires)); ttl <= time.Second || ttl > 2*time.Second {
+			t.Errorf("403 %s is cached for %v, want its 2s TTL", key, ttl)
+		}
+	}
+	expireEntries(cache, time.Second)
+	if statuses := serveTimes(chain, request, 1); statuses[0] != http.StatusForbidden {
+		t.Errorf("got status %d after the 403 expired", statuses[0])
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 2 {
+		t.Errorf("got %d fetches from Vault, want the expired 403 refetched", fetches)
+	}
+}